@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// expandArgs replaces $(NAME) references in the command and its arguments with the values of
+// the resolved variables, as Kubernetes does for a container's command and args. $$ is a
+// literal $, so $$(NAME) is kept as $(NAME). References to undefined variables are kept as
+// they are, or rejected with --strict-args. Secrets are never expanded, as arguments are
+// visible to every user of the machine.
+func expandArgs(opts *options, command []string, vars []env.ResolvedVar) ([]string, error) {
+	if !opts.expandArgs {
+		return command, nil
+	}
+
+	merged, _ := env.Merge(vars)
+	values := make(map[string]env.ResolvedVar, len(merged))
+	for _, v := range merged {
+		values[v.Name] = v
+	}
+
+	expanded := make([]string, 0, len(command))
+	var problems []error
+	for _, arg := range command {
+		expanded = append(expanded, expandArg(arg, func(name string) (string, bool) {
+			v, ok := values[name]
+			switch {
+			case ok && (v.Source == env.SourceSecret || v.Source == env.SourceFile):
+				problems = append(problems, fmt.Errorf("$(%s) holds a secret or file value, which would be visible in the process list", name))
+			case ok:
+				return v.Value, true
+			case opts.strictArgs:
+				problems = append(problems, fmt.Errorf("$(%s) is not a resolved variable", name))
+			}
+			return "", false
+		}))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("--expand-args: %w", errors.Join(problems...))
+	}
+	return expanded, nil
+}
+
+// expandArg expands the $(NAME) references of the argument with lookup, keeping the ones it
+// reports as unknown
+func expandArg(arg string, lookup func(name string) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '$' || i+1 == len(arg) {
+			b.WriteByte(arg[i])
+			continue
+		}
+
+		switch next := arg[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '(':
+			end := strings.IndexByte(arg[i+2:], ')')
+			if end < 0 {
+				b.WriteByte('$')
+				continue
+			}
+			name := arg[i+2 : i+2+end]
+			if value, ok := lookup(name); ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(arg[i : i+3+end])
+			}
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
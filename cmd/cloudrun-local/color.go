@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// noColorEnv turns colours off when set to any non-empty value, see https://no-color.org
+const noColorEnv = "NO_COLOR"
+
+// ANSI escape sequences of the colours of diagnostics
+const (
+	colorReset   = "\x1b[0m"
+	colorRed     = "\x1b[31m"
+	colorGreen   = "\x1b[32m"
+	colorYellow  = "\x1b[33m"
+	colorBlue    = "\x1b[34m"
+	colorMagenta = "\x1b[35m"
+	colorCyan    = "\x1b[36m"
+)
+
+// sourceColors are the colours of the sources --explain reports
+var sourceColors = map[env.Source]string{
+	env.SourceMetadata:   colorCyan,
+	env.SourceConfig:     colorGreen,
+	env.SourceSecret:     colorMagenta,
+	env.SourceSecretFile: colorMagenta,
+	env.SourceImage:      colorBlue,
+	env.SourceFile:       colorYellow,
+	env.SourceShell:      colorYellow,
+	sourceTransform:      colorBlue,
+}
+
+// logColor is whether the logger colours its output, set by setupLogger
+var logColor bool
+
+// colorEnabled reports whether diagnostics written to f are coloured: f is a terminal,
+// and neither --no-color nor NO_COLOR turns colours off. Windows consoles don't all
+// understand the escape sequences, so diagnostics are never coloured there.
+func colorEnabled(opts *options, f *os.File) bool {
+	if opts.noColor || os.Getenv(noColorEnv) != "" || os.Getenv("TERM") == "dumb" || runtime.GOOS == "windows" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps the text in the colour, if enabled
+func paint(enabled bool, color, text string) string {
+	if !enabled || color == "" {
+		return text
+	}
+	return color + text + colorReset
+}
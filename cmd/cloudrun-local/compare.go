@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/cloudrun"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// Values of --format of the compare command
+const (
+	compareFormatTable = "table"
+	compareFormatJSON  = "json"
+)
+
+// Kinds of drift between the config and the deployed resource
+const (
+	driftServiceAccount      = "service-account"
+	driftMissingLocally      = "missing-locally"
+	driftMissingInProduction = "missing-in-production"
+	driftValue               = "value"
+	driftSecret              = "secret"
+	driftSecretVersion       = "secret-version"
+)
+
+// drift is a difference between the config and the deployed resource. Secret values are
+// never fetched, secret-backed definitions are compared by their references.
+type drift struct {
+	Container  string `json:"container,omitempty"`
+	Name       string `json:"name"` // Variable, secret volume file, or serviceAccount
+	Local      string `json:"local"`
+	Production string `json:"production"`
+	Drift      string `json:"drift"`
+}
+
+// runCompare compares the service account, variables and secret references of every
+// container of the config with the deployed Service or Job of the same name in --region,
+// or the region of the config's location label. Fails after printing the differences, if
+// there are any.
+func runCompare(ctx context.Context, opts *options) error {
+	if opts.format != compareFormatTable && opts.format != compareFormatJSON {
+		return fmt.Errorf("unsupported format: %s (expected %s or %s)", opts.format, compareFormatTable, compareFormatJSON)
+	}
+	local, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("parse config: %w", err)}
+	}
+	for _, warning := range local.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+	if local.ServiceName == "" {
+		return &stageError{stage: stageConfig, err: errors.New("config has no name to look up the deployed resource by")}
+	}
+	if err := determineProject(ctx, local); err != nil {
+		return err
+	}
+	region := opts.region
+	if region == "" {
+		region = local.Region
+	}
+	if region == "" {
+		return &stageError{stage: stageUsage, err: errors.New("config has no location label, pass --region, the region the service is deployed in")}
+	}
+
+	// The deployed resource is read as the local identity, the service account rarely has access
+	tokens, err := auth.NewDefaultTokenSource(ctx, httpClient)
+	if err != nil {
+		return &stageError{stage: stageAuth, err: err}
+	}
+	data, err := cloudrun.NewClient(httpClient, tokens).Get(ctx, local.ProjectID, region, local.Kind, local.ServiceName)
+	if err != nil {
+		return &stageError{stage: stageAuth, err: fmt.Errorf("read deployed %s %s: %w", local.Kind, local.ServiceName, err)}
+	}
+	production, err := config.ParseReader(bytes.NewReader(data), config.Selector{}, config.FormatJSON)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("parse deployed %s %s: %w", local.Kind, local.ServiceName, err)}
+	}
+	// Short secret names of the deployed resource are in the project it's deployed in
+	production.ProjectID = local.ProjectID
+
+	drifts := compareConfigs(local, production)
+	if err := printDrifts(opts.format, drifts); err != nil {
+		return err
+	}
+
+	if len(drifts) > 0 {
+		return &stageError{
+			stage: stageConfig,
+			err:   fmt.Errorf("%s differs from the deployed %s %s in %d places", opts.configFile, local.Kind, local.ServiceName, len(drifts)),
+		}
+	}
+	logger.InfoContext(ctx, fmt.Sprintf("%s matches the deployed %s %s", opts.configFile, local.Kind, local.ServiceName))
+	return nil
+}
+
+// compareConfigs returns the differences between the local and the deployed config.
+// Containers are matched by name, or as they are if both have a single one, as the
+// deployed containers may be named when the local ones aren't.
+func compareConfigs(local, production *config.Config) []drift {
+	drifts := []drift{}
+	if local.ServiceAccount != production.ServiceAccount {
+		drifts = append(drifts, drift{
+			Name:       "serviceAccount",
+			Local:      local.ServiceAccount,
+			Production: production.ServiceAccount,
+			Drift:      driftServiceAccount,
+		})
+	}
+
+	if len(local.Containers) == 1 && len(production.Containers) == 1 {
+		return append(drifts, compareContainers(local.Containers[0].Name, local, &local.Containers[0], production, &production.Containers[0])...)
+	}
+
+	for i := range local.Containers {
+		container := &local.Containers[i]
+		deployed := findContainer(production, container.Name)
+		if deployed == nil {
+			drifts = append(drifts, drift{Container: container.Name, Name: "container", Local: container.Name, Drift: driftMissingInProduction})
+			continue
+		}
+		drifts = append(drifts, compareContainers(container.Name, local, container, production, deployed)...)
+	}
+	for _, container := range production.Containers {
+		if findContainer(local, container.Name) == nil {
+			drifts = append(drifts, drift{Container: container.Name, Name: "container", Production: container.Name, Drift: driftMissingLocally})
+		}
+	}
+	return drifts
+}
+
+// findContainer returns the container of the config with the name, nil if there is none
+func findContainer(cfg *config.Config, name string) *config.Container {
+	for i := range cfg.Containers {
+		if cfg.Containers[i].Name == name {
+			return &cfg.Containers[i]
+		}
+	}
+	return nil
+}
+
+// definition is how a variable or secret volume file is defined, for comparing and printing
+type definition struct {
+	text   string
+	secret string // Canonical name of the referenced secret, if any
+}
+
+// compareContainers returns the differences between the variables and secret volume files
+// of a local and a deployed container, in the order the local one defines them, followed by
+// the ones only deployed
+func compareContainers(name string, local *config.Config, container *config.Container, production *config.Config, deployed *config.Container) []drift {
+	localNames, localDefs := containerDefinitions(local, container)
+	productionNames, productionDefs := containerDefinitions(production, deployed)
+
+	var drifts []drift
+	for _, key := range localNames {
+		localDef := localDefs[key]
+		productionDef, ok := productionDefs[key]
+		switch {
+		case !ok:
+			drifts = append(drifts, drift{Container: name, Name: key, Local: localDef.text, Drift: driftMissingInProduction})
+		case localDef.text == productionDef.text:
+		case localDef.secret != "" && localDef.secret == productionDef.secret:
+			drifts = append(drifts, drift{Container: name, Name: key, Local: localDef.text, Production: productionDef.text, Drift: driftSecretVersion})
+		case localDef.secret != "" || productionDef.secret != "":
+			drifts = append(drifts, drift{Container: name, Name: key, Local: localDef.text, Production: productionDef.text, Drift: driftSecret})
+		default:
+			drifts = append(drifts, drift{Container: name, Name: key, Local: localDef.text, Production: productionDef.text, Drift: driftValue})
+		}
+	}
+	for _, key := range productionNames {
+		if _, ok := localDefs[key]; !ok {
+			drifts = append(drifts, drift{Container: name, Name: key, Production: productionDefs[key].text, Drift: driftMissingLocally})
+		}
+	}
+	return drifts
+}
+
+// containerDefinitions returns the names of the container's variables and secret volume
+// files in order, and their definitions. Of a variable defined twice, the last one counts.
+func containerDefinitions(cfg *config.Config, container *config.Container) ([]string, map[string]definition) {
+	var names []string
+	definitions := make(map[string]definition)
+	add := func(name string, def definition) {
+		if _, ok := definitions[name]; !ok {
+			names = append(names, name)
+		}
+		definitions[name] = def
+	}
+
+	for _, envVar := range container.EnvironmentVars {
+		switch {
+		case envVar.SecretRef != nil:
+			secret := canonicalSecret(envVar.SecretRef, cfg.ProjectID)
+			add(envVar.Name, definition{text: fmt.Sprintf("sm://%s/versions/%s", secret, envVar.SecretRef.Key), secret: secret})
+		case envVar.FieldRef != "":
+			add(envVar.Name, definition{text: "fieldRef " + envVar.FieldRef})
+		default:
+			add(envVar.Name, definition{text: envVar.Value})
+		}
+	}
+	for _, file := range container.SecretFiles {
+		secret := canonicalSecret(file.SecretRef, cfg.ProjectID)
+		add(file.Path, definition{text: fmt.Sprintf("sm://%s/versions/%s", secret, file.SecretRef.Key), secret: secret})
+	}
+	return names, definitions
+}
+
+// printDrifts prints the differences to stdout in the format
+func printDrifts(format string, drifts []drift) error {
+	if format == compareFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(drifts)
+	}
+
+	if len(drifts) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tNAME\tLOCAL\tPRODUCTION\tDRIFT")
+	for _, d := range drifts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orDash(d.Container), d.Name, orDash(d.Local), orDash(d.Production), d.Drift)
+	}
+	return w.Flush()
+}
+
+// orDash returns the value, or - for an empty one, keeping table columns aligned
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
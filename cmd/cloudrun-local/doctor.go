@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/iam"
+	"github.com/ngalaiko/cloudrun-local/internal/secrets"
+
+	"golang.org/x/oauth2"
+)
+
+// Outcomes of a doctor check
+const (
+	doctorPass = "ok"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCheck is the outcome of checking one part of the local setup
+type doctorCheck struct {
+	name   string
+	status string
+	detail string
+	hint   string // How to fix a failed check or what to look at for a warning
+	stage  string // Stage a failure is reported with
+}
+
+// doctorSecret is a secret version referenced by the config, checked once however often
+// it is referenced
+type doctorSecret struct {
+	canonical string
+	ref       *config.SecretRef
+}
+
+// runDoctor checks the local setup step by step and prints a checklist: the gcloud
+// configuration, the application default credentials, the config and its project,
+// impersonation of its service account, access to each referenced secret and, with
+// --permissions, the listed IAM permissions. Checks that depend on a failed one are
+// skipped. Fails if any check failed.
+func runDoctor(ctx context.Context, opts *options) error {
+	var checks []doctorCheck
+	report := func(check doctorCheck) {
+		checks = append(checks, check)
+		printDoctorCheck(check)
+	}
+
+	configDir, err := config.GcloudConfigDir()
+	if err == nil {
+		_, err = os.Stat(configDir)
+	}
+	if err != nil {
+		report(doctorCheck{
+			name:   "gcloud configuration",
+			status: doctorFail,
+			detail: err.Error(),
+			hint:   "Install the gcloud CLI and run 'gcloud init', or point CLOUDSDK_CONFIG at its configuration directory",
+			stage:  stageAuth,
+		})
+	} else {
+		report(doctorCheck{name: "gcloud configuration", status: doctorPass, detail: configDir})
+	}
+
+	credsType, credsErr := auth.ApplicationDefaultCredentialsType()
+	if credsErr != nil {
+		report(doctorCheck{
+			name:   "Application default credentials",
+			status: doctorFail,
+			detail: credsErr.Error(),
+			hint:   "Run 'gcloud auth application-default login'",
+			stage:  stageAuth,
+		})
+	} else {
+		report(doctorCheck{name: "Application default credentials", status: doctorPass, detail: credsType})
+	}
+
+	identity := ""
+	if credsErr != nil {
+		report(doctorCheck{name: "Source identity", status: doctorSkip, detail: "needs application default credentials"})
+	} else {
+		identity = doctorIdentity(ctx, report)
+	}
+
+	cfg, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
+	if err != nil {
+		report(doctorCheck{
+			name:   "Config",
+			status: doctorFail,
+			detail: err.Error(),
+			hint:   "Pass the config with -c, e.g. exported with 'gcloud run services describe SERVICE --format export'",
+			stage:  stageConfig,
+		})
+		return doctorResult(checks)
+	}
+	for _, warning := range cfg.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+	report(doctorCheck{name: "Config", status: doctorPass, detail: fmt.Sprintf("%s, service account %s", opts.configFile, cfg.ServiceAccount)})
+
+	var permissions []config.Permission
+	if opts.permissionsFile != "" {
+		if permissions, err = loadDoctorPermissions(opts.permissionsFile); err != nil {
+			report(doctorCheck{
+				name:   "Permissions file",
+				status: doctorFail,
+				detail: err.Error(),
+				hint:   "List the permissions under 'permissions:', each a name or a permission with a resource",
+				stage:  stageConfig,
+			})
+		} else {
+			report(doctorCheck{name: "Permissions file", status: doctorPass, detail: fmt.Sprintf("%s, %d permissions", opts.permissionsFile, len(permissions))})
+		}
+	}
+
+	projectCheck := doctorProject(ctx, cfg)
+	report(projectCheck)
+	if projectCheck.status == doctorFail {
+		return doctorResult(checks)
+	}
+
+	var token *oauth2.Token
+	if credsErr != nil {
+		report(doctorCheck{name: "Impersonation", status: doctorSkip, detail: "needs application default credentials"})
+	} else if token, err = auth.NewTokenSource(ctx, apiClient(cfg, opts), cfg.ServiceAccount, auth.SecretManagerScope).Token(); err != nil {
+		report(doctorCheck{
+			name:   "Impersonation",
+			status: doctorFail,
+			detail: err.Error(),
+			hint: fmt.Sprintf(
+				"Grant the Service Account Token Creator role: gcloud iam service-accounts add-iam-policy-binding %s --member=%s --role=roles/iam.serviceAccountTokenCreator",
+				cfg.ServiceAccount, iamMember(identity),
+			),
+			stage: stageAuth,
+		})
+	} else {
+		report(doctorCheck{name: "Impersonation", status: doctorPass, detail: cfg.ServiceAccount})
+	}
+
+	referenced := doctorSecrets(cfg)
+	if token == nil {
+		if len(referenced) > 0 {
+			report(doctorCheck{name: "Secrets", status: doctorSkip, detail: fmt.Sprintf("%d referenced, need impersonation", len(referenced))})
+		}
+		if len(permissions) > 0 {
+			report(doctorCheck{name: "Permissions", status: doctorSkip, detail: fmt.Sprintf("%d listed, need impersonation", len(permissions))})
+		}
+		return doctorResult(checks)
+	}
+
+	client := secrets.NewClient(apiClient(cfg, opts), token.AccessToken, cfg.ProjectID)
+	for _, secret := range referenced {
+		report(doctorSecretCheck(ctx, client, cfg.ServiceAccount, secret))
+	}
+
+	iamClient := iam.NewClient(apiClient(cfg, opts), token.AccessToken)
+	for _, resource := range permissionResources(permissions, cfg.ProjectID, referenced) {
+		report(doctorPermissionsCheck(ctx, iamClient, cfg.ServiceAccount, resource))
+	}
+
+	return doctorResult(checks)
+}
+
+// doctorIdentity checks that the default credentials can get a token and returns the identity
+// they name, empty if unknown
+func doctorIdentity(ctx context.Context, report func(doctorCheck)) string {
+	identity, err := auth.SourceIdentity(ctx, httpClient)
+	switch {
+	case errors.Is(err, auth.ErrNoEmailClaim):
+		report(doctorCheck{name: "Source identity", status: doctorPass, detail: "credentials work, but don't name their identity"})
+		return ""
+	case err != nil:
+		report(doctorCheck{
+			name:   "Source identity",
+			status: doctorFail,
+			detail: err.Error(),
+			hint:   "Log in again with 'gcloud auth application-default login'",
+			stage:  stageAuth,
+		})
+		return ""
+	default:
+		report(doctorCheck{name: "Source identity", status: doctorPass, detail: identity})
+		return identity
+	}
+}
+
+// doctorProject checks that the project of the config resolves and reports where from. A
+// gcloud configuration set to another project is a warning, as it's easily mistaken for
+// the project secrets are read from.
+func doctorProject(ctx context.Context, cfg *config.Config) doctorCheck {
+	gcloudProject, gcloudConfig, gcloudErr := config.GcloudActiveProject()
+
+	source := "the service account"
+	if cfg.ProjectID == "" {
+		if projectID, err := config.GetDefaultProjectID(ctx); err == nil {
+			cfg.ProjectID, source = projectID, "application default credentials"
+		} else if gcloudErr == nil {
+			cfg.ProjectID, source = gcloudProject, "gcloud configuration "+gcloudConfig
+		} else {
+			return doctorCheck{
+				name:   "Project",
+				status: doctorFail,
+				detail: fmt.Sprintf("service account %s doesn't carry a project, and none is configured locally", cfg.ServiceAccount),
+				hint:   "Set one with 'gcloud config set project PROJECT'",
+				stage:  stageConfig,
+			}
+		}
+	}
+
+	if gcloudErr == nil && gcloudProject != cfg.ProjectID {
+		return doctorCheck{
+			name:   "Project",
+			status: doctorWarn,
+			detail: fmt.Sprintf("%s from %s, but gcloud configuration %s uses %s", cfg.ProjectID, source, gcloudConfig, gcloudProject),
+			hint:   fmt.Sprintf("Secrets with short names are read from %s, make sure that's the intended project", cfg.ProjectID),
+		}
+	}
+	return doctorCheck{name: "Project", status: doctorPass, detail: fmt.Sprintf("%s from %s", cfg.ProjectID, source)}
+}
+
+// doctorSecrets returns the secret versions referenced by the variables and secret volumes
+// of every container, in config order
+func doctorSecrets(cfg *config.Config) []doctorSecret {
+	var (
+		result []doctorSecret
+		seen   = make(map[string]bool)
+	)
+	add := func(ref *config.SecretRef) {
+		canonical := canonicalSecret(ref, cfg.ProjectID)
+		if seen[canonical+"@"+ref.Key] {
+			return
+		}
+		seen[canonical+"@"+ref.Key] = true
+		result = append(result, doctorSecret{canonical: canonical, ref: ref})
+	}
+
+	for _, container := range cfg.Containers {
+		for _, envVar := range container.EnvironmentVars {
+			if envVar.SecretRef != nil {
+				add(envVar.SecretRef)
+			}
+		}
+		for _, file := range container.SecretFiles {
+			add(file.SecretRef)
+		}
+	}
+	return result
+}
+
+// doctorSecretCheck checks that the service account can access the secret version, or one
+// of the versions a key lists, falling back as resolution does. The value is fetched, as
+// that's what the access is granted for, but never printed.
+func doctorSecretCheck(ctx context.Context, client *secrets.Client, serviceAccount string, secret doctorSecret) doctorCheck {
+	name := fmt.Sprintf("Secret %s@%s", secret.canonical, secret.ref.Key)
+
+	var (
+		version string
+		err     error
+		skipped error // Of the first version, if another one is accessible
+	)
+	for i, candidate := range secret.ref.Versions() {
+		var accessed *secrets.SecretVersion
+		version = candidate
+		accessed, err = client.AccessSecretVersion(ctx, secret.ref.Secret(), version)
+		if err == nil {
+			if i > 0 {
+				return doctorCheck{
+					name:   name,
+					status: doctorWarn,
+					detail: fmt.Sprintf("accessible, falls back to version %s", accessed.Version),
+					hint:   fmt.Sprintf("Version %s is unusable (%v), drop it from the key or reference another version", secret.ref.Versions()[0], skipped),
+				}
+			}
+			detail := "accessible"
+			if accessed.Version != version {
+				detail = fmt.Sprintf("accessible, version %s", accessed.Version)
+			}
+			return doctorCheck{name: name, status: doctorPass, detail: detail}
+		}
+		if !errors.Is(err, secrets.ErrNotFound) && !errors.Is(err, secrets.ErrDisabled) && !errors.Is(err, secrets.ErrDestroyed) {
+			break
+		}
+		if skipped == nil {
+			skipped = err
+		}
+	}
+
+	project, secretName := "", secret.canonical
+	if rest, ok := strings.CutPrefix(secret.canonical, "projects/"); ok {
+		project, secretName, _ = strings.Cut(rest, "/secrets/")
+	}
+
+	check := doctorCheck{name: name, status: doctorFail, detail: err.Error(), stage: stageSecret}
+	switch {
+	case errors.Is(err, secrets.ErrNotFound):
+		check.hint = fmt.Sprintf("Check the name and version exist: gcloud secrets versions list %s --project %s", secretName, project)
+	case errors.Is(err, secrets.ErrDisabled):
+		check.hint = fmt.Sprintf("Enable the version again: gcloud secrets versions enable %s --secret=%s --project %s", version, secretName, project)
+	case errors.Is(err, secrets.ErrDestroyed):
+		check.hint = "Destroyed versions can't be recovered, reference another version"
+	case errors.Is(err, secrets.ErrCorrupted):
+		check.hint = "Retry, and check the proxies between Secret Manager and this machine if it persists"
+	default:
+		check.hint = fmt.Sprintf(
+			"Grant the Secret Accessor role: gcloud secrets add-iam-policy-binding %s --project %s --member=serviceAccount:%s --role=roles/secretmanager.secretAccessor",
+			secretName, project, serviceAccount,
+		)
+	}
+	return check
+}
+
+// doctorResource is a resource with the permissions tested on it
+type doctorResource struct {
+	name        string
+	permissions []string
+}
+
+// loadDoctorPermissions reads the permissions file, checking that the resources are supported
+func loadDoctorPermissions(filename string) ([]config.Permission, error) {
+	permissions, err := config.LoadPermissions(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, permission := range permissions {
+		if permission.Resource == "" {
+			continue
+		}
+		if err := iam.ValidateResource(permission.Resource); err != nil {
+			return nil, fmt.Errorf("permission %s: %w", permission.Permission, err)
+		}
+	}
+	return permissions, nil
+}
+
+// permissionResources groups the permissions by the resource they're tested on, in the
+// order of the file. Permissions without a resource are tested on the project, except
+// those of Secret Manager secrets and versions, which are tested on every referenced secret.
+func permissionResources(permissions []config.Permission, projectID string, referenced []doctorSecret) []doctorResource {
+	var (
+		result []doctorResource
+		index  = make(map[string]int)
+	)
+	add := func(resource, permission string) {
+		i, ok := index[resource]
+		if !ok {
+			i = len(result)
+			index[resource] = i
+			result = append(result, doctorResource{name: resource})
+		}
+		if !slices.Contains(result[i].permissions, permission) {
+			result[i].permissions = append(result[i].permissions, permission)
+		}
+	}
+
+	for _, permission := range permissions {
+		isSecret := strings.HasPrefix(permission.Permission, "secretmanager.secrets.") ||
+			strings.HasPrefix(permission.Permission, "secretmanager.versions.")
+		switch {
+		case permission.Resource != "":
+			add(permission.Resource, permission.Permission)
+		case isSecret && len(referenced) > 0:
+			for _, secret := range referenced {
+				add(secret.canonical, permission.Permission)
+			}
+		default:
+			add("projects/"+projectID, permission.Permission)
+		}
+	}
+	return result
+}
+
+// doctorPermissionsCheck checks that the service account has the permissions on the resource
+func doctorPermissionsCheck(ctx context.Context, client *iam.Client, serviceAccount string, resource doctorResource) doctorCheck {
+	name := "Permissions on " + resource.name
+
+	missing, err := client.Missing(ctx, resource.name, resource.permissions)
+	switch {
+	case err != nil:
+		return doctorCheck{
+			name:   name,
+			status: doctorFail,
+			detail: err.Error(),
+			hint:   "Check the resource exists and the permissions apply to its type",
+			stage:  stageAuth,
+		}
+	case len(missing) > 0:
+		return doctorCheck{
+			name:   name,
+			status: doctorFail,
+			detail: "missing " + strings.Join(missing, ", "),
+			hint:   fmt.Sprintf("Grant serviceAccount:%s a role including them on %s, or on a parent of it", serviceAccount, resource.name),
+			stage:  stageAuth,
+		}
+	default:
+		return doctorCheck{name: name, status: doctorPass, detail: strings.Join(resource.permissions, ", ")}
+	}
+}
+
+// iamMember returns the IAM member of the identity, or a placeholder if it's unknown
+func iamMember(identity string) string {
+	switch {
+	case identity == "":
+		return "user:YOUR_EMAIL"
+	case strings.HasSuffix(identity, ".gserviceaccount.com"):
+		return "serviceAccount:" + identity
+	default:
+		return "user:" + identity
+	}
+}
+
+// printDoctorCheck prints a line of the checklist, with the hint below a check that
+// didn't pass
+func printDoctorCheck(check doctorCheck) {
+	fmt.Printf("%-6s %s: %s\n", "["+check.status+"]", check.name, check.detail)
+	if check.hint != "" {
+		fmt.Printf("       %s\n", check.hint)
+	}
+}
+
+// doctorResult summarizes the checks, failing with the stage of the first failed one
+func doctorResult(checks []doctorCheck) error {
+	var failed []doctorCheck
+	for _, check := range checks {
+		if check.status == doctorFail {
+			failed = append(failed, check)
+		}
+	}
+
+	if len(failed) == 0 {
+		fmt.Println("\nAll checks passed")
+		return nil
+	}
+
+	fmt.Println()
+	err := fmt.Errorf("%d of %d checks failed", len(failed), len(checks))
+	if len(failed) == 1 {
+		err = fmt.Errorf("1 of %d checks failed: %s", len(checks), failed[0].name)
+	}
+	return &stageError{stage: failed[0].stage, err: err}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// Stages of a run, reported by --error-format json
+const (
+	stageUsage     = "usage"
+	stageConfig    = "config"
+	stageAuth      = "auth"
+	stageSecret    = "secret"
+	stageImage     = "image"
+	stageTransform = "transform"
+	stageExec      = "exec"
+	stageTimeout   = "timeout"
+	stageWarning   = "warning"
+)
+
+// stageError attributes an error to the stage of the run it happened in
+type stageError struct {
+	stage          string
+	serviceAccount string // Service account being impersonated, if relevant
+	err            error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// errorReport is the error printed by --error-format json
+type errorReport struct {
+	Stage          string `json:"stage"`
+	Message        string `json:"message"`
+	Secret         string `json:"secret,omitempty"`
+	ServiceAccount string `json:"service_account,omitempty"`
+	ExitCode       int    `json:"exit_code"`
+}
+
+// printError prints the error of a failed run in the format selected by --error-format.
+// The error is nil if the command exited with a non-zero code on its own.
+func printError(opts *options, err error, code int) {
+	if opts.errorFormat != "json" {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", paint(colorEnabled(opts, os.Stderr), colorRed, "Error:"), err)
+		}
+		return
+	}
+
+	report := errorReport{Stage: stageUsage, ExitCode: code}
+	if err == nil {
+		report.Stage = stageExec
+		report.Message = fmt.Sprintf("command exited with code %d", code)
+	} else {
+		report.Message = err.Error()
+	}
+
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		report.Stage = stageErr.stage
+		report.ServiceAccount = stageErr.serviceAccount
+	}
+	var timeoutErr *timeoutError
+	if errors.As(err, &timeoutErr) {
+		report.Stage = stageTimeout
+	}
+	var secretErr *env.SecretError
+	if errors.As(err, &secretErr) {
+		report.Secret = secretErr.Secret
+	}
+
+	_ = json.NewEncoder(os.Stderr).Encode(report)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// terminationGracePeriod is how long a terminated command may take to exit before it is killed
+const terminationGracePeriod = 10 * time.Second
+
+// runExec runs the command with the resolved environment. With --watch-secrets, the
+// environment is resolved again and the command restarted whenever a latest secret has a
+// new version.
+func runExec(ctx context.Context, opts *options, command []string) error {
+	if len(command) == 0 {
+		return errors.New("exec requires a command to run")
+	}
+	if opts.metadataAddr != "" {
+		return errors.New("--metadata-addr only applies to serve")
+	}
+	if opts.lazySecrets {
+		return errors.New("--lazy-secrets only applies to serve, exec has no metadata server to fetch them from")
+	}
+	if opts.accessBoundary != "" {
+		return errors.New("--access-boundary only applies to serve: exec can't downscope tokens, its command mints its own from the credentials file with all of the service account's access")
+	}
+
+	if opts.replace && !canReplaceProcess {
+		logger.WarnContext(ctx, "--replace is not supported on Windows, running the command as a child process")
+		opts.replace = false
+	}
+	if opts.replace {
+		// Nothing would be left to enforce these once the command replaces the process
+		if opts.timeout > 0 {
+			return errors.New("--timeout can't be combined with --replace")
+		}
+		if opts.applySecurityContext {
+			return errors.New("--apply-security-context can't be combined with --replace")
+		}
+		if opts.enforceTimeout {
+			return errors.New("--enforce-timeout can't be combined with --replace")
+		}
+		if len(opts.pgSSL) > 0 {
+			return errors.New("--pg-ssl-* can't be combined with --replace, nothing would be left to remove the files")
+		}
+		if len(opts.gcsFiles) > 0 {
+			return errors.New("--file-from-gcs can't be combined with --replace, nothing would be left to remove the files")
+		}
+		// Nothing would be left to remove the credentials file either, so none is written,
+		// unless it's a session's, which outlives the run anyway
+		if opts.session == "" {
+			opts.noCredsFile = true
+		}
+	}
+	if err := checkWatchSecrets(opts); err != nil {
+		return err
+	}
+	if err := checkCleanEnv(opts); err != nil {
+		return err
+	}
+	if opts.strictArgs && !opts.expandArgs {
+		return errors.New("--strict-args requires --expand-args")
+	}
+
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := checkSecurityContext(cfg, opts); err != nil {
+		return err
+	}
+
+	watcher := newSecretWatcher(ctx, cfg, opts)
+	for {
+		err := execCommand(ctx, cfg, opts, command, watcher)
+		if watcher != nil {
+			logExit(ctx, err)
+		}
+		if !errors.Is(err, errSecretRotated) {
+			return err
+		}
+	}
+}
+
+// execCommand resolves the environment and runs the command with it once
+func execCommand(ctx context.Context, cfg *config.Config, opts *options, command []string, watcher *secretWatcher) error {
+	resolver, envVars, err := resolve(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	merged, err := mergeShell(ctx, opts, envVars)
+	if err != nil {
+		return err
+	}
+	explain(ctx, opts, merged, envVars)
+
+	command, err = expandArgs(opts, command, envVars)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: err}
+	}
+
+	if opts.replace {
+		// Everything the run leaves behind is handled before the process is gone
+		cleanup(ctx, resolver)
+		if err := checkWarnings(opts); err != nil {
+			return err
+		}
+		return replaceProcess(command, env.Strings(merged), workingDir(ctx, cfg, opts))
+	}
+
+	// The command must still be able to read the credentials and secret files as another user
+	ownedFiles := secretFilePaths(resolver, envVars)
+	for _, envVar := range envVars {
+		if envVar.Name == "GOOGLE_APPLICATION_CREDENTIALS" {
+			ownedFiles = append(ownedFiles, envVar.Value)
+		}
+	}
+
+	return watcher.run(ctx, resolver, func(ctx context.Context) error {
+		return withTaskTimeout(ctx, cfg, opts, func(ctx context.Context) error {
+			return runCommand(ctx, command, env.Strings(merged), workingDir(ctx, cfg, opts), securityContext(cfg, opts), opts.childOutput, ownedFiles...)
+		})
+	})
+}
+
+// defaultTaskTimeout is the timeout of a job's task that doesn't set timeoutSeconds
+const defaultTaskTimeout = 10 * time.Minute
+
+// withTaskTimeout runs the command of a job with --enforce-timeout until the timeout of its
+// task expires, when it's terminated like any canceled command. Fails with exit code 124
+// then, whatever the command exited with.
+func withTaskTimeout(ctx context.Context, cfg *config.Config, opts *options, run func(context.Context) error) error {
+	if !opts.enforceTimeout || cfg.Kind != "Job" {
+		return run(ctx)
+	}
+
+	timeout, reason := cfg.Timeout, "the timeoutSeconds of the job"
+	if timeout == 0 {
+		timeout, reason = defaultTaskTimeout, "the default timeout of a job's task"
+	}
+	timeoutErr := &timeoutError{timeout: timeout, reason: reason}
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, timeoutErr)
+	defer cancel()
+
+	err := run(ctx)
+	if err != nil && context.Cause(ctx) == timeoutErr {
+		return &exitCodeError{code: exitCodeTimeout, err: timeoutErr}
+	}
+	return err
+}
+
+// securityContext returns the security context to run the command with, nil unless
+// --apply-security-context is set
+func securityContext(cfg *config.Config, opts *options) *config.SecurityContext {
+	if !opts.applySecurityContext {
+		return nil
+	}
+	return cfg.SecurityContext
+}
+
+// checkSecurityContext rejects --apply-security-context for a container without a runAsUser
+// or runAsGroup, which would otherwise run the command as the current user without notice
+func checkSecurityContext(cfg *config.Config, opts *options) error {
+	if !opts.applySecurityContext {
+		return nil
+	}
+	if cfg.SecurityContext == nil || (cfg.SecurityContext.RunAsUser == nil && cfg.SecurityContext.RunAsGroup == nil) {
+		return &stageError{stage: stageConfig, err: errors.New("--apply-security-context: the container's securityContext sets neither runAsUser nor runAsGroup")}
+	}
+	return nil
+}
+
+// Values of --env-precedence
+const (
+	precedenceShellWins  = "shell-wins"
+	precedenceConfigWins = "config-wins"
+)
+
+// mergeShell merges the variables with the inherited shell environment, the shell
+// taking precedence unless --env-precedence is config-wins. Image defaults never win
+// over the shell, as values such as the image's PATH don't apply locally.
+func mergeShell(ctx context.Context, opts *options, vars []env.ResolvedVar) ([]env.ResolvedVar, error) {
+	shell := inheritedShell(ctx, opts)
+	if opts.envPrecedence == precedenceConfigWins {
+		image := slices.DeleteFunc(slices.Clone(vars), func(v env.ResolvedVar) bool {
+			return v.Source != env.SourceImage
+		})
+		vars = slices.DeleteFunc(slices.Clone(vars), func(v env.ResolvedVar) bool {
+			return v.Source == env.SourceImage
+		})
+		return merge(ctx, opts, image, shell, vars)
+	}
+	return merge(ctx, opts, vars, shell)
+}
+
+// checkCleanEnv rejects --preserve without --clean-env, and the patterns of the shell
+// variables to inherit along with it
+func checkCleanEnv(opts *options) error {
+	switch {
+	case len(opts.preserve) > 0 && !opts.cleanEnv:
+		return errors.New("--preserve requires --clean-env")
+	case opts.cleanEnv && (len(opts.envPassthrough) > 0 || len(opts.envBlock) > 0):
+		return errors.New("--clean-env can't be combined with --env-passthrough or --env-block, name the variables to inherit with --preserve")
+	default:
+		return nil
+	}
+}
+
+// inheritedShell returns the variables of the shell the command inherits: the ones matching
+// --env-passthrough, or all of them without it, except the ones matching --env-block. With
+// --clean-env, only the ones named by --preserve are inherited.
+func inheritedShell(ctx context.Context, opts *options) []env.ResolvedVar {
+	shell := env.FromEnviron(os.Environ())
+	if len(opts.envPassthrough) == 0 && len(opts.envBlock) == 0 && !opts.cleanEnv {
+		return shell
+	}
+
+	total := len(shell)
+	inherited := slices.DeleteFunc(shell, func(v env.ResolvedVar) bool {
+		if opts.cleanEnv {
+			return !slices.Contains(opts.preserve, v.Name)
+		}
+		passed := len(opts.envPassthrough) == 0 || matchesAny(opts.envPassthrough, v.Name)
+		return !passed || matchesAny(opts.envBlock, v.Name)
+	})
+	logger.DebugContext(ctx, fmt.Sprintf("Inheriting %d of the shell's %d variables", len(inherited), total))
+	return inherited
+}
+
+// appendPattern appends a glob pattern of variable names to the patterns, rejecting a malformed one
+func appendPattern(patterns *[]string, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	*patterns = append(*patterns, pattern)
+	return nil
+}
+
+// matchesAny reports whether the name matches any of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// workingDir returns the directory to run the command in, falling back to the
+// current directory if the configured one doesn't exist locally
+func workingDir(ctx context.Context, cfg *config.Config, opts *options) string {
+	dir := cfg.WorkingDir
+	if opts.workDir != "" {
+		dir = opts.workDir
+	}
+	if dir == "" {
+		return ""
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		logger.WarnContext(ctx, fmt.Sprintf("working directory %s does not exist locally, using current directory", dir))
+		return ""
+	}
+
+	return dir
+}
+
+// replaceProcess replaces the process with the command, in dir with the environment, so it
+// keeps the PID and the parent of cloudrun-local. Only returns if the command couldn't be started.
+func replaceProcess(command []string, environ []string, dir string) error {
+	path, err := exec.LookPath(command[0])
+	if err == nil && dir != "" {
+		err = os.Chdir(dir)
+	}
+	if err == nil {
+		err = execve(path, command, environ)
+	}
+	return &exitCodeError{
+		code: exitCodeStartFailure,
+		err:  &stageError{stage: stageExec, err: fmt.Errorf("replace process with command: %w", err)},
+	}
+}
+
+// commandOutput is where a command writes instead of the process's own stdout and stderr
+type commandOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// runCommand executes the command in dir with the environment. If a security context is
+// given, the command runs as its user and the owned files are handed over to that user.
+// Without an output, the command inherits stdin, stdout and stderr.
+func runCommand(
+	ctx context.Context,
+	command []string,
+	environ []string,
+	dir string,
+	securityContext *config.SecurityContext,
+	output *commandOutput,
+	ownedFiles ...string,
+) error {
+	//nolint:gosec // looks insecure, but that's kind of the point
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = dir
+
+	if securityContext != nil {
+		if err := applySecurityContext(ctx, cmd, securityContext, ownedFiles...); err != nil {
+			return &stageError{stage: stageExec, err: err}
+		}
+	}
+
+	// Like Cloud Run, give the command a chance to shut down before it is killed
+	cmd.Cancel = func() error {
+		return terminate(cmd.Process)
+	}
+	cmd.WaitDelay = terminationGracePeriod
+
+	cmd.Env = environ
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Commands sharing the terminal with others don't read from it
+	if output != nil {
+		cmd.Stdin = nil
+		cmd.Stdout = output.stdout
+		cmd.Stderr = output.stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		return &exitCodeError{
+			code: exitCodeStartFailure,
+			err:  &stageError{stage: stageExec, err: fmt.Errorf("start command: %w", err)},
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &exitCodeError{code: exitErr.ExitCode()}
+		}
+		return &stageError{stage: stageExec, err: fmt.Errorf("execute command: %w", err)}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+func TestInheritedShell(t *testing.T) {
+	t.Setenv("APP_HOST", "localhost")
+	t.Setenv("APP_TOKEN", "s3cret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	tests := []struct {
+		name        string
+		passthrough []string
+		block       []string
+		want        []string
+	}{
+		{name: "everything by default", want: []string{"APP_HOST", "APP_TOKEN", "AWS_REGION"}},
+		{name: "passthrough only", passthrough: []string{"APP_*"}, want: []string{"APP_HOST", "APP_TOKEN"}},
+		{name: "block only", block: []string{"AWS_*"}, want: []string{"APP_HOST", "APP_TOKEN"}},
+		{name: "block wins over passthrough", passthrough: []string{"APP_*"}, block: []string{"*_TOKEN"}, want: []string{"APP_HOST"}},
+		{name: "block of a passed name", passthrough: []string{"APP_HOST"}, block: []string{"APP_HOST"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &options{envPassthrough: tt.passthrough, envBlock: tt.block}
+
+			var got []string
+			for _, v := range inheritedShell(t.Context(), opts) {
+				if slices.Contains([]string{"APP_HOST", "APP_TOKEN", "AWS_REGION"}, v.Name) {
+					got = append(got, v.Name)
+				}
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSecurityContext(t *testing.T) {
+	uid := int64(1000)
+	tests := []struct {
+		name            string
+		securityContext *config.SecurityContext
+		apply           bool
+		wantErr         bool
+	}{
+		{name: "not applied", apply: false},
+		{name: "runAsUser", securityContext: &config.SecurityContext{RunAsUser: &uid}, apply: true},
+		{name: "runAsGroup", securityContext: &config.SecurityContext{RunAsGroup: &uid}, apply: true},
+		{name: "no securityContext", apply: true, wantErr: true},
+		{name: "empty securityContext", securityContext: &config.SecurityContext{}, apply: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{SecurityContext: tt.securityContext}
+			err := checkSecurityContext(cfg, &options{applySecurityContext: tt.apply})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSecurityContext() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// canReplaceProcess reports whether --replace can replace the process with the command
+const canReplaceProcess = true
+
+// execve replaces the process with the program at path
+func execve(path string, argv []string, environ []string) error {
+	return syscall.Exec(path, argv, environ)
+}
+
+// terminate asks the process to shut down gracefully
+func terminate(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+// applySecurityContext makes the command run as the user and group of the security context.
+// The files are handed over to that user, so the command can still read them.
+func applySecurityContext(_ context.Context, cmd *exec.Cmd, securityContext *config.SecurityContext, files ...string) error {
+	uid, gid := int64(os.Getuid()), int64(os.Getgid())
+	if securityContext.RunAsUser != nil {
+		uid = *securityContext.RunAsUser
+	}
+	if securityContext.RunAsGroup != nil {
+		gid = *securityContext.RunAsGroup
+	}
+	if uid < 0 || uid > math.MaxUint32 || gid < 0 || gid > math.MaxUint32 {
+		return fmt.Errorf("invalid security context: uid %d, gid %d", uid, gid)
+	}
+
+	if uid == int64(os.Getuid()) && gid == int64(os.Getgid()) {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("--apply-security-context requires running as root to switch to another user")
+	}
+
+	for _, file := range files {
+		if err := os.Lchown(file, int(uid), int(gid)); err != nil {
+			return fmt.Errorf("change owner of %s: %w", file, err)
+		}
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: uint32(uid), //nolint:gosec // checked above
+			Gid: uint32(gid), //nolint:gosec // checked above
+		},
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// canReplaceProcess reports whether --replace can replace the process with the command,
+// Windows can only start new processes
+const canReplaceProcess = false
+
+// execve is never called on Windows, see canReplaceProcess
+func execve(_ string, _ []string, _ []string) error {
+	return errors.New("replacing the process is not supported on Windows")
+}
+
+// terminate stops the process, Windows has no graceful termination signal
+func terminate(p *os.Process) error {
+	return p.Kill()
+}
+
+// applySecurityContext does nothing, Windows has no uid and gid to switch to
+func applySecurityContext(ctx context.Context, _ *exec.Cmd, _ *config.SecurityContext, _ ...string) error {
+	logger.WarnContext(ctx, "--apply-security-context is not supported on Windows, ignoring")
+	return nil
+}
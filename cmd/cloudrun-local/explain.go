@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// metadataVars are the names of all automatic variables, the last ones are only set by serve
+// and up --port
+var metadataVars = []string{
+	"K_SERVICE",
+	"K_CONFIGURATION",
+	"K_REVISION",
+	"CLOUD_RUN_JOB",
+	"CLOUD_RUN_EXECUTION",
+	"CLOUD_RUN_TASK_INDEX",
+	"CLOUD_RUN_TASK_ATTEMPT",
+	"CLOUD_RUN_TASK_COUNT",
+	"GOOGLE_CLOUD_PROJECT",
+	"CLOUD_RUN_REGION",
+	"CLOUD_RUN_TIMEOUT_SECONDS",
+	"GOOGLE_APPLICATION_CREDENTIALS",
+	"GCE_METADATA_HOST",
+	"GCE_METADATA_IP",
+	"CLOUDRUN_LOCAL_METADATA_ADDR",
+	"PORT",
+}
+
+// checkNoMetadataVars warns about --no-metadata-var names that aren't automatic variables,
+// built-in or from --metadata-file
+func checkNoMetadataVars(ctx context.Context, opts *options) {
+	for _, name := range opts.noMetadataVars {
+		fromFile := slices.ContainsFunc(opts.metadataFileVars, func(v env.ResolvedVar) bool {
+			return v.Name == name
+		})
+		if !slices.Contains(metadataVars, name) && !fromFile {
+			logger.WarnContext(ctx, fmt.Sprintf("--no-metadata-var %s is not an automatic variable, known ones are: %s", name, strings.Join(metadataVars, ", ")))
+		}
+	}
+}
+
+// merge combines layers of variables by precedence. Automatic metadata variables
+// dropped with --no-metadata-var are left out. Automatic variables shadowed by a
+// user-supplied value are reported in verbose mode or with --fail-on-warning, and
+// rejected with --strict-overrides.
+func merge(ctx context.Context, opts *options, layers ...[]env.ResolvedVar) ([]env.ResolvedVar, error) {
+	if len(opts.noMetadataVars) > 0 {
+		filtered := make([][]env.ResolvedVar, 0, len(layers))
+		for _, layer := range layers {
+			filtered = append(filtered, slices.DeleteFunc(slices.Clone(layer), func(v env.ResolvedVar) bool {
+				// --no-metadata-var takes the unprefixed names
+				name := v.Name
+				if opts.prefixMetadata {
+					name = strings.TrimPrefix(name, opts.prefix)
+				}
+				return v.Source == env.SourceMetadata && slices.Contains(opts.noMetadataVars, name)
+			}))
+		}
+		layers = filtered
+	}
+
+	merged, overrides := env.Merge(layers...)
+
+	for _, override := range overrides {
+		if override.Overridden.Source != env.SourceMetadata {
+			continue
+		}
+
+		message := fmt.Sprintf("%s from %s overrides the automatic value: %s (automatic: %s)",
+			override.By.Name,
+			override.By.Source,
+			displayValue(opts, override.By),
+			displayValue(opts, override.Overridden),
+		)
+		if opts.strictOverrides {
+			return nil, fmt.Errorf("%s", message)
+		}
+		if opts.verbose || opts.explain || opts.failOnWarning {
+			logger.WarnContext(ctx, message)
+		}
+	}
+
+	return merged, nil
+}
+
+// explain logs the source of each of the named variables if --explain is set
+func explain(ctx context.Context, opts *options, vars []env.ResolvedVar, names []env.ResolvedVar) {
+	if !opts.explain {
+		return
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, v := range names {
+		wanted[v.Name] = true
+	}
+
+	for _, v := range vars {
+		if !wanted[v.Name] {
+			continue
+		}
+		logger.InfoContext(ctx, fmt.Sprintf("%s=%s (%s)", v.Name, displayValue(opts, v), paint(logColor, sourceColors[v.Source], string(v.Source))))
+	}
+}
+
+// minEncodedLength is the shortest secret value checked for a leftover base64 encoding,
+// shorter values are too likely to be plain words
+const minEncodedLength = 12
+
+// warnEncodedSecrets warns in verbose mode about secret values that still look base64-encoded,
+// which usually means the secret was stored encoded by mistake
+func warnEncodedSecrets(ctx context.Context, opts *options, vars []env.ResolvedVar) {
+	if !opts.verbose {
+		return
+	}
+
+	for _, v := range vars {
+		if v.Source == env.SourceSecret && looksBase64(v.Value) {
+			logger.WarnContext(ctx, fmt.Sprintf("the value of secret variable %s looks base64-encoded, check how the secret was created", v.Name))
+		}
+	}
+}
+
+// looksBase64 reports whether the value is valid base64 decoding to readable text.
+// Random tokens that happen to use only base64 characters decode to binary and aren't reported.
+func looksBase64(value string) bool {
+	if len(value) < minEncodedLength {
+		return false
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		decoded, err := encoding.DecodeString(value)
+		if err != nil || !utf8.Valid(decoded) {
+			continue
+		}
+		printable := strings.IndexFunc(string(decoded), func(r rune) bool {
+			return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+		}) == -1
+		if printable {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of --mask-mode
+const (
+	maskNone    = "none"
+	maskFull    = "full"
+	maskPartial = "partial"
+)
+
+// defaultMaskKeep is the number of characters --mask-mode partial shows at each end of a value
+const defaultMaskKeep = 2
+
+// warnUnmasked warns that --mask-mode none prints secret values
+func warnUnmasked(ctx context.Context, opts *options) {
+	if opts.maskMode == maskNone {
+		logger.WarnContext(ctx, "--mask-mode none: secret values are printed in full in diagnostics, don't share the output or leave it in logs")
+	}
+}
+
+// displayValue returns the value of the variable as it can be shown in diagnostics.
+// Values of secrets and of --value-from-file files are masked as set by --mask-mode.
+func displayValue(opts *options, v env.ResolvedVar) string {
+	if v.Source != env.SourceSecret && v.Source != env.SourceFile {
+		return v.Value
+	}
+
+	switch opts.maskMode {
+	case maskNone:
+		return v.Value
+	case maskPartial:
+		// Values too short to keep at most half of them are masked in full
+		runes := []rune(v.Value)
+		if len(runes) < 4*opts.maskKeep {
+			return "***"
+		}
+		return string(runes[:opts.maskKeep]) + "***" + string(runes[len(runes)-opts.maskKeep:])
+	default:
+		return "***"
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/gcs"
+)
+
+// parseGCSVar parses a NAME=gcs://bucket/object flag value into the variable and the object's URL
+func parseGCSVar(value string) (name, reference string, err error) {
+	name, reference, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid value %s, expected NAME=%s://bucket/object", value, gcs.Scheme)
+	}
+	if _, _, err := gcs.ParseURL(reference); err != nil {
+		return "", "", err
+	}
+	return name, reference, nil
+}
+
+// appendGCSValue adds a --value-from-gcs variable, defined with the object's URL as its value
+// for the resolver to replace with the contents
+func appendGCSValue(opts *options, value string) error {
+	name, reference, err := parseGCSVar(value)
+	if err != nil {
+		return err
+	}
+	opts.gcsValues = append(opts.gcsValues, config.EnvVar{Name: name, Value: reference})
+	return nil
+}
+
+// appendGCSFile adds a --file-from-gcs variable, whose object is written to a temporary file
+// named like the object, which must be unique among the temporary files
+func appendGCSFile(opts *options, value string) error {
+	name, reference, err := parseGCSVar(value)
+	if err != nil {
+		return err
+	}
+	_, object, _ := gcs.ParseURL(reference)
+	filename := path.Base(object)
+
+	for _, file := range opts.gcsFiles {
+		if file.File.Path == filename {
+			return fmt.Errorf("%s and %s would both be written to %s, objects must have different names", file.Name, name, filename)
+		}
+	}
+	for _, file := range pgSSLFiles {
+		if file.filename == filename {
+			return fmt.Errorf("%s would be written to %s, which is reserved for --%s", name, filename, file.flag)
+		}
+	}
+
+	opts.gcsFiles = append(opts.gcsFiles, env.SecretFileVar{
+		Name:      name,
+		File:      config.SecretFile{Path: filename},
+		Reference: reference,
+	})
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// runGet prints the raw value of a single variable, fetching only the secret it references
+func runGet(ctx context.Context, opts *options, name string) error {
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	resolver, lock, err := newResolver(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	envVar, err := resolver.ResolveOne(ctx, name)
+	if errors.Is(err, env.ErrNotDeclared) {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("%s is not declared in %s", name, opts.configFile)}
+	}
+	if err != nil {
+		return &stageError{
+			stage:          stageSecret,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("resolve %s: %w", name, err),
+		}
+	}
+
+	warnFallbacks(ctx, resolver)
+
+	if err := saveLockfile(opts, lock); err != nil {
+		return err
+	}
+
+	// The value is printed as is, so it can be piped or captured without trimming
+	_, err = fmt.Fprint(os.Stdout, envVar.Value)
+	return err
+}
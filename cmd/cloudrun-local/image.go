@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/registry"
+)
+
+// imageEnv returns the ENV defaults of the container's image if --image-env is set
+func imageEnv(ctx context.Context, cfg *config.Config, opts *options) ([]env.ResolvedVar, error) {
+	if !opts.imageEnv {
+		return nil, nil
+	}
+	if cfg.Image == "" {
+		return nil, errors.New("--image-env requires the container to have an image")
+	}
+
+	ref, err := registry.ParseReference(cfg.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only Google registries get a token, with its own source like the metadata server's
+	var accessToken string
+	if registry.IsGoogleRegistry(ref.Registry) {
+		token, err := auth.NewTokenSource(ctx, apiClient(cfg, opts), cfg.ServiceAccount, auth.CloudPlatformScope).Token()
+		if err != nil {
+			return nil, fmt.Errorf("get access token for %s: %w", ref.Registry, err)
+		}
+		accessToken = token.AccessToken
+	}
+
+	environ, err := registry.NewClient(httpClient, accessToken).ImageEnv(ctx, cfg.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make([]env.ResolvedVar, 0, len(environ))
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if !selected(opts, name) {
+			continue
+		}
+		vars = append(vars, env.ResolvedVar{Name: name, Value: value, Source: env.SourceImage})
+	}
+	logger.DebugContext(ctx, fmt.Sprintf("Read %d variables from image %s", len(vars), cfg.Image))
+
+	return vars, nil
+}
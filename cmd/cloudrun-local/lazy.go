@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/metadata"
+)
+
+// lazyTokenWindow is how long the token of the resolver fetching lazy secrets must still be
+// valid for, before it is replaced by a new one
+const lazyTokenWindow = 5 * time.Minute
+
+// lazySecrets fetches the secret-backed variables of the config when the command first
+// requests them from the metadata server, and caches their values for the rest of the run
+type lazySecrets struct {
+	cfg     *config.Config
+	opts    *options
+	entries map[string]*lazySecret
+
+	mu       sync.Mutex // guards resolver
+	resolver *env.Resolver
+}
+
+// lazySecret is the value of a variable, fetched at most once
+type lazySecret struct {
+	mu      sync.Mutex
+	value   string
+	fetched bool
+}
+
+// newLazySecrets returns a provider of the variables of the config whose final definition
+// references a secret, restricted to the ones selected by --only and --env-prefix-filter
+func newLazySecrets(cfg *config.Config, opts *options) *lazySecrets {
+	entries := make(map[string]*lazySecret)
+	for _, envVar := range cfg.EnvironmentVars {
+		if !selected(opts, envVar.Name) {
+			continue
+		}
+		if envVar.Value == "" && envVar.SecretRef != nil {
+			entries[envVar.Name] = &lazySecret{}
+		} else {
+			delete(entries, envVar.Name)
+		}
+	}
+	return &lazySecrets{cfg: cfg, opts: opts, entries: entries}
+}
+
+// Secret implements metadata.SecretProvider. Failed fetches aren't cached, so the next
+// request tries again.
+func (l *lazySecrets) Secret(ctx context.Context, name string) (string, error) {
+	entry, ok := l.entries[name]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", name, metadata.ErrUnknownVariable)
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.fetched {
+		return entry.value, nil
+	}
+
+	resolver, err := l.currentResolver(ctx)
+	if err != nil {
+		return "", err
+	}
+	v, err := resolver.ResolveOne(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	logger.DebugContext(ctx, fmt.Sprintf("Fetched %s on first access", name))
+
+	entry.value, entry.fetched = v.Value, true
+	return entry.value, nil
+}
+
+// currentResolver returns a resolver whose token is valid for a while yet, replacing one
+// whose token is about to expire
+func (l *lazySecrets) currentResolver(ctx context.Context) (*env.Resolver, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.resolver != nil && time.Until(l.resolver.TokenExpiry()) > lazyTokenWindow {
+		return l.resolver, nil
+	}
+	if l.resolver != nil {
+		cleanup(ctx, l.resolver)
+		l.resolver = nil
+	}
+
+	// Unlike the one resolving the environment, this resolver fetches the secrets
+	opts := *l.opts
+	opts.lazySecrets = false
+	resolver, _, err := newResolver(ctx, l.cfg, &opts)
+	if err != nil {
+		return nil, err
+	}
+	l.resolver = resolver
+	return resolver, nil
+}
+
+// close cleans up the resolver, if one was created
+func (l *lazySecrets) close(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resolver != nil {
+		cleanup(ctx, l.resolver)
+	}
+}
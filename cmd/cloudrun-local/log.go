@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// logger writes cloudrun-local's own diagnostics, to stderr unless --log-file is set
+var logger = slog.New(countWarnings(newTextHandler(os.Stderr, slog.LevelInfo, false)))
+
+// warningCount is the number of warnings and errors logged during the run, for --fail-on-warning
+var warningCount atomic.Int64
+
+// warningMessages are the messages of the warnings and errors logged during the run, for --report
+var warningMessages struct {
+	sync.Mutex
+	messages []string
+}
+
+// setupLogger configures the logger from the flags. The returned function closes the log file.
+func setupLogger(opts *options) (func() error, error) {
+	level := slog.LevelInfo
+	if opts.verbose {
+		level = slog.LevelDebug
+	}
+
+	if opts.logFile == "" {
+		logColor = opts.logFormat != "json" && colorEnabled(opts, os.Stderr)
+
+		// Errors are printed by main, so quiet mode leaves nothing to log
+		if opts.quiet {
+			if opts.verbose || opts.explain {
+				return nil, errors.New("--quiet can't be combined with --verbose or --explain without --log-file")
+			}
+			logger = slog.New(countWarnings(slog.DiscardHandler))
+			return func() error { return nil }, nil
+		}
+		logger = slog.New(countWarnings(newLogHandler(opts, os.Stderr, level, logColor)))
+		return func() error { return nil }, nil
+	}
+
+	f, err := os.OpenFile(opts.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	logger = slog.New(countWarnings(newLogHandler(opts, f, level, false)))
+
+	return f.Close, nil
+}
+
+// newLogHandler returns the handler writing diagnostics in the format of --log-format. JSON
+// lines carry the time and level of each record and are never coloured.
+func newLogHandler(opts *options, w io.Writer, level slog.Level, color bool) slog.Handler {
+	if opts.logFormat == "json" {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	}
+	return newTextHandler(w, level, color)
+}
+
+// countingHandler counts warnings in warningCount and keeps their messages before passing
+// records on, including the ones the wrapped handler drops, such as in quiet mode
+type countingHandler struct {
+	slog.Handler
+}
+
+// countWarnings wraps the handler to count warnings
+func countWarnings(h slog.Handler) slog.Handler {
+	return &countingHandler{Handler: h}
+}
+
+// Enabled implements slog.Handler
+func (h *countingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler
+func (h *countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		warningCount.Add(1)
+		warningMessages.Lock()
+		warningMessages.messages = append(warningMessages.messages, r.Message)
+		warningMessages.Unlock()
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler
+func (h *countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &countingHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler
+func (h *countingHandler) WithGroup(name string) slog.Handler {
+	return &countingHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// textHandler is a slog handler writing human-readable lines, prefixing warnings and errors
+type textHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	color bool // Colour the prefixes of warnings and errors
+	attrs []slog.Attr
+}
+
+func newTextHandler(w io.Writer, level slog.Leveler, color bool) *textHandler {
+	return &textHandler{
+		mu:    &sync.Mutex{},
+		w:     w,
+		level: level,
+		color: color,
+	}
+}
+
+// Enabled implements slog.Handler
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle implements slog.Handler
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString(paint(h.color, colorRed, "Error:") + " ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString(paint(h.color, colorYellow, "Warning:") + " ")
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) bool {
+		// Errors read best as the continuation of the message
+		if a.Key == "error" {
+			fmt.Fprintf(&b, ": %v", a.Value)
+		} else {
+			fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// WithAttrs implements slog.Handler
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+// WithGroup implements slog.Handler, groups are flattened
+func (h *textHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
@@ -2,59 +2,524 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
 	"github.com/ngalaiko/cloudrun-local/internal/config"
 	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/gcs"
+	"github.com/ngalaiko/cloudrun-local/internal/httpclient"
+	"github.com/ngalaiko/cloudrun-local/internal/lockfile"
+	"github.com/ngalaiko/cloudrun-local/internal/secrets"
+	"github.com/ngalaiko/cloudrun-local/internal/vault"
+
+	"golang.org/x/oauth2"
 )
 
-const version = "0.1.0"
+// httpClient is shared by all API calls so connections are reused across them
+var httpClient = httpclient.New()
 
 func main() {
-	if err := run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	var opts options
+	if err := run(&opts); err != nil {
+		code := exitCodeFailure
+		var exitErr *exitCodeError
+		if errors.As(err, &exitErr) {
+			code, err = exitErr.code, exitErr.err
+		}
+		printError(&opts, err, code)
+		os.Exit(code)
+	}
+}
+
+// Exit codes of cloudrun-local itself. When the command runs to completion, its own exit code is used.
+const (
+	// exitCodeFailure is the exit code for config, auth and secret resolution errors
+	exitCodeFailure = 1
+	// exitCodeTimeout is the exit code when the run exceeds --timeout, or the task timeout of
+	// a job with --enforce-timeout, same as timeout(1)
+	exitCodeTimeout = 124
+	// exitCodeStartFailure is the exit code when the command could not be started
+	exitCodeStartFailure = 125
+)
+
+// exitCodeError makes the process exit with the given code once all cleanup has run.
+// The error, if set, is printed before exiting.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// timeoutError is the cause of the run context being canceled by --timeout, or of the
+// command's by --enforce-timeout
+type timeoutError struct {
+	timeout time.Duration
+	reason  string // What set the timeout, if not --timeout
+}
+
+func (e *timeoutError) Error() string {
+	if e.reason != "" {
+		return fmt.Sprintf("timed out after %s, %s", e.timeout, e.reason)
+	}
+	return fmt.Sprintf("timed out after %s", e.timeout)
+}
+
+// options holds the flags of all commands
+type options struct {
+	configFile           string
+	configFormat         config.Format
+	kind                 string
+	name                 string
+	revisionTemplate     string
+	lockFile             string
+	updateLock           bool
+	latestAs             string
+	maxSecrets           int
+	secretTransport      string
+	timeout              time.Duration
+	verbose              bool
+	failOnWarning        bool
+	quiet                bool
+	explain              bool
+	maskMode             string
+	maskKeep             int
+	strictOverrides      bool
+	strictSecrets        bool
+	imageEnv             bool
+	allowNoContainer     bool
+	only                 stringsFlag
+	envPrefixFilter      string
+	stripPrefix          bool
+	noCredsFile          bool
+	session              string
+	verifyIdentity       bool
+	emitServiceVars      bool
+	placeholders         stringsFlag
+	secretEnvMaps        stringsFlag
+	valueFiles           stringsFlag
+	noMetadataVars       stringsFlag
+	metadataFile         string
+	overridesFile        string
+	permissionsFile      string
+	region               string
+	metadataFileVars     []env.ResolvedVar // Read from metadataFile
+	logFile              string
+	errorFormat          string
+	logFormat            string
+	noColor              bool
+	workDir              string
+	applySecurityContext bool
+	envPrecedence        string
+	envPassthrough       []string // Patterns of the shell variables the command inherits, all if empty
+	envBlock             []string // Patterns of the shell variables the command doesn't inherit
+	cleanEnv             bool
+	expandArgs           bool
+	strictArgs           bool
+	preserve             []string // Shell variables the command inherits with cleanEnv
+	transform            string
+	prefix               string
+	prefixMetadata       bool
+	service              string
+	revision             string
+	outputFile           string
+	outputFD             int
+	outputFDFile         *os.File       // Opened from outputFD while parsing the flags
+	childOutput          *commandOutput // Where the command writes, stdout and stderr if nil
+	failFast             bool
+	report               string
+	reportIncludeValues  bool
+	port                 int
+	rulesFile            string
+	format               string
+	template             string
+	containerAll         bool
+	stream               bool
+	container            string
+	setVars              []config.EnvVar
+	gcsValues            []config.EnvVar     // Variables of --value-from-gcs, set to the object's URL
+	gcsFiles             []env.SecretFileVar // Objects of --file-from-gcs
+	containerEnvOnly     bool
+	quotaProject         string
+	replace              bool
+	enforceTimeout       bool
+	watchSecrets         bool
+	metadataAddr         string
+	lazySecrets          bool
+	accessBoundary       string
+	pgSSL                map[string]string // Secrets of the --pg-ssl-* flags, by flag
+	pollInterval         time.Duration
+	materializeDir       string
+	showVersion          bool
+	versionJSON          bool
+	showHelp             bool
+}
+
+// selector returns the selector of the resource to use from the config
+func (o *options) selector() config.Selector {
+	return config.Selector{Kind: o.kind, Name: o.name, Revision: o.revisionTemplate}
+}
+
+// revisionName returns the revision exposed as K_REVISION: --revision, or else the revision
+// whose template --revision-template selects, empty for the default
+func (o *options) revisionName() string {
+	if o.revision != "" {
+		return o.revision
 	}
+	return o.revisionTemplate
+}
+
+// stringsFlag is a flag that can be repeated, collecting all values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
 }
 
-func run() error {
-	// Parse flags
-	var (
-		configFile  string
-		showVersion bool
-		showHelp    bool
-	)
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// commands are the subcommands selected by the first argument
+var commands = []string{"compare", "doctor", "env", "exec", "get", "materialize", "precedence", "secrets", "serve", "session", "up", "validate", "whoami"}
+
+// newFlagSet creates a flag set with the flags of the command.
+// An empty name registers the flags of all commands for the legacy invocation style.
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("cloudrun-local "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Run 'cloudrun-local --help' for usage.")
+	}
+
+	fs.StringVar(&opts.configFile, "config", "service.yaml", "Path to Cloud Run service YAML config file")
+	fs.StringVar(&opts.configFile, "c", "service.yaml", "Path to Cloud Run service YAML config file (shorthand)")
+	fs.Func("kind", "Kind of the resource to use from a config with multiple documents: Service or Job", func(value string) error {
+		if value != "Service" && value != "Job" {
+			return errors.New("expected Service or Job")
+		}
+		opts.kind = value
+		return nil
+	})
+	fs.Func("config-format", "Parse the config as yaml or json instead of detecting it: auto, yaml or json", func(value string) error {
+		switch value {
+		case "auto":
+			opts.configFormat = config.FormatAuto
+		case string(config.FormatYAML), string(config.FormatJSON):
+			opts.configFormat = config.Format(value)
+		default:
+			return errors.New("expected auto, yaml or json")
+		}
+		return nil
+	})
+	fs.StringVar(&opts.name, "name", "", "Name of the resource to use from a config with multiple documents")
+	fs.StringVar(&opts.revisionTemplate, "revision-template", "", "Name of the revision template to use, of the Service or of a Revision in the config")
+	fs.StringVar(&opts.logFile, "log-file", "", "Write diagnostics to a file instead of stderr")
+	fs.BoolVar(&opts.quiet, "quiet", false, "Only print errors to stderr, diagnostics still go to --log-file")
+	fs.BoolVar(&opts.verbose, "verbose", false, "Print diagnostics, such as overridden automatic variables")
+	fs.BoolVar(&opts.failOnWarning, "fail-on-warning", false, "Fail at the end of the run if any warning was printed")
+	opts.errorFormat = "text"
+	fs.Func("error-format", "Format of the error printed on failure: text or json", func(value string) error {
+		if value != "text" && value != "json" {
+			return errors.New("expected text or json")
+		}
+		opts.errorFormat = value
+		return nil
+	})
+	opts.logFormat = "text"
+	fs.Func("log-format", "Format of diagnostics: text or json", func(value string) error {
+		if value != "text" && value != "json" {
+			return errors.New("expected text or json")
+		}
+		opts.logFormat = value
+		return nil
+	})
+	fs.BoolVar(&opts.noColor, "no-color", false, "Don't colour diagnostics, even on a terminal")
+	fs.BoolVar(&opts.showHelp, "help", false, "Show help information")
+	fs.BoolVar(&opts.showHelp, "h", false, "Show help information (shorthand)")
+
+	if name == "session" {
+		return fs
+	}
+
+	if name == "validate" {
+		fs.StringVar(&opts.rulesFile, "rules", "", "Path to a lint rules file")
+		return fs
+	}
+
+	if name == "secrets" {
+		fs.StringVar(&opts.format, "format", secretsFormatTable, "Output format of the secret references: table or json")
+		return fs
+	}
+
+	if name == "precedence" {
+		fs.StringVar(&opts.format, "format", precedenceFormatTable, "Output format of the definitions: table or json")
+		fs.Var(&opts.valueFiles, "value-from-file", "Set a variable to the trimmed content of a local file: NAME=path (repeatable)")
+		fs.StringVar(&opts.service, "service", "", "Service name exposed as K_SERVICE and K_CONFIGURATION (default: metadata.name)")
+		fs.StringVar(&opts.revision, "revision", "", "Revision name exposed as K_REVISION (default: --revision-template, or local)")
+		fs.BoolVar(&opts.emitServiceVars, "emit-service-vars", false, "Set K_SERVICE, K_CONFIGURATION and K_REVISION for jobs too")
+		fs.StringVar(&opts.region, "region", "", "Region exposed as CLOUD_RUN_REGION (default: the config's location label)")
+		fs.StringVar(&opts.overridesFile, "overrides-file", "", "YAML or JSON file of job execution overrides, whose env wins over the config's")
+		fs.StringVar(&opts.metadataFile, "metadata-file", "", "YAML or JSON file of additional automatic variables, below the config's")
+		envPrecedenceFlag(fs, opts)
+		containerFlags(fs, opts)
+		return fs
+	}
+
+	fs.StringVar(&opts.quotaProject, "quota-project", "", "Project billed for the quota of IAM and Secret Manager requests (default: the config's project)")
+
+	if name == "doctor" {
+		fs.StringVar(&opts.permissionsFile, "permissions", "", "YAML or JSON file of IAM permissions the service account is checked for")
+		return fs
+	}
+
+	if name == "compare" {
+		fs.StringVar(&opts.region, "region", "", "Region the service or job is deployed in (default: the config's location label)")
+		fs.StringVar(&opts.format, "format", compareFormatTable, "Output format of the differences: table or json")
+		return fs
+	}
+
+	if name == "whoami" {
+		fs.StringVar(&opts.format, "format", whoamiFormatTable, "Output format of the identity: table or json")
+		return fs
+	}
+
+	fs.StringVar(&opts.lockFile, "lockfile", "", "Path to a lockfile pinning the versions of latest secrets")
+	fs.BoolVar(&opts.updateLock, "update-lock", false, "Re-resolve latest secrets and update the lockfile")
+	fs.StringVar(&opts.latestAs, "secret-version-latest-as", "", "Fetch this version number for every latest secret reference")
+	fs.IntVar(&opts.maxSecrets, "max-concurrent-secrets", env.DefaultMaxConcurrentSecrets, "Maximum number of secrets fetched at once")
+	fs.StringVar(&opts.secretTransport, "secret-transport", secrets.TransportREST, "How Secret Manager is accessed: rest or grpc")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "Maximum duration of the whole run, including the command (default: no limit)")
+	fs.Var(&opts.secretEnvMaps, "secret-env-map", "Expand a secret holding a JSON object into variables: name[@version][:PREFIX_] (repeatable)")
+	fs.Var(&opts.valueFiles, "value-from-file", "Set a variable to the trimmed content of a local file: NAME=path (repeatable)")
+	fs.Func("value-from-gcs", "Set a variable to the contents of a Cloud Storage object: NAME=gcs://bucket/object (repeatable)", func(value string) error {
+		return appendGCSValue(opts, value)
+	})
+	fs.StringVar(&opts.service, "service", "", "Service name exposed as K_SERVICE and K_CONFIGURATION (default: metadata.name)")
+	fs.StringVar(&opts.revision, "revision", "", "Revision name exposed as K_REVISION (default: --revision-template, or local)")
+	fs.BoolVar(&opts.emitServiceVars, "emit-service-vars", false, "Set K_SERVICE, K_CONFIGURATION and K_REVISION for jobs too")
+	fs.StringVar(&opts.region, "region", "", "Region exposed as CLOUD_RUN_REGION (default: the config's location label)")
+	fs.StringVar(&opts.overridesFile, "overrides-file", "", "YAML or JSON file of job execution overrides, whose env wins over the config's")
+	fs.StringVar(&opts.metadataFile, "metadata-file", "", "YAML or JSON file of additional automatic variables, below the config's")
+	fs.BoolVar(&opts.noCredsFile, "no-creds-file", false, "Don't write a credentials file, leaving out GOOGLE_APPLICATION_CREDENTIALS")
+	fs.StringVar(&opts.session, "session", "", "Reuse the credentials file and access token of the named session across runs")
+	fs.BoolVar(&opts.verifyIdentity, "verify-identity", false, "Fail unless the impersonated access token belongs to the service account")
+	fs.BoolVar(&opts.allowNoContainer, "allow-no-container", false, "Warn instead of failing if the config has no containers")
+	containerFlags(fs, opts)
+
+	if name == "get" {
+		return fs
+	}
+
+	if name == "materialize" {
+		fs.StringVar(&opts.materializeDir, "dir", "", "Directory to write the secret files and their manifest to")
+		return fs
+	}
+
+	fs.Var(&opts.only, "only", "Only resolve the named variable, skipping the secrets of all others (repeatable)")
+	fs.StringVar(&opts.envPrefixFilter, "env-prefix-filter", "", "Only resolve the variables starting with a prefix, skipping the secrets of all others")
+	fs.BoolVar(&opts.stripPrefix, "strip-prefix", false, "Remove --env-prefix-filter from the names of the resolved variables")
+	fs.Var(&opts.noMetadataVars, "no-metadata-var", "Leave out an automatic variable, such as GOOGLE_APPLICATION_CREDENTIALS (repeatable)")
+	fs.BoolVar(&opts.explain, "explain", false, "Print the source of every variable to stderr")
+	opts.maskMode = maskFull
+	fs.Func("mask-mode", "How secret values are shown in diagnostics: none, full or partial", func(value string) error {
+		if value != maskNone && value != maskFull && value != maskPartial {
+			return fmt.Errorf("expected %s, %s or %s", maskNone, maskFull, maskPartial)
+		}
+		opts.maskMode = value
+		return nil
+	})
+	opts.maskKeep = defaultMaskKeep
+	fs.Func("mask-keep", "Number of characters shown at each end of secret values with --mask-mode partial (default: 2)", func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return errors.New("expected a number of at least 1")
+		}
+		opts.maskKeep = n
+		return nil
+	})
+	fs.BoolVar(&opts.strictOverrides, "strict-overrides", false, "Fail if a user-supplied value overrides an automatic variable")
+	fs.BoolVar(&opts.strictSecrets, "strict-secrets", false, "Fail if a variable is empty, a placeholder or an incomplete secret reference")
+	fs.BoolVar(&opts.imageEnv, "image-env", false, "Read the ENV defaults of the container's image from its registry, below the config's variables")
+	fs.Var(&opts.placeholders, "placeholder", "Value rejected by --strict-secrets, replacing the defaults such as CHANGEME (repeatable)")
+	fs.StringVar(&opts.prefix, "prefix", "", "Prepend a prefix to the names of the config's variables")
+	fs.BoolVar(&opts.prefixMetadata, "prefix-metadata", false, "Also prepend --prefix to the names of automatic variables")
+	fs.StringVar(&opts.transform, "transform", "", "Executable transforming the resolved variables, as JSON on stdin and stdout")
+	fs.BoolVar(&opts.containerEnvOnly, "container-env-only", false, "Leave out automatic variables and only impersonate if a secret is referenced")
+	fs.StringVar(&opts.report, "report", "", "Write a JSON report of the resolution to a file, with secret values masked")
+	fs.BoolVar(&opts.reportIncludeValues, "report-include-values", false, "Include secret values in the --report file unmasked")
+
+	if name == "up" {
+		fs.BoolVar(&opts.failFast, "fail-fast", false, "Stop all services once one of them fails")
+		fs.IntVar(&opts.port, "port", 0, "Set PORT of the services to consecutive ports from this one, in the order given (default: unset)")
+	}
 
-	flag.StringVar(&configFile, "config", "service.yaml", "Path to Cloud Run service YAML config file")
-	flag.StringVar(&configFile, "c", "service.yaml", "Path to Cloud Run service YAML config file (shorthand)")
-	flag.BoolVar(&showVersion, "version", false, "Show version information")
-	flag.BoolVar(&showVersion, "v", false, "Show version information (shorthand)")
-	flag.BoolVar(&showHelp, "help", false, "Show help information")
-	flag.BoolVar(&showHelp, "h", false, "Show help information (shorthand)")
+	if name == "" || name == "env" {
+		fs.StringVar(&opts.outputFile, "output", "", "Write environment variables to a file instead of stdout")
+		fs.StringVar(&opts.outputFile, "o", "", "Write environment variables to a file instead of stdout (shorthand)")
+		fs.Func("output-fd", "Write environment variables to a file descriptor inherited from the parent instead of stdout", func(value string) error {
+			return openOutputFD(opts, value)
+		})
+		fs.StringVar(&opts.format, "format", "env", "Output format of environment variables")
+		fs.StringVar(&opts.template, "template", "", "Go template rendering the variables with --format template")
+		fs.BoolVar(&opts.containerAll, "container-all", false, "Print the variables of every container, prefixed by the container name")
+		fs.BoolVar(&opts.stream, "stream", false, "Write each variable as soon as it's resolved instead of once all are")
+	}
 
-	flag.Parse()
+	if name != "env" {
+		fs.StringVar(&opts.workDir, "workdir", "", "Working directory for the command (default: the container's workingDir)")
+		fs.BoolVar(&opts.applySecurityContext, "apply-security-context", false, "Run the command as the container's securityContext runAsUser and runAsGroup")
+		fs.BoolVar(&opts.replace, "replace", false, "Replace cloudrun-local with the command instead of running it as a child process")
+		fs.BoolVar(&opts.enforceTimeout, "enforce-timeout", false, "Terminate a job's command once the timeoutSeconds of its task expires")
+		fs.BoolVar(&opts.watchSecrets, "watch-secrets", false, "Restart the command when a latest secret it references has a new version")
+		fs.DurationVar(&opts.pollInterval, "poll-interval", defaultPollInterval, "How often --watch-secrets checks for new versions")
+		fs.BoolVar(&opts.lazySecrets, "lazy-secrets", false, "Fetch the config's secrets when serve's command requests them from the metadata server")
+		fs.StringVar(&opts.accessBoundary, "access-boundary", "", "Credential Access Boundary JSON file limiting the tokens serve's metadata server hands out")
+		fs.StringVar(&opts.metadataAddr, "metadata-addr", "", "Address of serve's metadata server (default: "+defaultMetadataAddr+", or a free port if taken)")
+		opts.pgSSL = make(map[string]string)
+		for _, file := range pgSSLFiles {
+			fs.Func(file.flag, "Write a secret to a temporary file and set "+file.variable+" to its path: name[@version]", func(value string) error {
+				opts.pgSSL[file.flag] = value
+				return nil
+			})
+		}
+		fs.Func("file-from-gcs", "Write a Cloud Storage object to a temporary file and set a variable to its path: NAME=gcs://bucket/object (repeatable)", func(value string) error {
+			return appendGCSFile(opts, value)
+		})
+		fs.Func("env-passthrough", "Only inherit the shell variables matching a glob pattern (repeatable)", func(value string) error {
+			return appendPattern(&opts.envPassthrough, value)
+		})
+		fs.Func("env-block", "Don't inherit the shell variables matching a glob pattern (repeatable)", func(value string) error {
+			return appendPattern(&opts.envBlock, value)
+		})
+		fs.BoolVar(&opts.expandArgs, "expand-args", false, "Replace $(NAME) in the command's arguments with the values of resolved variables")
+		fs.BoolVar(&opts.strictArgs, "strict-args", false, "Fail if --expand-args finds a $(NAME) that isn't a resolved variable")
+		fs.BoolVar(&opts.cleanEnv, "clean-env", false, "Don't inherit the shell's variables, except the ones of --preserve")
+		fs.Func("preserve", "Shell variables inherited despite --clean-env: NAME[,NAME...] (repeatable)", func(value string) error {
+			for name := range strings.SplitSeq(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					opts.preserve = append(opts.preserve, name)
+				}
+			}
+			return nil
+		})
+		envPrecedenceFlag(fs, opts)
+	}
+
+	if name == "" {
+		fs.BoolVar(&opts.showVersion, "version", false, "Show version information")
+		fs.BoolVar(&opts.showVersion, "v", false, "Show version information (shorthand)")
+		fs.BoolVar(&opts.versionJSON, "json", false, "Print --version as JSON with the commit, build date and Go version")
+	}
+
+	return fs
+}
 
-	if showVersion {
-		fmt.Printf("cloudrun-local version %s\n", version)
+// envPrecedenceFlag registers --env-precedence
+func envPrecedenceFlag(fs *flag.FlagSet, opts *options) {
+	opts.envPrecedence = precedenceShellWins
+	fs.Func("env-precedence", "Whether the shell or the config wins for variables defined in both: shell-wins or config-wins", func(value string) error {
+		if value != precedenceShellWins && value != precedenceConfigWins {
+			return fmt.Errorf("expected %s or %s", precedenceShellWins, precedenceConfigWins)
+		}
+		opts.envPrecedence = value
+		return nil
+	})
+}
+
+// containerFlags registers --container and --set
+func containerFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.container, "container", "", "Name of the container to use from a multi-container config")
+	fs.Func("set", "Define a variable in the env of the selected container, winning over its own: NAME=VALUE (repeatable)", func(value string) error {
+		name, value, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return errors.New("expected NAME=VALUE")
+		}
+		opts.setVars = append(opts.setVars, config.EnvVar{Name: name, Value: value})
 		return nil
+	})
+}
+
+func run(opts *options) error {
+	args := os.Args[1:]
+
+	name := ""
+	if len(args) > 0 {
+		for _, command := range commands {
+			if args[0] == command {
+				name, args = args[0], args[1:]
+				break
+			}
+		}
 	}
 
-	if showHelp {
+	fs := newFlagSet(name, opts)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if opts.versionJSON && !opts.showVersion {
+		return errors.New("--json only applies to --version")
+	}
+
+	if opts.showVersion {
+		return printVersion(opts)
+	}
+
+	if opts.showHelp {
 		printHelp()
 		return nil
 	}
 
+	closeLog, err := setupLogger(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = closeLog()
+	}()
+
 	// Everything after flags is the command to run
-	command := flag.Args()
+	command := fs.Args()
+
+	// Without a subcommand, trailing arguments select exec and their absence selects env
+	if name == "" {
+		name = "env"
+		if len(command) > 0 {
+			name = "exec"
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Bound the whole run, resolution and command alike
+	if opts.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, opts.timeout, &timeoutError{timeout: opts.timeout})
+		defer cancelTimeout()
+	}
+
 	// Handle signals for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -63,80 +528,1053 @@ func run() error {
 		cancel()
 	}()
 
+	if err := readMetadataFile(ctx, opts); err != nil {
+		return err
+	}
+	checkNoMetadataVars(ctx, opts)
+	warnUnmasked(ctx, opts)
+
+	if impersonates(name, opts) {
+		ctx = auth.PrefetchSourceToken(ctx, httpClient)
+	}
+
+	switch name {
+	case "compare":
+		if len(command) > 0 {
+			return fmt.Errorf("compare does not run a command")
+		}
+		err = runCompare(ctx, opts)
+	case "doctor":
+		if len(command) > 0 {
+			return fmt.Errorf("doctor does not run a command")
+		}
+		err = runDoctor(ctx, opts)
+	case "env":
+		if len(command) > 0 {
+			return fmt.Errorf("env does not run a command, use exec: cloudrun-local exec -- %s", command[0])
+		}
+		err = runEnv(ctx, opts)
+	case "exec":
+		err = runExec(ctx, opts, command)
+	case "get":
+		if len(command) != 1 {
+			return errors.New("get requires exactly one variable name: cloudrun-local get [FLAGS] NAME")
+		}
+		err = runGet(ctx, opts, command[0])
+	case "materialize":
+		if len(command) > 0 {
+			return fmt.Errorf("materialize does not run a command")
+		}
+		err = runMaterialize(ctx, opts)
+	case "precedence":
+		if len(command) > 0 {
+			return fmt.Errorf("precedence does not run a command")
+		}
+		err = runPrecedence(ctx, opts)
+	case "secrets":
+		if len(command) > 0 {
+			return fmt.Errorf("secrets does not run a command")
+		}
+		err = runSecrets(ctx, opts)
+	case "session":
+		err = runSession(ctx, command)
+	case "up":
+		err = runUp(ctx, opts, command)
+	case "validate":
+		if len(command) > 0 {
+			return fmt.Errorf("validate does not run a command")
+		}
+		err = runValidate(ctx, opts)
+	case "whoami":
+		if len(command) > 0 {
+			return fmt.Errorf("whoami does not run a command")
+		}
+		err = runWhoami(ctx, opts)
+	default:
+		err = runServe(ctx, opts, command)
+	}
+
+	// Everything ran, but a strict run must not have printed any warning
+	if err == nil {
+		err = checkWarnings(opts)
+	}
+
+	// A command terminated by the timeout is not reported with its own exit code
+	var timeoutErr *timeoutError
+	if err != nil && errors.As(context.Cause(ctx), &timeoutErr) {
+		return &exitCodeError{code: exitCodeTimeout, err: timeoutErr}
+	}
+
+	return err
+}
+
+// checkWarnings fails a run with --fail-on-warning if any warning was logged
+func checkWarnings(opts *options) error {
+	if !opts.failOnWarning {
+		return nil
+	}
+	switch n := warningCount.Load(); {
+	case n == 1:
+		return &stageError{stage: stageWarning, err: errors.New("--fail-on-warning: a warning was logged")}
+	case n > 1:
+		return &stageError{stage: stageWarning, err: fmt.Errorf("--fail-on-warning: %d warnings were logged", n)}
+	default:
+		return nil
+	}
+}
+
+// loadConfig parses the Cloud Run config and determines its project
+func loadConfig(ctx context.Context, opts *options) (*config.Config, error) {
 	// Parse Cloud Run config
-	cfg, err := config.Parse(configFile)
+	cfg, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
 	if err != nil {
-		return fmt.Errorf("parse config: %w", err)
+		return nil, &stageError{stage: stageConfig, err: fmt.Errorf("parse config: %w", err)}
 	}
 
-	// Resolve environment variables
-	resolver, err := env.NewResolver(ctx, cfg)
+	for _, warning := range cfg.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+
+	if opts.overridesFile != "" {
+		overrides, err := config.LoadOverrides(opts.overridesFile)
+		if err == nil {
+			var warnings []string
+			cfg, warnings, err = cfg.WithOverrides(overrides)
+			for _, warning := range warnings {
+				logger.WarnContext(ctx, "--overrides-file: "+warning)
+			}
+		}
+		if err != nil {
+			return nil, &stageError{stage: stageConfig, err: fmt.Errorf("--overrides-file: %w", err)}
+		}
+	}
+
+	switch {
+	case opts.containerAll && opts.container != "":
+		return nil, &stageError{stage: stageUsage, err: errors.New("--container can't be combined with --container-all")}
+	case opts.containerAll && len(opts.setVars) > 0:
+		return nil, &stageError{stage: stageUsage, err: errors.New("--set can't be combined with --container-all, select the container it applies to with --container")}
+	case opts.container != "":
+		i, err := cfg.ContainerIndex(opts.container)
+		if err != nil {
+			return nil, &stageError{stage: stageConfig, err: fmt.Errorf("--container: %w", err)}
+		}
+		cfg = cfg.WithContainer(i)
+	case len(cfg.Containers) == 0:
+		if !opts.allowNoContainer {
+			return nil, &stageError{
+				stage: stageConfig,
+				err:   errors.New("no containers found in config, pass --allow-no-container to run with only automatic variables"),
+			}
+		}
+		logger.WarnContext(ctx, "config has no containers, only automatic variables and --secret-env-map variables are set")
+	case len(cfg.Containers) != 1 && !opts.containerAll:
+		return nil, &stageError{
+			stage: stageConfig,
+			err:   fmt.Errorf("expected exactly 1 container, got %d (select one with --container, or print all with env --container-all)", len(cfg.Containers)),
+		}
+	}
+
+	// Like the env of --overrides-file, --set is defined after the container's own variables,
+	// and so is --value-from-gcs, whose URL the resolver replaces with the object
+	if len(opts.setVars) > 0 || len(opts.gcsValues) > 0 {
+		cfg.EnvironmentVars = slices.Concat(cfg.EnvironmentVars, opts.setVars, opts.gcsValues)
+	}
+
+	// Simulating another instance changes the identity everywhere it is exposed
+	if opts.service != "" {
+		cfg.ServiceName = opts.service
+	}
+	if opts.region != "" {
+		cfg.Region = opts.region
+	}
+	if (opts.service != "" || opts.revision != "") && !env.EmitsServiceVars(cfg, opts.emitServiceVars) {
+		logger.WarnContext(ctx, "jobs have no K_SERVICE, K_CONFIGURATION and K_REVISION, pass --emit-service-vars to set them from --service and --revision")
+	}
+	if opts.enforceTimeout && cfg.Kind != "Job" {
+		logger.WarnContext(ctx, "--enforce-timeout only applies to jobs, the timeoutSeconds of a service limits its requests, see CLOUD_RUN_TIMEOUT_SECONDS")
+	}
+
+	// Without automatic variables the project is only needed by what's resolved, which
+	// newResolver knows
+	if opts.containerEnvOnly {
+		return cfg, nil
+	}
+
+	if err := determineProject(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// determineProject sets the project of the config if the service account doesn't carry it
+func determineProject(ctx context.Context, cfg *config.Config) error {
+	if cfg.ProjectID != "" {
+		return nil
+	}
+
+	// The service account email doesn't carry the project, so fall back to the local setup
+	if projectID, err := config.GetDefaultProjectID(ctx); err == nil {
+		logger.InfoContext(ctx, fmt.Sprintf("Using project %s from application default credentials", projectID))
+		cfg.ProjectID = projectID
+		return nil
+	}
+
+	projectID, configName, err := config.GcloudActiveProject()
 	if err != nil {
-		return fmt.Errorf("create env resolver: %w", err)
+		return &stageError{
+			stage:          stageConfig,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("determine project of service account %s: %w", cfg.ServiceAccount, err),
+		}
 	}
-	defer func() {
-		if err := resolver.Cleanup(); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: cleanup failed: %v\n", err)
+	logger.InfoContext(ctx, fmt.Sprintf("Using project %s from gcloud configuration %s", projectID, configName))
+	cfg.ProjectID = projectID
+
+	return nil
+}
+
+// impersonates reports whether the command impersonates the service account to resolve the
+// environment, so the token of the local credentials impersonation starts from is fetched
+// while the config is loaded
+func impersonates(name string, opts *options) bool {
+	switch name {
+	case "env":
+		return opts.format != refsFormat
+	case "exec", "get", "materialize", "serve", "up":
+		return true
+	default:
+		return false
+	}
+}
+
+// imageResult is the outcome of reading the ENV defaults of the image
+type imageResult struct {
+	vars []env.ResolvedVar
+	err  error
+}
+
+// resolve creates a resolver for the config and resolves its environment.
+// The caller must clean up the returned resolver.
+func resolve(ctx context.Context, cfg *config.Config, opts *options) (*env.Resolver, []env.ResolvedVar, error) {
+	started := time.Now()
+
+	// The image's defaults don't depend on the secrets, so the registry is read while the
+	// service account is impersonated and the secrets are fetched. A failure of either
+	// cancels the other.
+	startCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	image := make(chan imageResult, 1)
+	go func() {
+		vars, err := imageEnv(startCtx, cfg, opts)
+		if err != nil {
+			err = &stageError{
+				stage:          stageImage,
+				serviceAccount: cfg.ServiceAccount,
+				err:            fmt.Errorf("read image env: %w", err),
+			}
+			cancel()
 		}
+		image <- imageResult{vars: vars, err: err}
 	}()
 
-	envVars, err := resolver.Resolve(ctx)
+	// failed stops reading the image and returns the error of resolution, unless resolution
+	// was only canceled because reading the image failed
+	failed := func(err error) error {
+		cancel()
+		result := <-image
+		if result.err != nil && ctx.Err() == nil && errors.Is(err, context.Canceled) {
+			return result.err
+		}
+		return err
+	}
+
+	resolver, lock, err := newResolver(startCtx, cfg, opts)
+	if err != nil {
+		return nil, nil, failed(err)
+	}
+	impersonated := time.Now()
+
+	envVars, err := resolver.Resolve(startCtx)
+	if err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, failed(&stageError{
+			stage:          stageSecret,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("resolve environment: %w", err),
+		})
+	}
+	warnFallbacks(ctx, resolver)
+	timings := reportTimings{
+		StartedAt:     started.UTC(),
+		Impersonation: impersonated.Sub(started).Milliseconds(),
+		Secrets:       time.Since(impersonated).Milliseconds(),
+	}
+
+	if err := saveLockfile(opts, lock); err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, failed(err)
+	}
+
+	if err := checkStrictSecrets(cfg, opts, envVars); err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, failed(&stageError{stage: stageConfig, err: err})
+	}
+
+	// Like in Cloud Run, the image's defaults are overridden by everything else
+	result := <-image
+	if result.err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, result.err
+	}
+	envVars = append(result.vars, envVars...)
+	checkOnly(ctx, opts, envVars)
+
+	envVars, err = stripPrefix(opts, envVars)
+	if err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, &stageError{stage: stageConfig, err: err}
+	}
+	envVars = applyPrefix(opts, envVars)
+	warnEncodedSecrets(ctx, opts, envVars)
+
+	if opts.transform != "" {
+		// The hook sees every variable once, with overrides within the config already applied
+		merged, err := merge(ctx, opts, envVars)
+		if err == nil {
+			envVars, err = transform(ctx, opts.transform, merged)
+		}
+		if err != nil {
+			cleanup(ctx, resolver)
+			return nil, nil, &stageError{stage: stageTransform, err: fmt.Errorf("transform: %w", err)}
+		}
+	}
+
+	timings.Total = time.Since(started).Milliseconds()
+	if err := writeReport(cfg, opts, resolver, envVars, timings); err != nil {
+		cleanup(ctx, resolver)
+		return nil, nil, err
+	}
+
+	return resolver, envVars, nil
+}
+
+// warnFallbacks warns about the secret references that resolved to a fallback version,
+// naming why the versions before it were skipped
+func warnFallbacks(ctx context.Context, resolver *env.Resolver) {
+	for _, fallback := range resolver.Fallbacks() {
+		reasons := make([]string, 0, len(fallback.Skipped))
+		for _, err := range fallback.Skipped {
+			reasons = append(reasons, err.Error())
+		}
+		logger.WarnContext(ctx, fmt.Sprintf("secret %s: using version %s of %s, skipped %s", fallback.Secret, fallback.Version, fallback.Key, strings.Join(reasons, "; ")))
+	}
+}
+
+// newResolver checks the resolution flags and creates a resolver for the config, along
+// with the lockfile it pins versions in, if any. The caller must clean up the resolver.
+func newResolver(ctx context.Context, cfg *config.Config, opts *options) (*env.Resolver, *lockfile.Lockfile, error) {
+	if opts.updateLock && opts.lockFile == "" {
+		return nil, nil, fmt.Errorf("--update-lock requires --lockfile")
+	}
+
+	if opts.stripPrefix && opts.envPrefixFilter == "" {
+		return nil, nil, errors.New("--strip-prefix requires --env-prefix-filter")
+	}
+
+	if opts.reportIncludeValues && opts.report == "" {
+		return nil, nil, errors.New("--report-include-values requires --report")
+	}
+
+	if opts.latestAs != "" {
+		if n, err := strconv.Atoi(opts.latestAs); err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("--secret-version-latest-as must be a version number, got %s", opts.latestAs)
+		}
+		if opts.lockFile != "" {
+			return nil, nil, fmt.Errorf("--secret-version-latest-as can't be combined with --lockfile")
+		}
+	}
+
+	if opts.maxSecrets < 1 {
+		return nil, nil, fmt.Errorf("--max-concurrent-secrets must be at least 1, got %d", opts.maxSecrets)
+	}
+
+	if opts.secretTransport != secrets.TransportREST && opts.secretTransport != secrets.TransportGRPC {
+		return nil, nil, fmt.Errorf("unsupported --secret-transport: %s (expected %s or %s)", opts.secretTransport, secrets.TransportREST, secrets.TransportGRPC)
+	}
+
+	var lock *lockfile.Lockfile
+	if opts.lockFile != "" {
+		var err error
+		lock, err = lockfile.Load(opts.lockFile)
+		if err != nil {
+			return nil, nil, &stageError{stage: stageConfig, err: fmt.Errorf("load lockfile: %w", err)}
+		}
+	}
+
+	secretMaps := make([]env.SecretMap, 0, len(opts.secretEnvMaps))
+	for _, value := range opts.secretEnvMaps {
+		secretMap, err := parseSecretMap(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--secret-env-map: %w", err)
+		}
+		secretMaps = append(secretMaps, secretMap)
+	}
+
+	secretFileVars, err := pgSSLSecrets(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	secretFileVars = append(secretFileVars, opts.gcsFiles...)
+
+	fileVars, err := readValueFiles(opts.valueFiles)
 	if err != nil {
-		return fmt.Errorf("resolve environment: %w", err)
+		return nil, nil, &stageError{stage: stageConfig, err: fmt.Errorf("--value-from-file: %w", err)}
+	}
+
+	resolverOpts := env.Options{
+		Lockfile:             lock,
+		UpdateLock:           opts.updateLock,
+		MaxConcurrentSecrets: opts.maxSecrets,
+		SecretMaps:           secretMaps,
+		SecretTransport:      opts.secretTransport,
+		Revision:             opts.revisionName(),
+		LatestAs:             opts.latestAs,
+		Only:                 opts.only,
+		PrefixFilter:         opts.envPrefixFilter,
+		NoCredsFile:          opts.noCredsFile,
+		Session:              opts.session,
+		EmitServiceVars:      opts.emitServiceVars,
+		FileVars:             fileVars,
+		ContainerEnvOnly:     opts.containerEnvOnly,
+		MetadataVars:         opts.metadataFileVars,
+		LazySecrets:          opts.lazySecrets,
+		SecretFileVars:       secretFileVars,
+		SecretRefs:           opts.format == refsFormat,
+	}
+
+	if opts.containerEnvOnly {
+		fetchesSecrets := env.FetchesSecrets(cfg, resolverOpts)
+		if !fetchesSecrets {
+			logger.DebugContext(ctx, fmt.Sprintf("No secrets referenced, not impersonating %s", cfg.ServiceAccount))
+		}
+		// Short secret names and metadata.namespace field references resolve in the project
+		if fetchesSecrets || referencesNamespace(cfg, opts) || resolverOpts.SecretRefs {
+			if err := determineProject(ctx, cfg); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// The quota project defaults to the project, which is only determined by now
+	client := apiClient(cfg, opts)
+	resolverOpts.HTTPClient = client
+	resolverOpts.QuotaProject = quotaProject(cfg, opts)
+	resolverOpts.Providers = map[string]env.SecretProvider{
+		vault.Scheme: vault.NewClient(httpClient),
+		// Objects are read with a token of their own, only minted if one is referenced. The
+		// resolver may outlive ctx, e.g. the one resolve creates it with.
+		gcs.Scheme: gcs.NewClient(httpClient, auth.NewTokenSource(context.WithoutCancel(ctx), client, cfg.ServiceAccount, auth.CloudPlatformScope)),
 	}
 
-	// If no command provided, print environment variables
-	if len(command) == 0 {
-		for _, envVar := range envVars {
-			fmt.Println(envVar)
+	// Resolve environment variables
+	resolver, err := env.NewResolver(ctx, cfg, resolverOpts)
+	if err != nil {
+		return nil, nil, &stageError{
+			stage:          stageAuth,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("create env resolver: %w", err),
 		}
+	}
+	if expiry := resolver.TokenExpiry(); !expiry.IsZero() {
+		logger.DebugContext(ctx, fmt.Sprintf("Access token for %s valid until %s", cfg.ServiceAccount, expiry.Local().Format(time.RFC3339)))
+	}
+	if opts.verifyIdentity {
+		if err := verifyIdentity(ctx, cfg, resolver); err != nil {
+			cleanup(ctx, resolver)
+			return nil, nil, err
+		}
+	}
+
+	return resolver, lock, nil
+}
+
+// verifyIdentity checks with --verify-identity that the access token the resolver minted
+// belongs to the service account, rather than impersonation having silently fallen back to
+// another identity
+func verifyIdentity(ctx context.Context, cfg *config.Config, resolver *env.Resolver) error {
+	identity, err := resolver.Identity(ctx)
+	switch {
+	case err != nil:
+		return &stageError{stage: stageAuth, serviceAccount: cfg.ServiceAccount, err: fmt.Errorf("--verify-identity: %w", err)}
+	case identity == "":
+		logger.DebugContext(ctx, fmt.Sprintf("--verify-identity: %s wasn't impersonated, there is no token to verify", cfg.ServiceAccount))
 		return nil
+	case !strings.EqualFold(identity, cfg.ServiceAccount):
+		return &stageError{
+			stage:          stageAuth,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("--verify-identity: the access token belongs to %s instead of %s", identity, cfg.ServiceAccount),
+		}
 	}
+	logger.DebugContext(ctx, fmt.Sprintf("Access token belongs to %s", identity))
+	return nil
+}
 
-	// Execute command with environment
-	//nolint:gosec // looks insecure, but that's kind of the point
-	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+// referencesNamespace reports whether a resolved variable of the config is the
+// metadata.namespace field reference, which is the project
+func referencesNamespace(cfg *config.Config, opts *options) bool {
+	return slices.ContainsFunc(cfg.EnvironmentVars, func(envVar config.EnvVar) bool {
+		return envVar.FieldRef == config.FieldPathNamespace && selected(opts, envVar.Name)
+	})
+}
 
-	// Inherit existing environment variables
-	cmd.Env = append(envVars, os.Environ()...)
+// saveLockfile writes the lockfile back if resolution pinned new versions
+func saveLockfile(opts *options, lock *lockfile.Lockfile) error {
+	if lock == nil || !lock.Changed() {
+		return nil
+	}
+	if err := lock.Save(opts.lockFile); err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("save lockfile: %w", err)}
+	}
+	return nil
+}
+
+// selected reports whether a variable of the config is resolved with --only and
+// --env-prefix-filter
+func selected(opts *options, name string) bool {
+	return (len(opts.only) == 0 || slices.Contains(opts.only, name)) && strings.HasPrefix(name, opts.envPrefixFilter)
+}
+
+// checkOnly warns about variables named by --only that weren't resolved
+func checkOnly(ctx context.Context, opts *options, vars []env.ResolvedVar) {
+	for _, name := range opts.only {
+		if !strings.HasPrefix(name, opts.envPrefixFilter) {
+			logger.WarnContext(ctx, fmt.Sprintf("--only %s doesn't start with --env-prefix-filter %s", name, opts.envPrefixFilter))
+			continue
+		}
+		if !slices.ContainsFunc(vars, func(v env.ResolvedVar) bool { return v.Name == name }) {
+			logger.WarnContext(ctx, fmt.Sprintf("--only %s is not declared in the config", name))
+		}
+	}
+}
+
+// stripPrefix removes --env-prefix-filter from the variable names with --strip-prefix, before
+// --prefix is prepended. Automatic variables keep their names.
+func stripPrefix(opts *options, vars []env.ResolvedVar) ([]env.ResolvedVar, error) {
+	if !opts.stripPrefix {
+		return vars, nil
+	}
+
+	stripped := make([]env.ResolvedVar, 0, len(vars))
+	for _, v := range vars {
+		if v.Source != env.SourceMetadata {
+			name, ok := strings.CutPrefix(v.Name, opts.envPrefixFilter)
+			if ok && name == "" {
+				return nil, fmt.Errorf("--strip-prefix: variable %s has no name without the prefix", v.Name)
+			}
+			v.Name = name
+		}
+		stripped = append(stripped, v)
+	}
+	return stripped, nil
+}
+
+// applyPrefix prepends --prefix to the variable names. Automatic variables are only
+// prefixed with --prefix-metadata, as client libraries look them up by their plain names.
+func applyPrefix(opts *options, vars []env.ResolvedVar) []env.ResolvedVar {
+	if opts.prefix == "" {
+		return vars
+	}
+
+	prefixed := make([]env.ResolvedVar, 0, len(vars))
+	for _, v := range vars {
+		if v.Source != env.SourceMetadata || opts.prefixMetadata {
+			v.Name = opts.prefix + v.Name
+		}
+		prefixed = append(prefixed, v)
+	}
+	return prefixed
+}
+
+// parseSecretMap parses a secret map reference in the name[@version][:PREFIX_] form
+func parseSecretMap(value string) (env.SecretMap, error) {
+	ref, prefix, _ := strings.Cut(value, ":")
+	name, version, ok := strings.Cut(ref, "@")
+	if !ok {
+		version = "latest"
+	}
+	if name == "" || version == "" {
+		return env.SecretMap{}, fmt.Errorf("invalid secret reference %q, expected name[@version][:PREFIX_]", value)
+	}
+
+	return env.SecretMap{
+		SecretRef: config.SecretRef{Name: name, Key: version},
+		Prefix:    prefix,
+	}, nil
+}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// readValueFiles reads the variables of --value-from-file, trimming the whitespace around
+// their values such as the trailing newline
+func readValueFiles(values []string) ([]env.ResolvedVar, error) {
+	vars := make([]env.ResolvedVar, 0, len(values))
+	for _, value := range values {
+		name, path, ok := strings.Cut(value, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid value %s, expected NAME=path", value)
+		}
 
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read value of %s: %w", name, err)
 		}
-		return fmt.Errorf("execute command: %w", err)
+		vars = append(vars, env.ResolvedVar{Name: name, Value: strings.TrimSpace(string(data)), Source: env.SourceFile})
 	}
+	return vars, nil
+}
 
+// readMetadataFile reads the additional automatic variables of --metadata-file. Variables
+// named like a built-in automatic variable are left out with a warning, the built-in
+// value wins.
+func readMetadataFile(ctx context.Context, opts *options) error {
+	if opts.metadataFile == "" {
+		return nil
+	}
+
+	vars, err := env.ReadMetadataFile(opts.metadataFile)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("--metadata-file: %w", err)}
+	}
+	opts.metadataFileVars = slices.DeleteFunc(vars, func(v env.ResolvedVar) bool {
+		if !slices.Contains(metadataVars, v.Name) {
+			return false
+		}
+		logger.WarnContext(ctx, fmt.Sprintf("--metadata-file: %s is a built-in automatic variable, ignoring its value", v.Name))
+		return true
+	})
 	return nil
 }
 
+// newSecretsClient creates a Secret Manager client for the config, accessing secrets over
+// --secret-transport with tokens of tokens
+func newSecretsClient(ctx context.Context, cfg *config.Config, opts *options, tokens oauth2.TokenSource) (*secrets.Client, error) {
+	if opts.secretTransport == secrets.TransportGRPC {
+		return secrets.NewGRPCClient(ctx, tokens, cfg.ProjectID, quotaProject(cfg, opts))
+	}
+	token, err := tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("get access token: %w", err)
+	}
+	return secrets.NewClient(apiClient(cfg, opts), token.AccessToken, cfg.ProjectID), nil
+}
+
+// quotaProject returns the project billed for the quota of the IAM and Secret Manager
+// requests made for the config: --quota-project, or the project of the config by default
+func quotaProject(cfg *config.Config, opts *options) string {
+	if opts.quotaProject != "" {
+		return opts.quotaProject
+	}
+	return cfg.ProjectID
+}
+
+// apiClient returns the client of the IAM and Secret Manager requests made for the config,
+// billing their quota to its quotaProject
+func apiClient(cfg *config.Config, opts *options) *http.Client {
+	project := quotaProject(cfg, opts)
+	if project == "" {
+		return httpClient
+	}
+	return httpclient.WithQuotaProject(httpClient, project)
+}
+
+// cleanup removes the resolver's temporary files, warning on failure
+func cleanup(ctx context.Context, resolver *env.Resolver) {
+	if err := resolver.Cleanup(); err != nil {
+		logger.WarnContext(ctx, "cleanup failed", "error", err)
+	}
+}
+
 func printHelp() {
 	fmt.Println(`cloudrun-local - Run Cloud Run services locally with proper service account impersonation
 
 USAGE:
-    cloudrun-local [FLAGS] [-- COMMAND [ARGS...]]
+    cloudrun-local env [FLAGS]
+    cloudrun-local exec [FLAGS] -- COMMAND [ARGS...]
+    cloudrun-local serve [FLAGS] -- COMMAND [ARGS...]
+    cloudrun-local up [FLAGS] CONFIG=COMMAND...
+    cloudrun-local get [FLAGS] NAME
+    cloudrun-local materialize [FLAGS] --dir DIR
+    cloudrun-local secrets [FLAGS]
+    cloudrun-local validate [FLAGS]
+    cloudrun-local whoami [FLAGS]
+    cloudrun-local doctor [FLAGS]
+    cloudrun-local compare [FLAGS]
+    cloudrun-local session clean ID
+
+COMMANDS:
+    env                    Print environment variables
+    exec                   Run a command with the environment
+    serve                  Run a long-lived command with an emulated metadata server
+                           that keeps the service account token fresh
+    up                     Run the command of every config at once, each with its own
+                           environment, with their output prefixed
+    get                    Print the raw value of a single variable, fetching only
+                           the secret it references
+    materialize            Write every secret variable and secret volume file to files
+                           under a directory, with a manifest
+    secrets                List the secrets the config references without fetching them,
+                           in variables and secret volumes
+    precedence             List every definition of every variable and which one wins,
+                           without fetching secrets
+    validate               Check the config and lint rules without contacting GCP
+    whoami                 Print the service account, its project, the local identity
+                           impersonating it and whether impersonation works
+    doctor                 Check the local setup step by step, from the gcloud
+                           configuration to access to every referenced secret
+    compare                Compare the service account, variables and secret
+                           references with the deployed service or job
+    session clean          Remove the credentials file and access token of a session
+
+    Without a command, cloudrun-local behaves like env, or like exec if a
+    command is given after the flags.
 
 FLAGS:
-    -c, --config <file>    Path to Cloud Run service YAML config file (default: service.yaml)
+    -c, --config <file>    Path to Cloud Run service YAML config file (default: service.yaml),
+                           a file in a Git repository: git+URL//PATH[@REF], or - for stdin
+    --config-format <auto|yaml|json>
+                           Parse the config as YAML or JSON instead of detecting it from
+                           the first character (default: auto)
+    --kind <Service|Job>   Kind of the resource to use from a config with multiple documents
+    --name <name>          Name of the resource to use from a config with multiple documents
+    --revision-template <name>
+                           Name of the revision template to use: the Service's
+                           spec.template.metadata.name, or a Revision in the config
+    --lockfile <file>      Pin the versions that latest secrets resolve to in a lockfile
+    --update-lock          Re-resolve latest secrets and update the lockfile
+    --secret-version-latest-as <n>
+                           Fetch version n for every latest secret reference, failing
+                           if a secret has no such version
+    --max-concurrent-secrets <n>
+                           Maximum number of secrets fetched at once (default: 8)
+    --secret-transport <rest|grpc>
+                           Access Secret Manager over its REST or its gRPC API, which
+                           retries transient failures (default: rest)
+    --quota-project <project>
+                           Bill the quota of IAM and Secret Manager requests to the
+                           project, which requires serviceusage.services.use on it
+                           (default: the config's project)
+    --timeout <duration>   Maximum duration of the whole run, e.g. 5m (default: no limit)
+    --secret-env-map <name[@version][:PREFIX_]>
+                           Expand a secret holding a flat JSON object into one variable
+                           per key, with an optional prefix (repeatable)
+    --value-from-file <NAME=path>
+                           Set a variable to the content of a local file, trimmed of
+                           surrounding whitespace, overriding the config (repeatable)
+    --value-from-gcs <NAME=gcs://bucket/object>
+                           Set a variable to the contents of a Cloud Storage object,
+                           read as the service account, after the config's (repeatable)
+    --prefix <PREFIX_>     Prepend a prefix to the names of the config's variables
+    --prefix-metadata      Also prepend --prefix to automatic variables, such as
+                           GOOGLE_APPLICATION_CREDENTIALS
+    --transform <executable>
+                           Pass the resolved variables through an executable, which
+                           reads them as JSON on stdin and writes the result to stdout
+    --service <name>       Service name exposed as K_SERVICE, K_CONFIGURATION and the
+                           metadata.name field reference (default: metadata.name)
+    --revision <name>      Revision name exposed as K_REVISION (default: the revision of
+                           --revision-template, or local)
+    --emit-service-vars    Set K_SERVICE, K_CONFIGURATION and K_REVISION for jobs too,
+                           which have none of them in Cloud Run
+    --region <region>      Region exposed as CLOUD_RUN_REGION (default: the config's
+                           cloud.googleapis.com/location label or v2 resource name)
+    --overrides-file <path>
+                           YAML or JSON file of job execution overrides, as for
+                           'gcloud run jobs execute', whose env wins over the config's
+    --metadata-file <path> YAML or JSON file of additional automatic variables, below
+                           the config and the shell
+    --no-creds-file        Don't write a credentials file to disk and leave out
+                           GOOGLE_APPLICATION_CREDENTIALS, which serve always does
+    --session <id>         Keep the credentials file and access token in the named session,
+                           reusing them in later runs until the token expires
+    --verify-identity      Fail unless the impersonated access token belongs to the
+                           service account, printing it with --verbose
+    --allow-no-container   Warn instead of failing if the config has no containers yet,
+                           setting only automatic and --secret-env-map variables
+    --container <name>     Use the named container of a multi-container config, with
+                           its env, secret volumes, workingDir and securityContext
+    --set <NAME=VALUE>     Define a variable in the env of the selected container, after
+                           its own variables, so it wins over them (repeatable)
+    --only <name>          Only resolve the named variable, leaving out all others and
+                           skipping their secrets (repeatable). Automatic variables are
+                           left out too unless named
+    --env-prefix-filter <prefix>
+                           Only resolve the variables starting with the prefix, e.g.
+                           WORKER_, skipping the secrets of all others. Automatic
+                           variables are kept
+    --strip-prefix         Remove --env-prefix-filter from the names of the variables
+    --no-metadata-var <name>
+                           Leave out an automatic variable, such as GOOGLE_CLOUD_PROJECT
+                           or GOOGLE_APPLICATION_CREDENTIALS (repeatable)
+    --container-env-only   Leave out all automatic variables. Without secret references,
+                           the service account isn't impersonated and nothing is fetched.
+                           Not supported by serve
+    --report <file>        Write a JSON report of the resolution: config, identity,
+                           variables, secret versions, timings and warnings. Secret
+                           values are written as *** (env, exec and serve)
+    --report-include-values
+                           Write secret values to the --report file unmasked
+    --verbose              Print diagnostics, such as overridden automatic variables
+    --fail-on-warning      Exit with 1 at the end of an otherwise successful run if any
+                           warning was logged, even with --quiet
+    --quiet                Only print errors to stderr, diagnostics still go to --log-file
+    --error-format <format>
+                           Format of the error printed to stderr on failure: text, or
+                           json for a single object with the stage that failed
+                           (default: text)
+    --log-format <format>  Format of diagnostics: text, or json for a JSON object per
+                           line with the time and level (default: text)
+    --no-color             Don't colour errors, warnings and --explain sources, even on
+                           a terminal. Setting NO_COLOR does the same
+    --log-file <file>      Write diagnostics to a file instead of stderr, errors are
+                           still printed to stderr
+    --explain              Print the source of every variable to stderr
+    --mask-mode <none|full|partial>
+                           How secret and file values are shown by --explain and
+                           --verbose: full masks them, partial keeps both ends, none
+                           prints them for debugging (default: full)
+    --mask-keep <n>        Characters kept at each end with --mask-mode partial
+                           (default: 2)
+    --strict-overrides     Fail if a user-supplied value overrides an automatic variable
+    --image-env            Read the ENV defaults of the container's image from its
+                           registry, overridden by the config's variables
+    --strict-secrets       Fail if a variable has an empty value, a placeholder value or
+                           an incomplete secret reference, reporting each of them
+    --placeholder <value>  Value rejected by --strict-secrets, case-insensitive, replacing
+                           the defaults CHANGEME, CHANGE_ME, REPLACEME, REPLACE_ME, TODO,
+                           FIXME, PLACEHOLDER and XXX (repeatable)
     -h, --help             Show this help message
     -v, --version          Show version information
+    --json                 Print --version as JSON with the commit, build date and Go version
+
+ENV FLAGS:
+    -o, --output <file>    Write environment variables to a file instead of stdout
+    --output-fd <fd>       Write environment variables to a file descriptor the parent
+                           process opened, e.g. 3, instead of stdout, closing it when
+                           done (Unix only)
+    --format <format>      Output format: env, json, jsonl, tsv, template, direnv
+                           printing export lines for an .envrc to evaluate, or
+                           dotenv-refs printing secret references instead of fetching
+                           the values (default: env)
+    --template <template>  Go template rendering the variables with --format template.
+                           The data is a list of variables with Name, Value and Source,
+                           the functions quote, upper and lower are available
+    --container-all        Print the variables of every container of a multi-container
+                           config, as container.NAME=value or a JSON object per container
+    --stream               Write each variable as soon as its secret is fetched rather
+                           than once all are, with the env, dotenv-refs, jsonl and tsv
+                           formats. A variable defined twice is rejected, as is anything
+                           that needs every variable first, e.g. --transform, and
+                           --output, which would be left partial if a secret fails
+
+VALIDATE FLAGS:
+    --rules <file>         Lint rules file checking secret names, required variables
+                           and literal values of sensitive variables
+
+    validate only accepts the -c, --config-format, --kind, --name,
+    --revision-template, --log-file, --log-format, --quiet, --verbose,
+    --error-format and -h flags besides --rules.
+
+GET FLAGS:
+    get doesn't accept --no-metadata-var, --explain, --strict-overrides,
+    --strict-secrets, --placeholder, --image-env, --only, --env-prefix-filter,
+    --strip-prefix, --prefix, --prefix-metadata, --transform,
+    --container-env-only or the env flags. NAME
+    is looked up as in the config, automatic variables such as
+    GOOGLE_CLOUD_PROJECT can be printed too.
+
+MATERIALIZE FLAGS:
+    --dir <dir>            Directory to write to, created with mode 0700. Variables go to
+                           env/NAME, secret volume files to files/MOUNT_PATH, and
+                           manifest.json maps them to their secrets. Files are written
+                           unmasked with mode 0600, remove the directory when done
+
+    materialize accepts the same flags as get.
+
+SECRETS FLAGS:
+    --format <format>      Output format: table or json (default: table)
+
+    secrets only accepts the -c, --config-format, --kind, --name,
+    --revision-template, --log-file, --log-format, --quiet, --verbose,
+    --error-format and -h flags besides --format.
+
+PRECEDENCE FLAGS:
+    --format <format>      Output format: table or json (default: table)
+
+    precedence accepts the same flags as secrets and --value-from-file,
+    --service, --revision, --emit-service-vars, --region, --overrides-file,
+    --metadata-file, --container, --set and --env-precedence. Secrets and value
+    files are shown as placeholders.
+
+WHOAMI FLAGS:
+    --format <format>      Output format: table or json (default: table)
+
+    whoami only accepts the same flags as secrets and --quota-project. It exits
+    with 1 if impersonation fails, after printing the identity.
+
+DOCTOR FLAGS:
+    --permissions <file>   YAML or JSON file listing the IAM permissions the service
+                           account needs, each tested on its resource
+
+    doctor accepts the same flags as whoami except --format. It prints a
+    checklist with a hint for every failed check and exits with 1 if any
+    check failed. Secret values are read to check access, but never printed.
+
+COMPARE FLAGS:
+    --region <region>      Region the service or job is deployed in (default: the
+                           config's cloud.googleapis.com/location label)
+    --format <format>      Output format: table or json (default: table)
+
+    compare accepts the same flags as whoami. The deployed resource is read
+    with your own credentials and looked up by the config's name in its
+    project. It exits with 1 if anything differs, after printing the
+    differences. Secret values are never fetched, only references compared.
+
+UP FLAGS:
+    --fail-fast            Stop all services once one of them fails, instead of waiting
+                           for every one to exit
+    --port <port>          Set PORT of the services to consecutive ports from this one,
+                           in the order given (default: PORT is not set)
+
+    up accepts the same flags as exec except --replace, --lockfile, --service,
+    --report, --lazy-secrets, --metadata-addr and --access-boundary. Each
+    CONFIG=COMMAND runs COMMAND, split on spaces without quoting, with the
+    environment of CONFIG. Signals stop all services. It exits once every
+    service has, with the exit code of the first that failed.
+
+EXEC AND SERVE FLAGS:
+    --workdir <dir>        Working directory for the command (default: container's workingDir)
+    --env-precedence <shell-wins|config-wins>
+                           Whether the shell environment or the resolved variables win
+                           for variables defined in both (default: shell-wins)
+    --env-passthrough <glob>
+                           Only inherit the shell variables matching the pattern, e.g.
+                           PATH or LC_* (repeatable, default: all)
+    --env-block <glob>     Don't inherit the shell variables matching the pattern, even
+                           if passed through (repeatable)
+    --expand-args          Replace $(NAME) in the command and its arguments with the
+                           value of the resolved variable, as Kubernetes does, $$ is $
+    --strict-args          Fail if --expand-args finds a $(NAME) that isn't resolved,
+                           instead of keeping it as it is
+    --clean-env            Don't inherit any shell variable, the command only gets the
+                           resolved variables and the ones of --preserve
+    --preserve <NAME[,NAME...]>
+                           Shell variables inherited despite --clean-env, e.g. PATH,HOME
+                           (repeatable)
+    --apply-security-context
+                           Run the command as the runAsUser and runAsGroup of the
+                           container's securityContext, requires root (Unix only). The
+                           credentials file, which embeds your own credentials, and the
+                           secret files become readable by that uid. A container
+                           setting neither is rejected
+    --replace              exec only: replace cloudrun-local with the command, which
+                           keeps its PID. No credentials file is written, and --timeout
+                           and --apply-security-context are rejected (Unix only)
+    --enforce-timeout      Terminate the command of a job like Cloud Run once the
+                           timeoutSeconds of its task expires (default: 10m), exiting
+                           with 124. Restarts by --watch-secrets get the full timeout
+    --metadata-addr <host:port>
+                           serve only: address of the metadata server, failing if it's
+                           taken (default: 127.0.0.1:8980, or a free port if taken)
+    --lazy-secrets         serve only: leave the config's secret variables out of the
+                           environment, the command fetches them from the metadata
+                           server on first use
+    --access-boundary <file>
+                           serve only: Credential Access Boundary JSON file downscoping
+                           the tokens the metadata server hands out in Cloud Storage.
+                           exec and up can't downscope tokens and reject it, as their
+                           command mints its own from a credentials file with all of
+                           the service account's access
+    --watch-secrets        Restart the command when a secret referenced at version
+                           latest has a new version
+    --poll-interval <duration>
+                           How often --watch-secrets checks for new versions, at
+                           least 10s (default: 30s)
+    --pg-ssl-cert <name[@version]>
+    --pg-ssl-key <name[@version]>
+    --pg-ssl-root-cert <name[@version]>
+                           Write the secret to a temporary file, removed when the
+                           command exits, and set PGSSLCERT, PGSSLKEY or PGSSLROOTCERT
+                           to its path
+    --file-from-gcs <NAME=gcs://bucket/object>
+                           Write a Cloud Storage object to a temporary file named like
+                           it, removed when the command exits, and set NAME to its path
+                           (repeatable)
 
 EXAMPLES:
     # Print environment variables
-    cloudrun-local --config=service.yaml
+    cloudrun-local env --config=service.yaml
 
     # Run a Go service with the environment
-    cloudrun-local -c service.yaml -- go run ./cmd/server
+    cloudrun-local exec -c service.yaml -- go run ./cmd/server
+
+    # Restart the service when one of its secrets is rotated
+    cloudrun-local exec --watch-secrets --poll-interval 1m -- ./server
+
+    # Connect to Cloud SQL with client certificates stored as secrets
+    cloudrun-local exec --pg-ssl-cert db-cert --pg-ssl-key db-key \
+        --pg-ssl-root-cert db-ca -- ./server
 
     # Run with default config file (service.yaml)
-    cloudrun-local -- npm start
+    cloudrun-local exec -- npm start
 
     # Save environment to a file
-    cloudrun-local > .env
+    cloudrun-local env -o .env
+
+    # Print environment variables as JSON
+    cloudrun-local env --format json
+
+    # Print variables as shell exports
+    cloudrun-local env --format template \
+        --template '{{range .}}export {{.Name}}={{quote .Value}}{{"\n"}}{{end}}'
+
+    # Check which identity impersonates the service account
+    cloudrun-local whoami -c service.yaml
+
+    # Check the local setup of a new machine
+    cloudrun-local doctor -c service.yaml
+
+    # Print a single secret without fetching the others
+    cloudrun-local get DATABASE_PASSWORD
+
+    # Use the config of a release from a Git repository
+    cloudrun-local env -c git+https://github.com/org/repo//deploy/service.yaml@v1.2.0
+
+    # Fail a CI step if tests run for longer than 10 minutes
+    cloudrun-local exec --timeout 10m -- go test ./...
+
+    # Add every key of the JSON secret "db-config" as a DB_ variable
+    cloudrun-local env --secret-env-map db-config@latest:DB_
+
+    # Pin latest secret versions for reproducible runs
+    cloudrun-local exec --lockfile cloudrun-local.lock -- npm start
+
+    # Check the config against the team's lint rules
+    cloudrun-local validate -c service.yaml --rules lint.yaml
+
+    # Run a service for hours without its token expiring
+    cloudrun-local serve -c service.yaml -- ./server
+
+ENVIRONMENT:
+    SECRET_MANAGER_EMULATOR_HOST
+                           host:port of a Secret Manager emulator to read secrets from
+                           instead of Secret Manager, over plain HTTP
+
+EXIT CODES:
+    1                      The environment couldn't be resolved
+    124                    The run exceeded --timeout, or --enforce-timeout the task timeout
+    125                    The command couldn't be started
+    other                  The exit code of the command
 
 DESCRIPTION:
     cloudrun-local reads a Cloud Run service configuration YAML file, impersonates
@@ -155,7 +1593,12 @@ DESCRIPTION:
     3. Automatic variables (K_SERVICE, K_REVISION, etc.)
 
 CONFIGURATION:
-    The service account is read from: spec.template.spec.serviceAccountName
-    The project ID is extracted from the service account email
-    Environment variables are read from: spec.template.spec.containers[0].env`)
+    The service account is read from: spec.template.spec.serviceAccountName, or the
+    run.googleapis.com/service-account annotation of spec.template if it's empty
+    The project ID is extracted from the service account email, falling back to the
+    application default credentials and the active gcloud configuration
+    Environment variables are read from: spec.template.spec.containers[0].env
+    The working directory is read from: spec.template.spec.containers[0].workingDir
+    Cloud Run Admin API v2 resources, which have no kind, are read from template
+    (services) or template.template (jobs) instead`)
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// headerRecorder records the header of the requests it answers with an empty response
+type headerRecorder struct {
+	header http.Header
+}
+
+func (r *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.header = req.Header
+	return httptest.NewRecorder().Result(), nil
+}
+
+func TestAPIClientQuotaProject(t *testing.T) {
+	tests := []struct {
+		name         string
+		quotaProject string
+		want         string
+	}{
+		{name: "config's project by default", want: "my-project"},
+		{name: "flag", quotaProject: "billing-project", want: "billing-project"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &headerRecorder{}
+			defaultClient := httpClient
+			httpClient = &http.Client{Transport: recorder}
+			t.Cleanup(func() { httpClient = defaultClient })
+
+			cfg := &config.Config{ProjectID: "my-project"}
+			client := apiClient(cfg, &options{quotaProject: tt.quotaProject})
+			resp, err := client.Get("https://secretmanager.googleapis.com/v1/projects/my-project/secrets/db/versions/latest:access")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if got := recorder.header.Get("X-Goog-User-Project"); got != tt.want {
+				t.Errorf("got x-goog-user-project %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevisionName(t *testing.T) {
+	tests := []struct {
+		name string
+		opts options
+		want string
+	}{
+		{name: "default", want: ""},
+		{name: "revision template", opts: options{revisionTemplate: "api-00042-abc"}, want: "api-00042-abc"},
+		{name: "revision wins", opts: options{revision: "api-00043-def", revisionTemplate: "api-00042-abc"}, want: "api-00043-def"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.revisionName(); got != tt.want {
+				t.Errorf("revisionName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
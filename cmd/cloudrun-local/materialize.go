@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// Layout of a materialized directory
+const (
+	materializeManifest = "manifest.json"
+	materializeEnvDir   = "env"
+	materializeFilesDir = "files"
+)
+
+// materializeManifestData maps the files of a materialized directory to what they hold
+type materializeManifestData struct {
+	Env   []materializedEnv  `json:"env"`
+	Files []materializedFile `json:"files"`
+}
+
+// materializedEnv is a secret-backed variable written to a file
+type materializedEnv struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Secret  string `json:"secret,omitempty"` // Empty for variables of --secret-env-map
+	Version string `json:"version,omitempty"`
+}
+
+// materializedFile is a file of a secret volume, written under its path in the container
+type materializedFile struct {
+	Path    string `json:"path"`
+	File    string `json:"file"`
+	Secret  string `json:"secret"`
+	Version string `json:"version"`
+}
+
+// runMaterialize writes the value of every secret-backed variable and every secret volume
+// file of the container to files under the directory, with a manifest describing them.
+// Values are written in full, readable only by the current user.
+func runMaterialize(ctx context.Context, opts *options) error {
+	if opts.materializeDir == "" {
+		return errors.New("materialize requires --dir")
+	}
+
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	// The files are for another process to read, the credentials file would only be left behind
+	opts.noCredsFile = true
+
+	resolver, lock, err := newResolver(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	vars, err := resolver.Resolve(ctx)
+	if err != nil {
+		return &stageError{
+			stage:          stageSecret,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("resolve environment: %w", err),
+		}
+	}
+	files, err := resolver.ResolveFiles(ctx)
+	if err != nil {
+		return &stageError{
+			stage:          stageSecret,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("resolve secret volumes: %w", err),
+		}
+	}
+
+	warnFallbacks(ctx, resolver)
+
+	if err := saveLockfile(opts, lock); err != nil {
+		return err
+	}
+
+	manifest := materializeManifestData{Env: []materializedEnv{}, Files: []materializedFile{}}
+	var values []string // Of the manifest's env, followed by its files
+
+	// Names come from the config and from the keys of --secret-env-map, so they're checked
+	// before anything is written
+	merged, _ := env.Merge(vars)
+	for _, v := range merged {
+		if v.Source != env.SourceSecret {
+			continue
+		}
+		if err := checkMaterializeName(v.Name); err != nil {
+			return &stageError{stage: stageConfig, err: err}
+		}
+
+		entry := materializedEnv{Name: v.Name, File: path.Join(materializeEnvDir, v.Name)}
+		for _, envVar := range cfg.EnvironmentVars {
+			if envVar.Name == v.Name && envVar.SecretRef != nil {
+				entry.Secret = canonicalSecret(envVar.SecretRef, cfg.ProjectID)
+				entry.Version = envVar.SecretRef.Key
+			}
+		}
+		manifest.Env = append(manifest.Env, entry)
+		values = append(values, v.Value)
+	}
+
+	for _, file := range files {
+		if err := checkMaterializePath(file.Path); err != nil {
+			return &stageError{stage: stageConfig, err: err}
+		}
+		manifest.Files = append(manifest.Files, materializedFile{
+			Path:    file.Path,
+			File:    path.Join(materializeFilesDir, file.Path),
+			Secret:  canonicalSecret(file.SecretRef, cfg.ProjectID),
+			Version: file.SecretRef.Key,
+		})
+		values = append(values, file.Value)
+	}
+
+	if err := prepareMaterializeDir(opts.materializeDir); err != nil {
+		return err
+	}
+	for i, entry := range manifest.Env {
+		if err := writeMaterialized(opts.materializeDir, entry.File, values[i]); err != nil {
+			return err
+		}
+	}
+	for i, entry := range manifest.Files {
+		if err := writeMaterialized(opts.materializeDir, entry.File, values[len(manifest.Env)+i]); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if err := writeMaterialized(opts.materializeDir, materializeManifest, string(data)+"\n"); err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, fmt.Sprintf(
+		"Wrote %d variables and %d secret files to %s, remove it when done: rm -rf %s",
+		len(manifest.Env), len(manifest.Files), opts.materializeDir, opts.materializeDir,
+	))
+	return nil
+}
+
+// checkMaterializeName rejects variable names that can't be used as a file name under the
+// env directory, such as ../../.bashrc, by only accepting names a shell can export
+func checkMaterializeName(name string) error {
+	if !shellName.MatchString(name) {
+		return fmt.Errorf("can't materialize %q, it's not a valid environment variable name", name)
+	}
+	return nil
+}
+
+// checkMaterializePath rejects secret file paths that would be written outside of the files
+// directory, or to another file than the one the container sees
+func checkMaterializePath(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p || strings.ContainsAny(p, "\\\x00") {
+		return fmt.Errorf("can't materialize secret file %q, its path must be absolute and clean, without backslashes or NUL", p)
+	}
+	return nil
+}
+
+// prepareMaterializeDir creates the directory, or clears the files of an earlier run from it
+// so no secret outlives its removal from the config. A non-empty directory that wasn't
+// materialized before is refused, to not mix secrets into unrelated files.
+func prepareMaterializeDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("create %s: %w", dir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", dir, err)
+	}
+
+	if len(entries) > 0 {
+		if _, err := os.Stat(filepath.Join(dir, materializeManifest)); err != nil {
+			return fmt.Errorf("%s is not empty and has no %s, pass an empty or new directory", dir, materializeManifest)
+		}
+	}
+	for _, name := range []string{materializeEnvDir, materializeFilesDir, materializeManifest} {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("remove previous %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeMaterialized writes the value to the slash-separated path under the directory,
+// readable only by the current user
+func writeMaterialized(dir, name, value string) error {
+	filename := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("create directory for %s: %w", name, err)
+	}
+	if err := os.WriteFile(filename, []byte(value), 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestCheckMaterializeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "DB_PASSWORD"},
+		{name: "_private"},
+		{name: "../../.bashrc", wantErr: true},
+		{name: "nested/name", wantErr: true},
+		{name: `C:\Windows\evil`, wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "NAME\x00", wantErr: true},
+		{name: "1PASSWORD", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkMaterializeName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("checkMaterializeName(%q) = %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckMaterializePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "/secrets/db/password"},
+		{path: "/secrets/../../etc/passwd", wantErr: true},
+		{path: "secrets/password", wantErr: true},
+		{path: `/secrets/..\..\password`, wantErr: true},
+		{path: "/secrets/password\x00.txt", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkMaterializePath(tt.path); (err != nil) != tt.wantErr {
+			t.Errorf("checkMaterializePath(%q) = %v, want error: %v", tt.path, err, tt.wantErr)
+		}
+	}
+}
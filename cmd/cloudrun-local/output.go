@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// formatter writes resolved environment variables in a specific format
+type formatter func(w io.Writer, vars []env.ResolvedVar) error
+
+// formatters are the supported output formats by name
+var formatters = map[string]formatter{
+	"env":      formatEnv,
+	"json":     formatJSON,
+	"jsonl":    formatJSONL,
+	"tsv":      formatTSV,
+	refsFormat: formatEnv, // Resolved with references instead of secret values
+}
+
+// lineFormats write a single variable as a line of the formats --stream supports
+var lineFormats = map[string]func(w io.Writer, v env.ResolvedVar) error{
+	"env":      writeEnvLine,
+	"jsonl":    writeJSONLLine,
+	"tsv":      writeTSVLine,
+	refsFormat: writeEnvLine,
+}
+
+// templateFormat is the name of the format rendering the --template flag
+const templateFormat = "template"
+
+// refsFormat is the name of the format printing references instead of secret values
+const refsFormat = "dotenv-refs"
+
+// direnvFormat is the name of the format printing export lines for an .envrc to evaluate
+const direnvFormat = "direnv"
+
+// templateFuncs are the helper functions available to --template
+var templateFuncs = template.FuncMap{
+	"quote": strconv.Quote,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// formatNames returns the names of the supported output formats
+func formatNames() string {
+	names := make([]string, 0, len(formatters)+2)
+	for name := range formatters {
+		names = append(names, name)
+	}
+	names = append(names, templateFormat, direnvFormat)
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newFormatter returns the formatter selected by the flags
+func newFormatter(opts *options) (formatter, error) {
+	if opts.format == templateFormat {
+		if opts.template == "" {
+			return nil, errors.New("--format template requires --template")
+		}
+		return newTemplateFormatter(opts.template)
+	}
+	if opts.template != "" {
+		return nil, errors.New("--template requires --format template")
+	}
+	if opts.format == direnvFormat {
+		return newDirenvFormatter(opts), nil
+	}
+
+	format, ok := formatters[opts.format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %s (expected one of %s)", opts.format, formatNames())
+	}
+	return format, nil
+}
+
+// runEnv prints the resolved environment
+func runEnv(ctx context.Context, opts *options) error {
+	format, err := newFormatter(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.containerAll && opts.format != "env" && opts.format != "json" {
+		return fmt.Errorf("--container-all only supports the env and json formats")
+	}
+	if opts.outputFD != 0 && opts.outputFile != "" {
+		return errors.New("--output-fd can't be combined with --output")
+	}
+	if err := checkStream(opts); err != nil {
+		return err
+	}
+	if opts.format == refsFormat {
+		// Neither has a reference to print instead of its values
+		if len(opts.secretEnvMaps) > 0 {
+			return fmt.Errorf("--format %s can't be combined with --secret-env-map, whose variables are only known once fetched", refsFormat)
+		}
+		if len(opts.valueFiles) > 0 {
+			return fmt.Errorf("--format %s can't be combined with --value-from-file", refsFormat)
+		}
+	}
+
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.containerAll {
+		return runEnvAllContainers(ctx, cfg, opts)
+	}
+	if opts.stream {
+		return streamEnv(ctx, cfg, opts)
+	}
+
+	resolver, envVars, err := resolve(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	envVars, err = merge(ctx, opts, envVars)
+	if err != nil {
+		return err
+	}
+	explain(ctx, opts, envVars, envVars)
+
+	return writeOutput(opts, func(w io.Writer) error {
+		return format(w, envVars)
+	})
+}
+
+// runEnvAllContainers prints the resolved environment of every container
+func runEnvAllContainers(ctx context.Context, cfg *config.Config, opts *options) error {
+	names := make([]string, 0, len(cfg.Containers))
+	containers := make(map[string][]env.ResolvedVar, len(cfg.Containers))
+	for i, container := range cfg.Containers {
+		resolver, envVars, err := resolve(ctx, cfg.WithContainer(i), opts)
+		if err != nil {
+			return fmt.Errorf("container %s: %w", container.Name, err)
+		}
+		cleanup(ctx, resolver)
+
+		envVars, err = merge(ctx, opts, envVars)
+		if err != nil {
+			return fmt.Errorf("container %s: %w", container.Name, err)
+		}
+
+		names = append(names, container.Name)
+		containers[container.Name] = envVars
+	}
+
+	return writeOutput(opts, func(w io.Writer) error {
+		if opts.format == "json" {
+			values := make(map[string]map[string]string, len(containers))
+			for name, vars := range containers {
+				values[name] = make(map[string]string, len(vars))
+				for _, v := range vars {
+					values[name][v.Name] = v.Value
+				}
+			}
+
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(values)
+		}
+
+		for _, name := range names {
+			for _, v := range containers[name] {
+				if _, err := fmt.Fprintf(w, "%s.%s\n", name, v.String()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// checkStream rejects --stream with the formats and flags that need every variable before
+// the first one is written
+func checkStream(opts *options) error {
+	if !opts.stream {
+		return nil
+	}
+
+	var conflict string
+	switch {
+	case lineFormats[opts.format] == nil:
+		return fmt.Errorf("--stream only supports the env, %s, jsonl and tsv formats", refsFormat)
+	case opts.outputFile != "":
+		// A failed secret would leave a truncated file behind, whereas the reader of a pipe or
+		// --output-fd sees the command fail
+		return errors.New("--stream can't be combined with --output, as a failed resolution would leave a partial file")
+	case opts.containerAll:
+		conflict = "--container-all"
+	case opts.imageEnv:
+		conflict = "--image-env"
+	case len(opts.secretEnvMaps) > 0:
+		conflict = "--secret-env-map"
+	case opts.strictSecrets:
+		conflict = "--strict-secrets"
+	case opts.transform != "":
+		conflict = "--transform"
+	case opts.report != "":
+		conflict = "--report"
+	default:
+		return nil
+	}
+	return fmt.Errorf("--stream can't be combined with %s, which needs every variable before the first one is written", conflict)
+}
+
+// streamEnv prints the resolved environment, writing each variable as soon as it's resolved.
+// As a later definition of a variable would override an earlier one already written, a
+// variable defined twice is rejected before anything is resolved.
+func streamEnv(ctx context.Context, cfg *config.Config, opts *options) error {
+	resolver, lock, err := newResolver(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	checkOnly(ctx, opts, resolver.Declared())
+	declared, err := stripPrefix(opts, resolver.Declared())
+	if err != nil {
+		return &stageError{stage: stageConfig, err: err}
+	}
+	declared = applyPrefix(opts, declared)
+	if _, overrides := env.Merge(declared); len(overrides) > 0 {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("--stream can't write %s, which is defined more than once and only its last definition applies", overrides[0].By.Name)}
+	}
+
+	writeLine := lineFormats[opts.format]
+	var resolveErr error
+	err = writeOutput(opts, func(w io.Writer) error {
+		if opts.format == "tsv" {
+			if err := writeTSVHeader(w); err != nil {
+				return err
+			}
+		}
+
+		var writeErr error
+		resolveErr = resolver.Stream(ctx, func(v env.ResolvedVar) error {
+			vars, err := stripPrefix(opts, []env.ResolvedVar{v})
+			if err != nil {
+				return err
+			}
+			// Merging a single variable only leaves out the ones of --no-metadata-var
+			vars, err = merge(ctx, opts, applyPrefix(opts, vars))
+			if err != nil {
+				return err
+			}
+			warnEncodedSecrets(ctx, opts, vars)
+			explain(ctx, opts, vars, vars)
+			for _, v := range vars {
+				if writeErr = writeLine(w, v); writeErr != nil {
+					return writeErr
+				}
+			}
+			return nil
+		})
+		if writeErr != nil {
+			return writeErr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if resolveErr != nil {
+		return &stageError{
+			stage:          stageSecret,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("resolve environment: %w", resolveErr),
+		}
+	}
+
+	warnFallbacks(ctx, resolver)
+	return saveLockfile(opts, lock)
+}
+
+// openOutputFD opens the descriptor of --output-fd for writeOutput, failing while the flags
+// are parsed if the parent process didn't pass it
+func openOutputFD(opts *options, value string) error {
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return errors.New("expected a file descriptor of at least 3, as 0 to 2 are stdin, stdout and stderr")
+	}
+
+	f, err := inheritedFD(fd)
+	if err != nil {
+		return err
+	}
+	opts.outputFD, opts.outputFDFile = fd, f
+	return nil
+}
+
+// writeOutput writes to stdout, to the --output file, or to the descriptor of --output-fd
+func writeOutput(opts *options, write func(w io.Writer) error) error {
+	if opts.outputFDFile != nil {
+		// Closing the descriptor tells the reading parent that the output is complete
+		if err := write(opts.outputFDFile); err != nil {
+			_ = opts.outputFDFile.Close()
+			return fmt.Errorf("write to fd %d: %w", opts.outputFD, err)
+		}
+		return opts.outputFDFile.Close()
+	}
+	if opts.outputFile == "" {
+		return write(os.Stdout)
+	}
+
+	// The output contains secret values, so it's only readable by the owner
+	f, err := os.OpenFile(opts.outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("open output file: %w", err)
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write output file: %w", err)
+	}
+	return f.Close()
+}
+
+// formatEnv writes variables as KEY=value lines
+func formatEnv(w io.Writer, vars []env.ResolvedVar) error {
+	for _, v := range vars {
+		if err := writeEnvLine(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEnvLine writes a variable as a KEY=value line
+func writeEnvLine(w io.Writer, v env.ResolvedVar) error {
+	_, err := fmt.Fprintln(w, v.String())
+	return err
+}
+
+// formatJSON writes variables as a single JSON object mapping names to values
+func formatJSON(w io.Writer, vars []env.ResolvedVar) error {
+	values := make(map[string]string, len(vars))
+	for _, v := range vars {
+		values[v.Name] = v.Value
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(values)
+}
+
+// jsonlVar is a variable of the jsonl format
+type jsonlVar struct {
+	Name   string     `json:"name"`
+	Value  string     `json:"value"`
+	Source env.Source `json:"source"`
+}
+
+// formatJSONL writes variables as JSON Lines, one object with the name, value and source of
+// a variable per line, in the order they are resolved
+func formatJSONL(w io.Writer, vars []env.ResolvedVar) error {
+	for _, v := range vars {
+		if err := writeJSONLLine(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONLLine writes a variable as a line of JSON Lines
+func writeJSONLLine(w io.Writer, v env.ResolvedVar) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(jsonlVar{Name: v.Name, Value: v.Value, Source: v.Source})
+}
+
+// tsvEscaper escapes the characters that would break a TSV row, keeping values on one line
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// formatTSV writes variables as tab-separated name, value and source columns below a header
+// row. Backslashes, tabs and line breaks in values are escaped as \\, \t, \n and \r.
+func formatTSV(w io.Writer, vars []env.ResolvedVar) error {
+	if err := writeTSVHeader(w); err != nil {
+		return err
+	}
+	for _, v := range vars {
+		if err := writeTSVLine(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTSVHeader writes the header row of the tsv format
+func writeTSVHeader(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "name\tvalue\tsource")
+	return err
+}
+
+// writeTSVLine writes a variable as a row of the tsv format
+func writeTSVLine(w io.Writer, v env.ResolvedVar) error {
+	_, err := fmt.Fprintf(w, "%s\t%s\t%s\n", tsvEscaper.Replace(v.Name), tsvEscaper.Replace(v.Value), v.Source)
+	return err
+}
+
+// newTemplateFormatter returns a formatter executing a text/template with the variables as data
+func newTemplateFormatter(text string) (formatter, error) {
+	tmpl, err := template.New("output").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+
+	return func(w io.Writer, vars []env.ResolvedVar) error {
+		if err := tmpl.Execute(w, vars); err != nil {
+			return fmt.Errorf("execute template: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// shellName matches the variable names a shell can export
+var shellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// newDirenvFormatter returns a formatter writing variables as export lines for direnv to
+// evaluate from an .envrc. A header of watch_file lines has direnv run the tool again when
+// one of the local files the variables come from changes, on top of every directory entry.
+func newDirenvFormatter(opts *options) formatter {
+	var watched []string
+	files := []string{opts.configFile, opts.overridesFile, opts.metadataFile}
+	for _, value := range opts.valueFiles {
+		_, path, _ := strings.Cut(value, "=")
+		files = append(files, path)
+	}
+	for _, file := range files {
+		// Stdin and configs in git repositories have no file to watch
+		if info, err := os.Stat(file); file == "" || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+		watched = append(watched, file)
+	}
+
+	return func(w io.Writer, vars []env.ResolvedVar) error {
+		for _, v := range vars {
+			if !shellName.MatchString(v.Name) {
+				return fmt.Errorf("variable %s can't be exported by a shell, its name must consist of letters, digits and '_'", v.Name)
+			}
+		}
+
+		if _, err := fmt.Fprintln(w, "# Generated by cloudrun-local, evaluate in .envrc: eval \"$(cloudrun-local env --format direnv)\""); err != nil {
+			return err
+		}
+		for _, file := range watched {
+			if _, err := fmt.Fprintf(w, "watch_file %s\n", shellQuote(file)); err != nil {
+				return err
+			}
+		}
+		for _, v := range vars {
+			if _, err := fmt.Fprintf(w, "export %s=%s\n", v.Name, shellQuote(v.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// shellQuote quotes the value for bash as a single-quoted string, in which nothing is
+// expanded, closing and reopening it around single quotes
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
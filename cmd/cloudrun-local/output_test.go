@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    options
+		wantErr string
+	}{
+		{
+			name: "env to stdout",
+			opts: options{stream: true, format: "env"},
+		},
+		{
+			name: "jsonl to a descriptor",
+			opts: options{stream: true, format: "jsonl", outputFD: 3},
+		},
+		{
+			name:    "json",
+			opts:    options{stream: true, format: "json"},
+			wantErr: "only supports",
+		},
+		{
+			name:    "output file",
+			opts:    options{stream: true, format: "env", outputFile: "env.out"},
+			wantErr: "--output",
+		},
+		{
+			name: "output file without streaming",
+			opts: options{format: "env", outputFile: "env.out"},
+		},
+		{
+			name:    "transform",
+			opts:    options{stream: true, format: "tsv", transform: "./redact"},
+			wantErr: "--transform",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStream(&tt.opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkStream() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkStream() = %v, want an error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
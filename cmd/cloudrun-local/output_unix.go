@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inheritedFD returns the file of a descriptor the parent process passed. The process's own
+// descriptors, such as the ones the Go runtime opens at startup, are close-on-exec, while
+// inherited ones can't be, as they survived the exec.
+func inheritedFD(fd int) (*os.File, error) {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%d isn't an open file descriptor: %w", fd, errno)
+	}
+	if flags&syscall.FD_CLOEXEC != 0 {
+		return nil, fmt.Errorf("%d wasn't passed by the parent process", fd)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd)), nil
+}
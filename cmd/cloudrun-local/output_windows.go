@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// inheritedFD fails, as Windows passes handles rather than numbered descriptors
+func inheritedFD(_ int) (*os.File, error) {
+	return nil, errors.New("file descriptors are only supported on Unix")
+}
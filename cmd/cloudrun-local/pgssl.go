@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// pgSSLFile is a TLS file of a PostgreSQL connection, such as one to Cloud SQL, given as a
+// secret with a flag and read by libpq from the path in a variable
+type pgSSLFile struct {
+	flag     string
+	variable string
+	filename string // Name of the file in the temporary directory, libpq's default
+}
+
+// pgSSLFiles are the TLS files of the --pg-ssl-* flags
+var pgSSLFiles = []pgSSLFile{
+	{flag: "pg-ssl-cert", variable: "PGSSLCERT", filename: "postgresql.crt"},
+	{flag: "pg-ssl-key", variable: "PGSSLKEY", filename: "postgresql.key"},
+	{flag: "pg-ssl-root-cert", variable: "PGSSLROOTCERT", filename: "root.crt"},
+}
+
+// pgSSLSecrets returns the secret files of the --pg-ssl-* flags that are set, each with the
+// variable libpq reads its path from
+func pgSSLSecrets(opts *options) ([]env.SecretFileVar, error) {
+	var fileVars []env.SecretFileVar
+	for _, file := range pgSSLFiles {
+		value := opts.pgSSL[file.flag]
+		if value == "" {
+			continue
+		}
+
+		name, version, ok := strings.Cut(value, "@")
+		if !ok {
+			version = "latest"
+		}
+		if name == "" || version == "" {
+			return nil, fmt.Errorf("--%s: invalid secret reference %q, expected name[@version]", file.flag, value)
+		}
+
+		fileVars = append(fileVars, env.SecretFileVar{
+			Name: file.variable,
+			File: config.SecretFile{Path: file.filename, SecretRef: &config.SecretRef{Name: name, Key: version}},
+		})
+	}
+	return fileVars, nil
+}
+
+// secretFilePaths returns the temporary directory of the resolver's secret files and the
+// files of the variables, which a command running as another user must be able to read
+func secretFilePaths(resolver *env.Resolver, vars []env.ResolvedVar) []string {
+	dir := resolver.SecretFilesDir()
+	if dir == "" {
+		return nil
+	}
+
+	paths := []string{dir}
+	for _, v := range vars {
+		if v.Source == env.SourceSecretFile {
+			paths = append(paths, v.Value)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/gcs"
+	"github.com/ngalaiko/cloudrun-local/internal/vault"
+)
+
+// Values of --format of the precedence command
+const (
+	precedenceFormatTable = "table"
+	precedenceFormatJSON  = "json"
+)
+
+// precedenceVar is a variable with every definition found for it, lowest precedence first
+type precedenceVar struct {
+	Name       string                `json:"name"`
+	Candidates []precedenceCandidate `json:"candidates"`
+}
+
+// precedenceCandidate is a definition of a variable. Secrets and files aren't read, their
+// value is a placeholder naming the reference.
+type precedenceCandidate struct {
+	Source env.Source `json:"source"`
+	Value  string     `json:"value"`
+	Wins   bool       `json:"wins"`
+}
+
+// runPrecedence lists every definition of every variable and which one wins, without
+// fetching secrets or reading value files
+func runPrecedence(ctx context.Context, opts *options) error {
+	if opts.format != precedenceFormatTable && opts.format != precedenceFormatJSON {
+		return fmt.Errorf("unsupported format: %s (expected %s or %s)", opts.format, precedenceFormatTable, precedenceFormatJSON)
+	}
+
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	fileVars, err := valueFileCandidates(opts.valueFiles)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("--value-from-file: %w", err)}
+	}
+
+	// The layers in the order mergeShell applies them, later ones win
+	resolved := slices.Concat(automaticCandidates(cfg, opts), configCandidates(cfg), fileVars)
+	shell := slices.DeleteFunc(env.FromEnviron(os.Environ()), func(v env.ResolvedVar) bool {
+		return !slices.ContainsFunc(resolved, func(r env.ResolvedVar) bool { return r.Name == v.Name })
+	})
+	layers := slices.Concat(resolved, shell)
+	if opts.envPrecedence == precedenceConfigWins {
+		layers = slices.Concat(shell, resolved)
+	}
+
+	byName := make(map[string]*precedenceVar)
+	for _, v := range layers {
+		if byName[v.Name] == nil {
+			byName[v.Name] = &precedenceVar{Name: v.Name}
+		}
+		byName[v.Name].Candidates = append(byName[v.Name].Candidates, precedenceCandidate{Source: v.Source, Value: v.Value})
+	}
+	vars := make([]precedenceVar, 0, len(byName))
+	for _, v := range byName {
+		v.Candidates[len(v.Candidates)-1].Wins = true
+		vars = append(vars, *v)
+	}
+	slices.SortFunc(vars, func(a, b precedenceVar) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	if opts.format == precedenceFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(vars)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VARIABLE\tSOURCE\tVALUE\tRESULT")
+	for _, v := range vars {
+		for _, candidate := range v.Candidates {
+			result := "overridden"
+			if candidate.Wins {
+				result = "wins"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Name, candidate.Source, tsvEscaper.Replace(candidate.Value), result)
+		}
+	}
+	return w.Flush()
+}
+
+// automaticCandidates returns the automatic variables, as the resolver sets them
+func automaticCandidates(cfg *config.Config, opts *options) []env.ResolvedVar {
+	var vars []env.ResolvedVar
+	if env.EmitsServiceVars(cfg, opts.emitServiceVars) {
+		vars = env.ServiceVars(cfg, opts.revisionName())
+	}
+	vars = append(vars, env.JobVars(cfg)...)
+	vars = append(vars,
+		env.ResolvedVar{Name: "GOOGLE_CLOUD_PROJECT", Value: cfg.ProjectID, Source: env.SourceMetadata},
+	)
+	if cfg.Region != "" {
+		vars = append(vars, env.ResolvedVar{Name: "CLOUD_RUN_REGION", Value: cfg.Region, Source: env.SourceMetadata})
+	}
+	if cfg.Timeout > 0 {
+		vars = append(vars, env.ResolvedVar{Name: "CLOUD_RUN_TIMEOUT_SECONDS", Value: env.TimeoutSeconds(cfg), Source: env.SourceMetadata})
+	}
+	vars = append(vars, env.ResolvedVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "<credentials file>", Source: env.SourceMetadata})
+	return append(vars, opts.metadataFileVars...)
+}
+
+// configCandidates returns the definitions of the config in order, with placeholders naming
+// the secrets they reference
+func configCandidates(cfg *config.Config) []env.ResolvedVar {
+	vars := make([]env.ResolvedVar, 0, len(cfg.EnvironmentVars))
+	for _, envVar := range cfg.EnvironmentVars {
+		switch {
+		case env.IsSecretReference(envVar.Value), vault.IsReference(envVar.Value), gcs.IsReference(envVar.Value):
+			vars = append(vars, env.ResolvedVar{Name: envVar.Name, Value: "<secret " + envVar.Value + ">", Source: env.SourceSecret})
+		case envVar.Value != "":
+			vars = append(vars, env.ResolvedVar{Name: envVar.Name, Value: envVar.Value, Source: env.SourceConfig})
+		case envVar.SecretRef != nil:
+			secret := fmt.Sprintf("<secret %s/versions/%s>", canonicalSecret(envVar.SecretRef, cfg.ProjectID), envVar.SecretRef.Key)
+			vars = append(vars, env.ResolvedVar{Name: envVar.Name, Value: secret, Source: env.SourceSecret})
+		case envVar.FieldRef != "":
+			vars = append(vars, env.ResolvedVar{Name: envVar.Name, Value: env.FieldValue(cfg, envVar.FieldRef), Source: env.SourceConfig})
+		}
+	}
+	return vars
+}
+
+// valueFileCandidates returns the variables of --value-from-file, with placeholders naming
+// the files instead of their content
+func valueFileCandidates(values []string) ([]env.ResolvedVar, error) {
+	vars := make([]env.ResolvedVar, 0, len(values))
+	for _, value := range values {
+		name, path, ok := strings.Cut(value, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid value %s, expected NAME=path", value)
+		}
+		vars = append(vars, env.ResolvedVar{Name: name, Value: "<file " + path + ">", Source: env.SourceFile})
+	}
+	return vars, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// resolutionReport is the JSON file written by --report once the environment is resolved,
+// for archiving what a run used. Secret values are masked unless --report-include-values.
+type resolutionReport struct {
+	Config         string           `json:"config"`
+	Kind           string           `json:"kind"`
+	Name           string           `json:"name,omitempty"`
+	ServiceAccount string           `json:"service_account"`
+	Project        string           `json:"project"`
+	Variables      []reportVariable `json:"variables"`
+	Secrets        []reportSecret   `json:"secrets"`
+	Timings        reportTimings    `json:"timings"`
+	Warnings       []string         `json:"warnings"`
+}
+
+// reportVariable is a resolved variable, as the command gets it before the shell is merged in
+type reportVariable struct {
+	Name   string     `json:"name"`
+	Source env.Source `json:"source"`
+	Value  string     `json:"value"`
+}
+
+// reportSecret is a secret reference that was fetched, with the version it resolved to
+type reportSecret struct {
+	Variable        string `json:"variable,omitempty"`
+	Path            string `json:"path,omitempty"` // Of a secret volume file
+	Secret          string `json:"secret"`
+	Version         string `json:"version,omitempty"`
+	ResolvedVersion string `json:"resolved_version,omitempty"`
+}
+
+// reportTimings are the durations of the steps of resolution, in milliseconds
+type reportTimings struct {
+	StartedAt     time.Time `json:"started_at"`
+	Impersonation int64     `json:"impersonation_ms"`
+	Secrets       int64     `json:"secrets_ms"`
+	Total         int64     `json:"total_ms"`
+}
+
+// writeReport writes the report of the resolution to --report, readable only by the
+// current user, as it names the secrets the run used
+func writeReport(cfg *config.Config, opts *options, resolver *env.Resolver, vars []env.ResolvedVar, timings reportTimings) error {
+	if opts.report == "" {
+		return nil
+	}
+
+	report := resolutionReport{
+		Config:         opts.configFile,
+		Kind:           cfg.Kind,
+		Name:           cfg.ServiceName,
+		ServiceAccount: cfg.ServiceAccount,
+		Project:        cfg.ProjectID,
+		Variables:      []reportVariable{},
+		Secrets:        []reportSecret{},
+		Timings:        timings,
+	}
+
+	merged, _ := env.Merge(vars)
+	for _, v := range merged {
+		report.Variables = append(report.Variables, reportVariable{Name: v.Name, Source: v.Source, Value: reportValue(opts, v)})
+	}
+
+	for _, envVar := range cfg.EnvironmentVars {
+		switch {
+		case envVar.SecretRef != nil:
+			if version, ok := resolver.ResolvedVersion(envVar.SecretRef); ok {
+				report.Secrets = append(report.Secrets, reportSecret{
+					Variable:        envVar.Name,
+					Secret:          canonicalSecret(envVar.SecretRef, cfg.ProjectID),
+					Version:         envVar.SecretRef.Key,
+					ResolvedVersion: version,
+				})
+			}
+		case slices.ContainsFunc(merged, func(v env.ResolvedVar) bool { return v.Name == envVar.Name && v.Source == env.SourceSecret }):
+			// A provider's reference, such as vault://path#field, has no version of its own
+			report.Secrets = append(report.Secrets, reportSecret{Variable: envVar.Name, Secret: envVar.Value})
+		}
+	}
+	for _, file := range cfg.SecretFiles {
+		if version, ok := resolver.ResolvedVersion(file.SecretRef); ok {
+			report.Secrets = append(report.Secrets, reportSecret{
+				Path:            file.Path,
+				Secret:          canonicalSecret(file.SecretRef, cfg.ProjectID),
+				Version:         file.SecretRef.Key,
+				ResolvedVersion: version,
+			})
+		}
+	}
+
+	warningMessages.Lock()
+	report.Warnings = append([]string{}, warningMessages.messages...)
+	warningMessages.Unlock()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report: %w", err)
+	}
+	if err := os.WriteFile(opts.report, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// reportValue returns the value of the variable in the report. Secret and file values are
+// always *** without --report-include-values, whatever --mask-mode, as the report is kept
+// around longer than diagnostics and a partial value still gives part of the secret away.
+func reportValue(opts *options, v env.ResolvedVar) string {
+	if opts.reportIncludeValues {
+		return v.Value
+	}
+	if v.Source == env.SourceSecret || v.Source == env.SourceFile {
+		return "***"
+	}
+	return displayValue(opts, v)
+}
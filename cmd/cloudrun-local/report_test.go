@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+func TestReportValue(t *testing.T) {
+	secret := env.ResolvedVar{Name: "DB_PASSWORD", Value: "correct-horse-battery", Source: env.SourceSecret}
+	file := env.ResolvedVar{Name: "API_KEY", Value: "from-a-file", Source: env.SourceFile}
+	literal := env.ResolvedVar{Name: "LOG_LEVEL", Value: "debug", Source: env.SourceConfig}
+
+	tests := []struct {
+		name string
+		opts options
+		v    env.ResolvedVar
+		want string
+	}{
+		{name: "secret", v: secret, want: "***"},
+		{name: "secret with partial masking", opts: options{maskMode: maskPartial}, v: secret, want: "***"},
+		{name: "file with partial masking", opts: options{maskMode: maskPartial}, v: file, want: "***"},
+		{name: "secret with values", opts: options{reportIncludeValues: true, maskMode: maskPartial}, v: secret, want: "correct-horse-battery"},
+		{name: "literal", v: literal, want: "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reportValue(&tt.opts, tt.v); got != tt.want {
+				t.Errorf("reportValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// Values of --format of the secrets command
+const (
+	secretsFormatTable = "table"
+	secretsFormatJSON  = "json"
+)
+
+// secretReference is a secret used by a variable or a secret volume file of a container
+type secretReference struct {
+	Secret    string `json:"secret"`
+	Version   string `json:"version"`
+	Variable  string `json:"variable,omitempty"`
+	Path      string `json:"path,omitempty"` // Path of a secret volume file in the container
+	Container string `json:"container"`
+}
+
+// runSecrets lists the secrets referenced by every container of the config, in variables and
+// secret volumes, without fetching them
+func runSecrets(ctx context.Context, opts *options) error {
+	if opts.format != secretsFormatTable && opts.format != secretsFormatJSON {
+		return fmt.Errorf("unsupported format: %s (expected %s or %s)", opts.format, secretsFormatTable, secretsFormatJSON)
+	}
+
+	cfg, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("parse config: %w", err)}
+	}
+
+	for _, warning := range cfg.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+
+	// Short secret names are listed in their canonical form, in the project of the service
+	if err := determineProject(ctx, cfg); err != nil {
+		return err
+	}
+
+	references := []secretReference{}
+	for _, container := range cfg.Containers {
+		for _, envVar := range container.EnvironmentVars {
+			if envVar.SecretRef == nil {
+				continue
+			}
+			references = append(references, secretReference{
+				Secret:    canonicalSecret(envVar.SecretRef, cfg.ProjectID),
+				Version:   envVar.SecretRef.Key,
+				Variable:  envVar.Name,
+				Container: container.Name,
+			})
+		}
+		for _, file := range container.SecretFiles {
+			references = append(references, secretReference{
+				Secret:    canonicalSecret(file.SecretRef, cfg.ProjectID),
+				Version:   file.SecretRef.Key,
+				Path:      file.Path,
+				Container: container.Name,
+			})
+		}
+	}
+
+	if opts.format == secretsFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(references)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SECRET\tVERSION\tVARIABLE OR FILE\tCONTAINER")
+	for _, ref := range references {
+		usedBy := ref.Variable
+		if ref.Path != "" {
+			usedBy = ref.Path
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ref.Secret, ref.Version, usedBy, ref.Container)
+	}
+	return w.Flush()
+}
+
+// canonicalSecret returns the full resource name of the secret, looking up short names in the project
+func canonicalSecret(ref *config.SecretRef, projectID string) string {
+	secret := ref.Secret()
+	if strings.HasPrefix(secret, "projects/") {
+		return secret
+	}
+	return fmt.Sprintf("projects/%s/secrets/%s", projectID, secret)
+}
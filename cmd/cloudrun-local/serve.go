@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+	"github.com/ngalaiko/cloudrun-local/internal/metadata"
+)
+
+const (
+	// defaultMetadataAddr is where the emulated metadata server listens unless --metadata-addr is set
+	defaultMetadataAddr = "127.0.0.1:8980"
+	// fallbackMetadataAddr is where it listens if the default address can't be bound, on a free port
+	fallbackMetadataAddr = "127.0.0.1:0"
+)
+
+// runServe runs the command next to an emulated metadata server that keeps handing out
+// fresh tokens for the service account, so the command can outlive a single token lifetime.
+// With --watch-secrets, the command is restarted whenever a latest secret has a new version.
+// With --lazy-secrets, the variables referencing secrets are left out of its environment and
+// fetched when the command requests them from the metadata server instead. With
+// --access-boundary, the command's tokens are downscoped to the boundary.
+func runServe(ctx context.Context, opts *options, command []string) error {
+	if len(command) == 0 {
+		return errors.New("serve requires a command to run")
+	}
+	if opts.replace {
+		return errors.New("serve keeps running next to the command, it can't be combined with --replace")
+	}
+	if opts.containerEnvOnly {
+		return errors.New("serve hands out tokens through automatic variables, it can't be combined with --container-env-only")
+	}
+	if err := checkWatchSecrets(opts); err != nil {
+		return err
+	}
+	if err := checkCleanEnv(opts); err != nil {
+		return err
+	}
+	if opts.strictArgs && !opts.expandArgs {
+		return errors.New("--strict-args requires --expand-args")
+	}
+	if opts.lazySecrets {
+		// Neither could account for secrets fetched while the command runs
+		if opts.lockFile != "" {
+			return errors.New("--lazy-secrets can't be combined with --lockfile")
+		}
+		if opts.watchSecrets {
+			return errors.New("--lazy-secrets can't be combined with --watch-secrets")
+		}
+	}
+
+	var boundary *auth.AccessBoundary
+	if opts.accessBoundary != "" {
+		var err error
+		boundary, err = auth.LoadAccessBoundary(opts.accessBoundary)
+		if err != nil {
+			return &stageError{stage: stageConfig, err: fmt.Errorf("--access-boundary: %w", err)}
+		}
+	}
+
+	cfg, err := loadConfig(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if err := checkSecurityContext(cfg, opts); err != nil {
+		return err
+	}
+
+	// The command gets its tokens from the metadata server, so no credentials file is written
+	opts.noCredsFile = true
+
+	// A token source of its own, so the command never sees the tool's Secret Manager token
+	tokens := auth.NewTokenSource(ctx, apiClient(cfg, opts), cfg.ServiceAccount, auth.CloudPlatformScope)
+	if boundary != nil {
+		tokens, err = auth.NewDownscopedTokenSource(ctx, httpClient, tokens, boundary)
+		if err != nil {
+			return &stageError{stage: stageConfig, err: fmt.Errorf("--access-boundary: %w", err)}
+		}
+		logger.DebugContext(ctx, fmt.Sprintf("Tokens of the metadata server are downscoped to %d access boundary rules", len(boundary.Rules)))
+	}
+
+	// Client libraries and gcloud prefer the application default credentials gcloud keeps in
+	// its configuration directory over the metadata server, so the command gets an empty one
+	gcloudConfig, err := os.MkdirTemp("", "cloudrun-local-gcloud-")
+	if err != nil {
+		return &stageError{stage: stageExec, err: fmt.Errorf("create gcloud configuration directory: %w", err)}
+	}
+	defer os.RemoveAll(gcloudConfig)
+
+	server := metadata.NewServer(cfg.ServiceAccount, cfg.ProjectID, tokens, logger)
+	server.ServeRegion(cfg.Region)
+	if err := listenMetadata(ctx, server, opts); err != nil {
+		return &stageError{stage: stageExec, err: fmt.Errorf("start metadata server: %w", err)}
+	}
+	logger.DebugContext(ctx, fmt.Sprintf("Metadata server listening on %s", server.Addr()))
+
+	if opts.lazySecrets {
+		provider := newLazySecrets(cfg, opts)
+		defer provider.close(ctx)
+		server.ServeSecrets(provider)
+		logger.DebugContext(ctx, fmt.Sprintf("%d secret variables are fetched on first access at http://%s/cloudrun-local/v1/env/NAME", len(provider.entries), server.Addr()))
+	}
+
+	serverCtx, stopServer := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := server.Run(serverCtx); err != nil {
+			logger.WarnContext(ctx, "metadata server", "error", err)
+		}
+	}()
+
+	// Restarts for new secret versions keep the server, so the command finds it at the same address
+	watcher := newSecretWatcher(ctx, cfg, opts)
+	for {
+		err = serveCommand(ctx, cfg, opts, command, server.Addr(), gcloudConfig, watcher)
+		logExit(ctx, err)
+		if !errors.Is(err, errSecretRotated) {
+			break
+		}
+	}
+
+	// The server only lives as long as the child
+	stopServer()
+	wg.Wait()
+
+	return err
+}
+
+// listenMetadata binds the metadata server to --metadata-addr. Without it, the default address
+// is tried first, and a free port if that's taken, e.g. by another service running with serve.
+// The command is told the address either way.
+func listenMetadata(ctx context.Context, server *metadata.Server, opts *options) error {
+	if opts.metadataAddr != "" {
+		return server.Listen(opts.metadataAddr)
+	}
+
+	err := server.Listen(defaultMetadataAddr)
+	if err == nil {
+		return nil
+	}
+	if fallbackErr := server.Listen(fallbackMetadataAddr); fallbackErr != nil {
+		return errors.Join(err, fallbackErr)
+	}
+	logger.InfoContext(ctx, fmt.Sprintf("Metadata server listening on %s instead of %s", server.Addr(), defaultMetadataAddr), "error", err)
+	return nil
+}
+
+// serveCommand resolves the environment and runs the command with it once, pointed at the
+// metadata server at addr and the empty gcloud configuration directory gcloudConfig
+func serveCommand(ctx context.Context, cfg *config.Config, opts *options, command []string, addr, gcloudConfig string, watcher *secretWatcher) error {
+	resolver, envVars, err := resolve(ctx, cfg, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup(ctx, resolver)
+
+	// The child finds credentials through the metadata server instead of the credentials file
+	childVars := []env.ResolvedVar{
+		{Name: "GCE_METADATA_HOST", Value: addr, Source: env.SourceMetadata},
+		{Name: "GCE_METADATA_IP", Value: addr, Source: env.SourceMetadata},
+		{Name: "CLOUDRUN_LOCAL_METADATA_ADDR", Value: addr, Source: env.SourceMetadata},
+	}
+	for _, envVar := range envVars {
+		if envVar.Name == "GOOGLE_APPLICATION_CREDENTIALS" {
+			continue
+		}
+		childVars = append(childVars, envVar)
+	}
+
+	merged, err := mergeShell(ctx, opts, childVars)
+	if err != nil {
+		return err
+	}
+	merged = withoutLocalCredentials(ctx, merged, gcloudConfig)
+	explain(ctx, opts, merged, childVars)
+
+	command, err = expandArgs(opts, command, childVars)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: err}
+	}
+
+	return watcher.run(ctx, resolver, func(ctx context.Context) error {
+		return withTaskTimeout(ctx, cfg, opts, func(ctx context.Context) error {
+			return runCommand(ctx, command, env.Strings(merged), workingDir(ctx, cfg, opts), securityContext(cfg, opts), opts.childOutput, secretFilePaths(resolver, envVars)...)
+		})
+	})
+}
+
+// withoutLocalCredentials drops GOOGLE_APPLICATION_CREDENTIALS the shell still sets after
+// merging, and points CLOUDSDK_CONFIG at the empty directory gcloudConfig, as client
+// libraries prefer either file over the metadata server
+func withoutLocalCredentials(ctx context.Context, merged []env.ResolvedVar, gcloudConfig string) []env.ResolvedVar {
+	var dropped []string
+	merged = slices.DeleteFunc(merged, func(v env.ResolvedVar) bool {
+		if v.Name != "GOOGLE_APPLICATION_CREDENTIALS" && v.Name != "CLOUDSDK_CONFIG" {
+			return false
+		}
+		dropped = append(dropped, v.Name)
+		return true
+	})
+	for _, name := range dropped {
+		logger.WarnContext(ctx, fmt.Sprintf("leaving out %s, the command gets its credentials from the metadata server", name))
+	}
+	return append(merged, env.ResolvedVar{Name: "CLOUDSDK_CONFIG", Value: gcloudConfig, Source: env.SourceMetadata})
+}
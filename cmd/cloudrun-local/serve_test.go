@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+func TestServeLeavesOutLocalCredentials(t *testing.T) {
+	// The shell's gcloud configuration holds application default credentials
+	shellConfig := t.TempDir()
+	if err := os.WriteFile(filepath.Join(shellConfig, "application_default_credentials.json"), []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLOUDSDK_CONFIG", shellConfig)
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/home/me/key.json")
+
+	for _, precedence := range []string{precedenceShellWins, precedenceConfigWins} {
+		t.Run(precedence, func(t *testing.T) {
+			childVars := []env.ResolvedVar{
+				{Name: "GCE_METADATA_HOST", Value: "127.0.0.1:8980", Source: env.SourceMetadata},
+			}
+			merged, err := mergeShell(t.Context(), &options{envPrecedence: precedence}, childVars)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gcloudConfig := t.TempDir()
+			var configs []string
+			for _, v := range withoutLocalCredentials(t.Context(), merged, gcloudConfig) {
+				switch v.Name {
+				case "GOOGLE_APPLICATION_CREDENTIALS":
+					t.Errorf("got %s, want it left out", v)
+				case "CLOUDSDK_CONFIG":
+					configs = append(configs, v.Value)
+				}
+			}
+			if len(configs) != 1 || configs[0] != gcloudConfig {
+				t.Fatalf("got CLOUDSDK_CONFIG %q, want only %q", configs, gcloudConfig)
+			}
+
+			// Where client libraries look for application default credentials of gcloud
+			adc := filepath.Join(configs[0], "application_default_credentials.json")
+			if _, err := os.Stat(adc); !os.IsNotExist(err) {
+				t.Errorf("got %s reachable (%v), want it missing", adc, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+)
+
+// runSession manages the files runs with --session share. The only action is clean,
+// removing the credentials files and access tokens of a session.
+func runSession(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] != "clean" {
+		return errors.New("session requires an action and a session id: cloudrun-local session clean ID")
+	}
+	session := args[1]
+
+	err := auth.CleanSession(session)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		logger.InfoContext(ctx, fmt.Sprintf("Session %s has no files to remove", session))
+		return nil
+	case err != nil:
+		return fmt.Errorf("clean session %s: %w", session, err)
+	}
+	logger.InfoContext(ctx, fmt.Sprintf("Removed the files of session %s", session))
+	return nil
+}
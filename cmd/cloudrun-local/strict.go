@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// defaultPlaceholders are the values --strict-secrets rejects unless --placeholder is set
+var defaultPlaceholders = []string{"CHANGEME", "CHANGE_ME", "REPLACEME", "REPLACE_ME", "TODO", "FIXME", "PLACEHOLDER", "XXX"}
+
+// checkStrictSecrets reports every variable of the config with an incomplete secret
+// reference, an empty value or a placeholder value, if --strict-secrets is set.
+// Only the values left after overrides within the config are checked.
+func checkStrictSecrets(cfg *config.Config, opts *options, vars []env.ResolvedVar) error {
+	if !opts.strictSecrets {
+		return nil
+	}
+
+	placeholders := []string(opts.placeholders)
+	if len(placeholders) == 0 {
+		placeholders = defaultPlaceholders
+	}
+
+	var problems []error
+	for _, envVar := range cfg.EnvironmentVars {
+		if envVar.Incomplete != "" && selected(opts, envVar.Name) {
+			problems = append(problems, fmt.Errorf("%s: %s", envVar.Name, envVar.Incomplete))
+		}
+	}
+
+	// Resolve leaves variables with an empty value out, so they are only found in the config
+	for i, envVar := range cfg.EnvironmentVars {
+		if emptyValue(envVar) && selected(opts, envVar.Name) && !redefined(cfg.EnvironmentVars[i+1:], envVar.Name) && !fromValueFile(vars, envVar.Name) {
+			problems = append(problems, fmt.Errorf("%s: value is empty", envVar.Name))
+		}
+	}
+
+	merged, _ := env.Merge(vars)
+	for _, v := range merged {
+		// Automatic variables and image defaults aren't the config's to get wrong
+		if v.Source == env.SourceMetadata || v.Source == env.SourceImage {
+			continue
+		}
+
+		if strings.TrimSpace(v.Value) == "" {
+			problems = append(problems, fmt.Errorf("%s: value is empty", v.Name))
+			continue
+		}
+		for _, placeholder := range placeholders {
+			if strings.EqualFold(strings.TrimSpace(v.Value), placeholder) {
+				problems = append(problems, fmt.Errorf("%s: value is the placeholder %s", v.Name, placeholder))
+				break
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--strict-secrets found %d suspicious variables:\n%w", len(problems), errors.Join(problems...))
+}
+
+// emptyValue reports whether the variable is defined with an empty value, rather than by a
+// reference
+func emptyValue(envVar config.EnvVar) bool {
+	return envVar.Value == "" && envVar.SecretRef == nil && envVar.FieldRef == "" && envVar.Incomplete == ""
+}
+
+// redefined reports whether any of the variables has the name
+func redefined(envVars []config.EnvVar, name string) bool {
+	return slices.ContainsFunc(envVars, func(envVar config.EnvVar) bool { return envVar.Name == name })
+}
+
+// fromValueFile reports whether the variable with the name is set by --value-from-file
+func fromValueFile(vars []env.ResolvedVar, name string) bool {
+	return slices.ContainsFunc(vars, func(v env.ResolvedVar) bool { return v.Name == name && v.Source == env.SourceFile })
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+func TestCheckStrictSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		envVars []config.EnvVar
+		vars    []env.ResolvedVar // As resolved from the config
+		want    []string
+	}{
+		{
+			name:    "empty literal value",
+			envVars: []config.EnvVar{{Name: "API_KEY", Value: ""}},
+			want:    []string{"API_KEY: value is empty"},
+		},
+		{
+			name:    "empty literal value overriding an earlier one",
+			envVars: []config.EnvVar{{Name: "API_KEY", Value: "key"}, {Name: "API_KEY", Value: ""}},
+			vars:    []env.ResolvedVar{{Name: "API_KEY", Value: "key", Source: env.SourceConfig}},
+			want:    []string{"API_KEY: value is empty"},
+		},
+		{
+			name:    "empty literal value overridden later in the config",
+			envVars: []config.EnvVar{{Name: "API_KEY", Value: ""}, {Name: "API_KEY", Value: "key"}},
+			vars:    []env.ResolvedVar{{Name: "API_KEY", Value: "key", Source: env.SourceConfig}},
+		},
+		{
+			name:    "empty literal value replaced by a value file",
+			envVars: []config.EnvVar{{Name: "API_KEY", Value: ""}},
+			vars:    []env.ResolvedVar{{Name: "API_KEY", Value: "key", Source: env.SourceFile}},
+		},
+		{
+			name:    "empty secret",
+			envVars: []config.EnvVar{{Name: "API_KEY", SecretRef: &config.SecretRef{Name: "api-key", Key: "latest"}}},
+			vars:    []env.ResolvedVar{{Name: "API_KEY", Value: " ", Source: env.SourceSecret}},
+			want:    []string{"API_KEY: value is empty"},
+		},
+		{
+			name:    "placeholder",
+			envVars: []config.EnvVar{{Name: "API_KEY", Value: "changeme"}},
+			vars:    []env.ResolvedVar{{Name: "API_KEY", Value: "changeme", Source: env.SourceConfig}},
+			want:    []string{"API_KEY: value is the placeholder CHANGEME"},
+		},
+		{
+			name:    "field reference",
+			envVars: []config.EnvVar{{Name: "SERVICE", FieldRef: "metadata.name"}},
+			vars:    []env.ResolvedVar{{Name: "SERVICE", Value: "api", Source: env.SourceConfig}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{EnvironmentVars: tt.envVars}
+			err := checkStrictSecrets(cfg, &options{strictSecrets: true}, tt.vars)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// sourceTransform is the source of variables added or changed by the --transform hook
+const sourceTransform env.Source = "transform"
+
+// transformVar is a variable as exchanged with the --transform hook
+type transformVar struct {
+	Name   string     `json:"name"`
+	Value  string     `json:"value"`
+	Source env.Source `json:"source,omitempty"`
+}
+
+// transform passes the variables through the --transform executable, which reads them as
+// a JSON array on stdin and writes the transformed array to stdout
+func transform(ctx context.Context, executable string, vars []env.ResolvedVar) ([]env.ResolvedVar, error) {
+	input := make([]transformVar, 0, len(vars))
+	sources := make(map[string]env.ResolvedVar, len(vars))
+	for _, v := range vars {
+		input = append(input, transformVar{Name: v.Name, Value: v.Value, Source: v.Source})
+		sources[v.Name] = v
+	}
+
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("marshal variables: %w", err)
+	}
+
+	var stdout bytes.Buffer
+	//nolint:gosec // the hook is chosen by the user on purpose
+	cmd := exec.CommandContext(ctx, executable)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("run %s: %w", executable, err)
+	}
+
+	var output []transformVar
+	decoder := json.NewDecoder(&stdout)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&output); err != nil {
+		return nil, fmt.Errorf("decode output of %s: %w", executable, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("decode output of %s: unexpected data after the variables", executable)
+	}
+
+	result := make([]env.ResolvedVar, 0, len(output))
+	seen := make(map[string]bool, len(output))
+	for i, v := range output {
+		if v.Name == "" || strings.Contains(v.Name, "=") {
+			return nil, fmt.Errorf("output of %s: invalid variable name %q at index %d", executable, v.Name, i)
+		}
+		if seen[v.Name] {
+			return nil, fmt.Errorf("output of %s: duplicate variable %s", executable, v.Name)
+		}
+		seen[v.Name] = true
+
+		result = append(result, env.ResolvedVar{Name: v.Name, Value: v.Value, Source: transformedSource(sources, v)})
+	}
+
+	return result, nil
+}
+
+// transformedSource returns the source of a variable returned by the hook. Unchanged variables
+// keep their source, and derived values of secrets and files keep theirs so they're never displayed.
+func transformedSource(sources map[string]env.ResolvedVar, v transformVar) env.Source {
+	original, ok := sources[v.Name]
+	switch {
+	case ok && original.Value == v.Value:
+		return original.Source
+	case ok && (original.Source == env.SourceSecret || original.Source == env.SourceFile):
+		return original.Source
+	default:
+		return sourceTransform
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+)
+
+// upService is a config started by up, with the command it runs
+type upService struct {
+	name    string // Prefix of its output
+	cfg     *config.Config
+	opts    *options
+	command []string
+	stdout  *prefixWriter
+	stderr  *prefixWriter
+}
+
+// upResult is how the command of a service ended
+type upResult struct {
+	service *upService
+	err     error
+}
+
+// runUp runs the command of every CONFIG=COMMAND argument with the environment of its
+// config, each resolved with its own impersonation, and waits for all of them to exit.
+// Their output is prefixed with the name of the service. Signals and --timeout stop all of
+// them, and so does the first failure with --fail-fast. Fails with the exit code of the
+// first service that failed.
+func runUp(ctx context.Context, opts *options, args []string) error {
+	if len(args) == 0 {
+		return &stageError{stage: stageUsage, err: errors.New("up requires at least one service: cloudrun-local up [FLAGS] CONFIG=COMMAND...")}
+	}
+	switch {
+	case opts.replace:
+		return errors.New("--replace can't be combined with up, which runs several commands")
+	case opts.accessBoundary != "":
+		return errors.New("--access-boundary only applies to serve: up can't downscope tokens, its commands mint their own from the credentials file with all of the service account's access")
+	case opts.lazySecrets || opts.metadataAddr != "":
+		return errors.New("--lazy-secrets and --metadata-addr only apply to serve")
+	case opts.lockFile != "":
+		return errors.New("--lockfile can't be combined with up, the configs would overwrite each other's pins")
+	case opts.service != "":
+		return errors.New("--service can't be combined with up, every service would get the same name")
+	case opts.report != "":
+		return errors.New("--report can't be combined with up, the services would overwrite each other's reports")
+	case opts.port < 0 || opts.port+len(args)-1 > 65535:
+		return fmt.Errorf("--port must leave room for %d ports below 65536", len(args))
+	}
+	if err := checkWatchSecrets(opts); err != nil {
+		return err
+	}
+	if err := checkCleanEnv(opts); err != nil {
+		return err
+	}
+	if opts.strictArgs && !opts.expandArgs {
+		return errors.New("--strict-args requires --expand-args")
+	}
+
+	// Every config is loaded before any command starts, so a broken one starts nothing
+	services, err := upServices(ctx, opts, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan upResult, len(services))
+	for _, service := range services {
+		go func() {
+			results <- upResult{service: service, err: service.run(ctx)}
+		}()
+	}
+
+	var failed error
+	for range services {
+		result := <-results
+		err := upError(result)
+		if err == nil {
+			logger.InfoContext(ctx, fmt.Sprintf("%s exited", result.service.name), "exit_code", 0)
+			continue
+		}
+		logger.WarnContext(ctx, err.Error())
+		if failed != nil {
+			continue
+		}
+		failed = err
+		if opts.failFast && ctx.Err() == nil {
+			logger.WarnContext(ctx, fmt.Sprintf("--fail-fast: stopping the other services after %s failed", result.service.name))
+			cancel()
+		}
+	}
+	return failed
+}
+
+// upServices parses the CONFIG=COMMAND arguments and loads their configs. The command is
+// split on whitespace, without quoting. Services are named after their config, or its
+// file if the config has no name or shares it with another.
+func upServices(ctx context.Context, opts *options, args []string) ([]*upService, error) {
+	services := make([]*upService, 0, len(args))
+	for i, arg := range args {
+		configFile, commandLine, ok := strings.Cut(arg, "=")
+		command := strings.Fields(commandLine)
+		if !ok || configFile == "" || len(command) == 0 {
+			return nil, &stageError{stage: stageUsage, err: fmt.Errorf("invalid service %q, expected CONFIG=COMMAND", arg)}
+		}
+
+		serviceOpts := *opts
+		serviceOpts.configFile = configFile
+		if opts.port > 0 {
+			// Like the ones of --metadata-file, PORT is an automatic variable the config overrides
+			port := env.ResolvedVar{Name: "PORT", Value: strconv.Itoa(opts.port + i), Source: env.SourceMetadata}
+			serviceOpts.metadataFileVars = append(slices.Clone(opts.metadataFileVars), port)
+		}
+
+		cfg, err := loadConfig(ctx, &serviceOpts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+		if err := checkSecurityContext(cfg, &serviceOpts); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+		services = append(services, &upService{name: cfg.ServiceName, cfg: cfg, opts: &serviceOpts, command: command})
+	}
+
+	counts := make(map[string]int, len(services))
+	for _, service := range services {
+		counts[service.name]++
+	}
+	for i, service := range services {
+		if service.name == "" || counts[service.name] > 1 {
+			service.name = filepath.Base(args[i][:strings.IndexByte(args[i], '=')])
+		}
+	}
+
+	// Lines of all services are written whole, with the prefixes aligned
+	width := 0
+	for _, service := range services {
+		width = max(width, len(service.name))
+	}
+	var mu sync.Mutex
+	for _, service := range services {
+		prefix := fmt.Sprintf("%-*s | ", width, service.name)
+		service.stdout = &prefixWriter{mu: &mu, w: os.Stdout, prefix: prefix}
+		service.stderr = &prefixWriter{mu: &mu, w: os.Stderr, prefix: prefix}
+		service.opts.childOutput = &commandOutput{stdout: service.stdout, stderr: service.stderr}
+	}
+	return services, nil
+}
+
+// run resolves the environment of the service and runs its command, again whenever
+// --watch-secrets sees a new version of a secret
+func (s *upService) run(ctx context.Context) error {
+	defer s.stdout.flush()
+	defer s.stderr.flush()
+
+	watcher := newSecretWatcher(ctx, s.cfg, s.opts)
+	for {
+		err := execCommand(ctx, s.cfg, s.opts, s.command, watcher)
+		if !errors.Is(err, errSecretRotated) {
+			return err
+		}
+		logger.InfoContext(ctx, fmt.Sprintf("%s restarts for a new secret version", s.name))
+	}
+}
+
+// upError returns the error of a service that failed, naming the service, or nil if its
+// command exited with 0
+func upError(result upResult) error {
+	var exitErr *exitCodeError
+	switch {
+	case result.err == nil:
+		return nil
+	case errors.As(result.err, &exitErr) && exitErr.err == nil:
+		return &exitCodeError{code: exitErr.code, err: fmt.Errorf("%s exited with code %d", result.service.name, exitErr.code)}
+	default:
+		return fmt.Errorf("%s: %w", result.service.name, result.err)
+	}
+}
+
+// prefixWriter writes every line written to it to w with a prefix. The prefixWriters
+// sharing a mutex never interleave their lines.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte // Start of a line without its newline yet
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// flush writes the last line, if the command didn't end it with a newline
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		_ = p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+// writeLine writes a line with the prefix
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := io.WriteString(p.w, p.prefix+string(line))
+	return err
+}
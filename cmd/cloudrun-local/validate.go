@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/lint"
+)
+
+// runValidate checks the config and the lint rules without contacting GCP
+func runValidate(ctx context.Context, opts *options) error {
+	cfg, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("parse config: %w", err)}
+	}
+
+	for _, warning := range cfg.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+
+	if len(cfg.Containers) == 0 {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("no containers found in %s", opts.configFile)}
+	}
+
+	if opts.rulesFile != "" {
+		rules, err := lint.Load(opts.rulesFile)
+		if err != nil {
+			return &stageError{stage: stageConfig, err: fmt.Errorf("load lint rules: %w", err)}
+		}
+
+		errorCount := 0
+		for i := range cfg.Containers {
+			for _, violation := range rules.Check(cfg.WithContainer(i)) {
+				fmt.Println(violation)
+				if violation.Severity == lint.SeverityError {
+					errorCount++
+				}
+			}
+		}
+		if errorCount > 0 {
+			return &stageError{stage: stageConfig, err: fmt.Errorf("%s has %d lint errors", opts.configFile, errorCount)}
+		}
+	}
+
+	fmt.Printf("%s is valid\n", opts.configFile)
+	return nil
+}
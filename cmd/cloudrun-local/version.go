@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set by the release build with -ldflags "-X main.version=..."
+var (
+	version = "0.1.0"
+	commit  = ""
+	date    = ""
+)
+
+// versionInfo is the version printed by --version --json
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// buildVersion returns the build information. Binaries built from a checkout without the
+// release ldflags fall back to the VCS information Go embeds for the commit and date.
+func buildVersion() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Commit:    commit,
+		BuildDate: date,
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range buildInfo.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = setting.Value
+		}
+	}
+	return info
+}
+
+// printVersion prints the version, as JSON with --json
+func printVersion(opts *options) error {
+	info := buildVersion()
+	if opts.versionJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+
+	fmt.Printf("cloudrun-local version %s\n", info.Version)
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/env"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// defaultPollInterval is how often --watch-secrets checks for new versions
+	defaultPollInterval = 30 * time.Second
+	// minPollInterval is the shortest --poll-interval, keeping polling well within the
+	// Secret Manager quota
+	minPollInterval = 10 * time.Second
+)
+
+// errSecretRotated is returned for a command terminated because a secret has a new version
+var errSecretRotated = errors.New("secret has a new version")
+
+// Reasons of the event logged when a watched or served command exits
+const (
+	exitReasonSecretChange = "secret-change"
+	exitReasonSignal       = "signal"
+	exitReasonTimeout      = "timeout"
+	exitReasonCrash        = "crash"
+	exitReasonExit         = "exit"
+)
+
+// secretWatcher polls the versions the latest secret references of a config resolve to
+type secretWatcher struct {
+	tokens   oauth2.TokenSource
+	cfg      *config.Config
+	interval time.Duration
+	opts     *options
+}
+
+// checkWatchSecrets rejects flags that keep latest references from following new versions
+func checkWatchSecrets(opts *options) error {
+	if !opts.watchSecrets {
+		return nil
+	}
+	switch {
+	case opts.pollInterval < minPollInterval:
+		return fmt.Errorf("--poll-interval must be at least %s", minPollInterval)
+	case opts.replace:
+		return errors.New("--watch-secrets can't be combined with --replace, nothing would be left to restart the command")
+	case opts.latestAs != "":
+		return errors.New("--watch-secrets can't be combined with --secret-version-latest-as, which fixes the version of latest references")
+	case opts.lockFile != "" && !opts.updateLock:
+		return errors.New("--watch-secrets can't be combined with the pins of --lockfile, add --update-lock to pin new versions on every restart")
+	default:
+		return nil
+	}
+}
+
+// newSecretWatcher returns a watcher for the secrets of the config, nil unless --watch-secrets
+// is set. It mints tokens of its own, as polling outlives the token of any single resolution.
+func newSecretWatcher(ctx context.Context, cfg *config.Config, opts *options) *secretWatcher {
+	if !opts.watchSecrets {
+		return nil
+	}
+	return &secretWatcher{
+		tokens:   auth.NewTokenSource(ctx, apiClient(cfg, opts), cfg.ServiceAccount, auth.SecretManagerScope),
+		cfg:      cfg,
+		interval: opts.pollInterval,
+		opts:     opts,
+	}
+}
+
+// run runs the command, terminating it once a latest secret the resolver fetched has a new
+// version, in which case errSecretRotated is returned along with the command's own error.
+// A nil watcher runs the command as is.
+func (w *secretWatcher) run(ctx context.Context, resolver *env.Resolver, run func(context.Context) error) error {
+	if w == nil {
+		return run(ctx)
+	}
+
+	versions := resolver.LatestVersions()
+	if len(versions) == 0 {
+		logger.WarnContext(ctx, "--watch-secrets: no secret is referenced at version latest, nothing to watch")
+		return run(ctx)
+	}
+	logger.DebugContext(ctx, fmt.Sprintf("Checking %d secrets for new versions every %s", len(versions), w.interval))
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w.wait(runCtx, versions) {
+			cancel(errSecretRotated)
+		}
+	}()
+
+	err := run(runCtx)
+	rotated := errors.Is(context.Cause(runCtx), errSecretRotated)
+	cancel(nil)
+	wg.Wait()
+
+	if rotated && ctx.Err() == nil {
+		return errors.Join(errSecretRotated, err)
+	}
+	return err
+}
+
+// logExit logs why the command exited and with which code, one event per run for following
+// restarts and crashes over a long session, e.g. as JSON with --log-format json. Nothing is
+// logged for a command that was never started.
+func logExit(ctx context.Context, err error) {
+	code := 0
+	var exitErr *exitCodeError
+	var timeoutErr *timeoutError
+	switch {
+	case errors.As(err, &exitErr):
+		// Start failures carry an error of their own, the command's exit code doesn't, unless
+		// --enforce-timeout terminated it
+		if exitErr.err != nil && !errors.As(exitErr.err, &timeoutErr) {
+			return
+		}
+		code = exitErr.code
+	case err != nil && !errors.Is(err, errSecretRotated):
+		return
+	}
+
+	reason := exitReasonExit
+	switch {
+	case errors.Is(err, errSecretRotated):
+		reason = exitReasonSecretChange
+	case timeoutErr != nil || errors.As(context.Cause(ctx), &timeoutErr):
+		reason = exitReasonTimeout
+	case ctx.Err() != nil:
+		reason = exitReasonSignal
+	case code != 0:
+		reason = exitReasonCrash
+	}
+	logger.InfoContext(ctx, "Command exited", "reason", reason, "exit_code", code)
+}
+
+// wait polls the secrets every interval until one resolves to another version than the one
+// given, reporting whether one did before ctx is done
+func (w *secretWatcher) wait(ctx context.Context, versions map[string]string) bool {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+		if w.rotated(ctx, versions) {
+			return true
+		}
+	}
+}
+
+// rotated reports whether any of the secrets resolves to another version than the one given.
+// Failed polls are logged, the secret is checked again at the next interval.
+func (w *secretWatcher) rotated(ctx context.Context, versions map[string]string) bool {
+	client, err := newSecretsClient(ctx, w.cfg, w.opts, w.tokens)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.WarnContext(ctx, "--watch-secrets: create Secret Manager client", "error", err)
+		}
+		return false
+	}
+	defer client.Close()
+
+	for _, secret := range slices.Sorted(maps.Keys(versions)) {
+		current, err := client.AccessSecretVersion(ctx, secret, "latest")
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			logger.WarnContext(ctx, fmt.Sprintf("--watch-secrets: check secret %s", secret), "error", err)
+			continue
+		}
+		if current.Version != versions[secret] {
+			logger.InfoContext(ctx, fmt.Sprintf("Secret %s has a new version %s, was %s, restarting the command", secret, current.Version, versions[secret]))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+)
+
+// Values of --format of the whoami command
+const (
+	whoamiFormatTable = "table"
+	whoamiFormatJSON  = "json"
+)
+
+// identityReport is the identity printed by the whoami command
+type identityReport struct {
+	ServiceAccount      string `json:"service_account"`
+	Project             string `json:"project"`
+	SourceIdentity      string `json:"source_identity,omitempty"`
+	SourceIdentityError string `json:"source_identity_error,omitempty"`
+	Impersonated        bool   `json:"impersonated"`
+	ImpersonationError  string `json:"impersonation_error,omitempty"`
+}
+
+// runWhoami prints the identity the config resolves with: the service account, its project,
+// the local identity impersonating it and whether impersonation works. Nothing is fetched
+// with the impersonated token. Fails after printing if impersonation doesn't work.
+func runWhoami(ctx context.Context, opts *options) error {
+	if opts.format != whoamiFormatTable && opts.format != whoamiFormatJSON {
+		return fmt.Errorf("unsupported format: %s (expected %s or %s)", opts.format, whoamiFormatTable, whoamiFormatJSON)
+	}
+
+	cfg, err := config.Parse(ctx, opts.configFile, opts.selector(), opts.configFormat)
+	if err != nil {
+		return &stageError{stage: stageConfig, err: fmt.Errorf("parse config: %w", err)}
+	}
+
+	for _, warning := range cfg.Warnings {
+		logger.WarnContext(ctx, warning)
+	}
+
+	if err := determineProject(ctx, cfg); err != nil {
+		return err
+	}
+
+	report := identityReport{
+		ServiceAccount: cfg.ServiceAccount,
+		Project:        cfg.ProjectID,
+	}
+
+	if identity, err := auth.SourceIdentity(ctx, httpClient); err != nil {
+		report.SourceIdentityError = err.Error()
+	} else {
+		report.SourceIdentity = identity
+	}
+
+	_, impersonationErr := auth.NewTokenSource(ctx, apiClient(cfg, opts), cfg.ServiceAccount, auth.CloudPlatformScope).Token()
+	if impersonationErr != nil {
+		report.ImpersonationError = impersonationErr.Error()
+	} else {
+		report.Impersonated = true
+	}
+
+	if err := printIdentity(opts.format, report); err != nil {
+		return err
+	}
+
+	if impersonationErr != nil {
+		return &stageError{
+			stage:          stageAuth,
+			serviceAccount: cfg.ServiceAccount,
+			err:            fmt.Errorf("impersonate %s: %w", cfg.ServiceAccount, impersonationErr),
+		}
+	}
+	return nil
+}
+
+// printIdentity prints the report to stdout in the format
+func printIdentity(format string, report identityReport) error {
+	if format == whoamiFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	sourceIdentity := report.SourceIdentity
+	if sourceIdentity == "" {
+		sourceIdentity = "unknown (" + report.SourceIdentityError + ")"
+	}
+	impersonation := "ok"
+	if !report.Impersonated {
+		impersonation = "failed"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "SERVICE ACCOUNT\t%s\n", report.ServiceAccount)
+	fmt.Fprintf(w, "PROJECT\t%s\n", report.Project)
+	fmt.Fprintf(w, "SOURCE IDENTITY\t%s\n", sourceIdentity)
+	fmt.Fprintf(w, "IMPERSONATION\t%s\n", impersonation)
+	return w.Flush()
+}
@@ -9,20 +9,41 @@ import (
 	"io"
 	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
+// OAuth scopes of impersonated access tokens
+const (
+	// CloudPlatformScope grants everything the service account's IAM roles allow
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// SecretManagerScope is used for the tool's own Secret Manager access. Secret Manager
+	// has no narrower scope, IAM roles on the secrets limit what the token can read.
+	SecretManagerScope = CloudPlatformScope
+	// EmailScope adds the email claim to a token, naming the identity it belongs to
+	EmailScope = "https://www.googleapis.com/auth/userinfo.email"
+)
+
 // Credentials holds authentication information
 type Credentials struct {
-	AccessToken string
-	CredsFile   string // Path to temporary credentials file
+	AccessToken string    // Token for the tool's own Secret Manager access, never passed to the command
+	CredsFile   string    // Path to temporary credentials file, from which the command mints its own tokens, empty if not created
+	Expiry      time.Time // When AccessToken expires, as reported by generateAccessToken
+
+	session bool // CredsFile belongs to a session and outlives the run
 }
 
-// GetImpersonatedCredentials fetches an impersonated access token and creates a credentials file
-func GetImpersonatedCredentials(ctx context.Context, serviceAccountEmail string) (*Credentials, error) {
+// GetImpersonatedCredentials fetches an impersonated access token for Secret Manager and
+// creates a credentials file for the command
+func GetImpersonatedCredentials(ctx context.Context, httpClient *http.Client, serviceAccountEmail string) (*Credentials, error) {
 	// Read application default credentials
 	currentADC, err := applicationDefaultCredentials()
 	if err != nil {
@@ -30,7 +51,7 @@ func GetImpersonatedCredentials(ctx context.Context, serviceAccountEmail string)
 	}
 
 	// Fetch impersonated access token
-	accessToken, err := fetchImpersonatedAccessToken(ctx, serviceAccountEmail)
+	token, err := fetchImpersonatedAccessToken(ctx, httpClient, serviceAccountEmail)
 	if err != nil {
 		return nil, fmt.Errorf("fetch impersonated access token: %w", err)
 	}
@@ -42,37 +63,39 @@ func GetImpersonatedCredentials(ctx context.Context, serviceAccountEmail string)
 	}
 
 	return &Credentials{
-		AccessToken: accessToken,
+		AccessToken: token.AccessToken,
 		CredsFile:   credsFile,
+		Expiry:      token.Expiry,
 	}, nil
 }
 
-// Cleanup removes the temporary credentials file
-func (c *Credentials) Cleanup() error {
-	if c.CredsFile == "" {
-		return nil
+// GetImpersonatedToken fetches an impersonated access token for Secret Manager without
+// creating a credentials file, for commands that get their tokens elsewhere
+func GetImpersonatedToken(ctx context.Context, httpClient *http.Client, serviceAccountEmail string) (*Credentials, error) {
+	// Impersonation still starts from the application default credentials
+	if _, err := applicationDefaultCredentials(); err != nil {
+		return nil, err
 	}
-	return os.Remove(c.CredsFile)
+
+	token, err := fetchImpersonatedAccessToken(ctx, httpClient, serviceAccountEmail)
+	if err != nil {
+		return nil, fmt.Errorf("fetch impersonated access token: %w", err)
+	}
+
+	return &Credentials{AccessToken: token.AccessToken, Expiry: token.Expiry}, nil
 }
 
-// getGcloudConfigDir returns the gcloud configuration directory
-func getGcloudConfigDir() (string, error) {
-	// gcloud stores credentials in ~/.config/gcloud/ on all platforms
-	// Respect CLOUDSDK_CONFIG if set, otherwise use ~/.config/gcloud
-	configDir := os.Getenv("CLOUDSDK_CONFIG")
-	if configDir == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return "", fmt.Errorf("get user home directory: %w", err)
-		}
-		configDir = filepath.Join(home, ".config", "gcloud")
+// Cleanup removes the temporary credentials file, unless it belongs to a session
+func (c *Credentials) Cleanup() error {
+	if c.CredsFile == "" || c.session {
+		return nil
 	}
-	return configDir, nil
+	return os.Remove(c.CredsFile)
 }
 
 // applicationDefaultCredentials reads the local application default credentials
 func applicationDefaultCredentials() (string, error) {
-	configDir, err := getGcloudConfigDir()
+	configDir, err := config.GcloudConfigDir()
 	if err != nil {
 		return "", err
 	}
@@ -90,23 +113,177 @@ func applicationDefaultCredentials() (string, error) {
 	return string(b), nil
 }
 
-// fetchImpersonatedAccessToken generates an access token for the service account
-func fetchImpersonatedAccessToken(ctx context.Context, serviceAccountEmail string) (string, error) {
-	// Get credentials from application default credentials
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+// ApplicationDefaultCredentialsType returns the type of the local application default
+// credentials impersonation starts from, such as authorized_user
+func ApplicationDefaultCredentialsType() (string, error) {
+	adc, err := applicationDefaultCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	var file struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(adc), &file); err != nil {
+		return "", fmt.Errorf("parse application default credentials: %w", err)
+	}
+	if file.Type == "" {
+		return "", errors.New("application default credentials have no type")
+	}
+	return file.Type, nil
+}
+
+// tokenInfoURL returns the claims of an access token
+const tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// ErrNoEmailClaim is returned by SourceIdentity when the default credentials work, but their
+// access token doesn't name the identity
+var ErrNoEmailClaim = errors.New("access token of the default credentials has no email claim")
+
+// SourceIdentity returns the email of the application default credentials that service
+// accounts are impersonated with. Service account keys and impersonated credentials name it,
+// for other credentials it's the email claim of their access token, which is only present
+// if they were granted the userinfo.email scope, as gcloud does.
+func SourceIdentity(ctx context.Context, httpClient *http.Client) (string, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	creds, err := google.FindDefaultCredentials(ctx, CloudPlatformScope)
 	if err != nil {
 		return "", fmt.Errorf("find default credentials: %w", err)
 	}
 
-	// Get access token
-	token, err := creds.TokenSource.Token()
+	var file struct {
+		Type                           string `json:"type"`
+		ClientEmail                    string `json:"client_email"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if len(creds.JSON) > 0 {
+		if err := json.Unmarshal(creds.JSON, &file); err != nil {
+			return "", fmt.Errorf("unmarshal default credentials: %w", err)
+		}
+	}
+	switch {
+	case file.Type == "service_account" && file.ClientEmail != "":
+		return file.ClientEmail, nil
+	case file.Type == "impersonated_service_account":
+		// .../serviceAccounts/EMAIL:generateAccessToken
+		_, rest, _ := strings.Cut(file.ServiceAccountImpersonationURL, "/serviceAccounts/")
+		if email, _, _ := strings.Cut(rest, ":"); email != "" {
+			return email, nil
+		}
+	}
+
+	token, err := sourceToken(ctx, creds.TokenSource)
 	if err != nil {
 		return "", fmt.Errorf("get access token: %w", err)
 	}
 
+	email, err := TokenIdentity(ctx, httpClient, token.AccessToken)
+	if errors.Is(err, errNoEmail) {
+		return "", ErrNoEmailClaim
+	}
+	return email, err
+}
+
+// errNoEmail is returned by TokenIdentity for a token without the email claim
+var errNoEmail = errors.New("access token has no email claim")
+
+// TokenIdentity returns the email of the identity the access token belongs to, from its
+// email claim. Tokens only carry the claim if they were granted EmailScope. The token is
+// sent in the body rather than the URL, which proxies and access logs may record.
+func TokenIdentity(ctx context.Context, httpClient *http.Client, accessToken string) (string, error) {
+	form := url.Values{"access_token": {accessToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenInfoURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get token info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("get token info (status %d): %s", resp.StatusCode, string(b))
+	}
+
+	var info struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decode token info: %w", err)
+	}
+	if info.Email == "" {
+		return "", errNoEmail
+	}
+
+	return info.Email, nil
+}
+
+// NewDefaultTokenSource returns a token source of the application default credentials
+// themselves, for API calls made as the local identity rather than the service account
+func NewDefaultTokenSource(ctx context.Context, httpClient *http.Client) (oauth2.TokenSource, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	creds, err := google.FindDefaultCredentials(ctx, CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("find default credentials: %w", err)
+	}
+	return creds.TokenSource, nil
+}
+
+// fetchImpersonatedAccessToken generates an access token for the service account. It's
+// granted EmailScope too, so TokenIdentity can tell whose token it is.
+func fetchImpersonatedAccessToken(ctx context.Context, httpClient *http.Client, serviceAccountEmail string) (*oauth2.Token, error) {
+	return NewTokenSource(ctx, httpClient, serviceAccountEmail, SecretManagerScope, EmailScope).Token()
+}
+
+// NewTokenSource returns a token source minting access tokens with the scopes for the
+// service account. Tokens are cached and refreshed shortly before they expire.
+func NewTokenSource(ctx context.Context, httpClient *http.Client, serviceAccountEmail string, scopes ...string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSourceWithExpiry(nil, &impersonatedTokenSource{
+		ctx:                 ctx,
+		httpClient:          httpClient,
+		serviceAccountEmail: serviceAccountEmail,
+		scopes:              scopes,
+	}, tokenRefreshWindow)
+}
+
+// tokenRefreshWindow is how long before expiry a cached token is refreshed
+const tokenRefreshWindow = 5 * time.Minute
+
+// impersonatedTokenSource mints a new access token for the service account on every call
+type impersonatedTokenSource struct {
+	ctx                 context.Context
+	httpClient          *http.Client
+	serviceAccountEmail string
+	scopes              []string
+}
+
+// Token implements oauth2.TokenSource
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	// The default credentials refresh their token with the client from the context
+	ctx := context.WithValue(s.ctx, oauth2.HTTPClient, s.httpClient)
+
+	// Get access token of the application default credentials
+	token := prefetchedSourceToken(ctx)
+	if token == nil {
+		creds, err := google.FindDefaultCredentials(ctx, CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("find default credentials: %w", err)
+		}
+		token, err = sourceToken(ctx, creds.TokenSource)
+		if err != nil {
+			return nil, fmt.Errorf("get access token: %w", err)
+		}
+	}
+
 	accessToken := token.AccessToken
 	if accessToken == "" {
-		return "", fmt.Errorf("got empty access token")
+		return nil, fmt.Errorf("got empty access token")
 	}
 
 	// Generate access token for delegated service account
@@ -114,49 +291,163 @@ func fetchImpersonatedAccessToken(ctx context.Context, serviceAccountEmail strin
 		Delegates []string `json:"delegates"`
 		Scope     []string `json:"scope"`
 	}{
-		Delegates: []string{"projects/-/serviceAccounts/" + serviceAccountEmail},
-		Scope:     []string{"https://www.googleapis.com/auth/cloud-platform"},
+		Delegates: []string{"projects/-/serviceAccounts/" + s.serviceAccountEmail},
+		Scope:     s.scopes,
 	}
 
 	reqBody, err := json.Marshal(body)
 	if err != nil {
-		return "", fmt.Errorf("marshal request body: %w", err)
+		return nil, fmt.Errorf("marshal request body: %w", err)
 	}
 
 	url := fmt.Sprintf(
 		"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
-		serviceAccountEmail,
+		s.serviceAccountEmail,
 	)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		b, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to generate access token (status %d): %s", resp.StatusCode, string(b))
+		return nil, fmt.Errorf("failed to generate access token (status %d): %s", resp.StatusCode, string(b))
 	}
 
 	var tokens struct {
-		AccessToken string `json:"accessToken"`
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return tokens.AccessToken, nil
+	return &oauth2.Token{
+		AccessToken: tokens.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      tokens.ExpireTime,
+	}, nil
+}
+
+// sourceTokenKey is the context key of the token PrefetchSourceToken gets
+type sourceTokenKey struct{}
+
+// prefetchedToken is a token of the application default credentials fetched in the background
+type prefetchedToken struct {
+	done  chan struct{} // Closed once the fetch ended
+	token *oauth2.Token // Nil if the fetch failed
+}
+
+// PrefetchSourceToken starts getting a token of the application default credentials in the
+// background and returns a context carrying it. The token doesn't depend on the service
+// account, so it's fetched while the config is still loaded, and impersonations with the
+// context exchange it until it expires, instead of getting their own.
+func PrefetchSourceToken(ctx context.Context, httpClient *http.Client) context.Context {
+	prefetched := &prefetchedToken{done: make(chan struct{})}
+	go func() {
+		defer close(prefetched.done)
+
+		creds, err := google.FindDefaultCredentials(context.WithValue(ctx, oauth2.HTTPClient, httpClient), CloudPlatformScope)
+		if err != nil {
+			return
+		}
+		// A failure is left to impersonation, which retries it and reports the cause
+		if token, err := creds.TokenSource.Token(); err == nil {
+			prefetched.token = token
+		}
+	}()
+	return context.WithValue(ctx, sourceTokenKey{}, prefetched)
+}
+
+// prefetchedSourceToken returns the token PrefetchSourceToken got for the context, waiting
+// for it if it's still fetched, or nil if there is none or it expired
+func prefetchedSourceToken(ctx context.Context) *oauth2.Token {
+	prefetched, ok := ctx.Value(sourceTokenKey{}).(*prefetchedToken)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-prefetched.done:
+	case <-ctx.Done():
+		return nil
+	}
+	if !prefetched.token.Valid() {
+		return nil
+	}
+	return prefetched.token
+}
+
+const (
+	// sourceTokenAttempts is how often getting a token of the default credentials is tried
+	sourceTokenAttempts = 3
+	// sourceTokenBackoff is the wait before the first retry, doubled for each further one
+	sourceTokenBackoff = 500 * time.Millisecond
+)
+
+// sourceToken gets a token of the application default credentials, retrying transient
+// failures such as network errors. Credentials rejected by the token endpoint aren't retried.
+func sourceToken(ctx context.Context, tokens oauth2.TokenSource) (*oauth2.Token, error) {
+	wait := sourceTokenBackoff
+	for attempt := 1; ; attempt++ {
+		token, err := tokens.Token()
+		if err == nil {
+			return token, nil
+		}
+
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+			status := retrieveErr.Response.StatusCode
+			switch {
+			case retrieveErr.ErrorCode == "invalid_grant" || status == http.StatusUnauthorized:
+				return nil, fmt.Errorf("application default credentials were rejected, they may have expired or been revoked. "+
+					"Please authenticate again using 'gcloud auth application-default login': %w", err)
+			case status < http.StatusInternalServerError && status != http.StatusTooManyRequests:
+				return nil, err
+			}
+		}
+
+		if attempt == sourceTokenAttempts {
+			return nil, fmt.Errorf("failed %d times: %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
 }
 
 // createDelegatedCredsFile creates a temporary credentials file with impersonation config
 func createDelegatedCredsFile(currentADC, serviceAccountEmail string) (string, error) {
+	delegateCredsJSON, err := delegatedCreds(currentADC, serviceAccountEmail)
+	if err != nil {
+		return "", err
+	}
+
+	// Create temp directory
+	tempDir := os.TempDir()
+	credsPath := filepath.Join(tempDir, fmt.Sprintf("cloudrun-local-creds-%s.json", randomLower(8)))
+
+	if err := os.WriteFile(credsPath, delegateCredsJSON, 0o600); err != nil {
+		return "", err
+	}
+
+	return credsPath, nil
+}
+
+// delegatedCreds returns the credentials impersonating the service account with the
+// application default credentials
+func delegatedCreds(currentADC, serviceAccountEmail string) ([]byte, error) {
 	serviceAccountImpersonationURL := fmt.Sprintf(
 		"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
 		serviceAccountEmail,
@@ -174,20 +465,7 @@ func createDelegatedCredsFile(currentADC, serviceAccountEmail string) (string, e
 		SourceCredentials:              json.RawMessage(currentADC),
 	}
 
-	delegateCredsJSON, err := json.Marshal(delegateCreds)
-	if err != nil {
-		return "", err
-	}
-
-	// Create temp directory
-	tempDir := os.TempDir()
-	credsPath := filepath.Join(tempDir, fmt.Sprintf("cloudrun-local-creds-%s.json", randomLower(8)))
-
-	if err := os.WriteFile(credsPath, delegateCredsJSON, 0o600); err != nil {
-		return "", err
-	}
-
-	return credsPath, nil
+	return json.Marshal(delegateCreds)
 }
 
 // randomLower generates a random lowercase string of length n
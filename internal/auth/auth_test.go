@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeGoogle answers token requests of the application default credentials and
+// generateAccessToken requests, each after the latency of a round trip
+type fakeGoogle struct {
+	latency time.Duration
+}
+
+func (f *fakeGoogle) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-time.After(f.latency):
+	}
+
+	body := `{"access_token": "source-token", "token_type": "Bearer", "expires_in": 3600}`
+	if strings.HasSuffix(req.URL.Path, ":generateAccessToken") {
+		body = `{"accessToken": "impersonated-token", "expireTime": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// loadConfigLatency stands in for loading the config before the service account is known,
+// e.g. from a git repository
+const loadConfigLatency = 20 * time.Millisecond
+
+// BenchmarkImpersonation measures the time from starting to load the config to having the
+// impersonated token, with the token of the local credentials fetched before or after
+func BenchmarkImpersonation(b *testing.B) {
+	b.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "testdata/authorized_user.json")
+	httpClient := &http.Client{Transport: &fakeGoogle{latency: 20 * time.Millisecond}}
+
+	for _, prefetch := range []bool{false, true} {
+		name := "sequential"
+		if prefetch {
+			name = "prefetched"
+		}
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				ctx := context.Background()
+				if prefetch {
+					ctx = PrefetchSourceToken(ctx, httpClient)
+				}
+				time.Sleep(loadConfigLatency)
+
+				if _, err := fetchImpersonatedAccessToken(ctx, httpClient, "app@my-project.iam.gserviceaccount.com"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// flakyTokenSource fails with the errors before returning a token
+type flakyTokenSource struct {
+	errs  []error
+	calls int
+}
+
+func (s *flakyTokenSource) Token() (*oauth2.Token, error) {
+	s.calls++
+	if s.calls <= len(s.errs) {
+		return nil, s.errs[s.calls-1]
+	}
+	return &oauth2.Token{AccessToken: "source-token"}, nil
+}
+
+func TestSourceTokenRetries(t *testing.T) {
+	tokens := &flakyTokenSource{errs: []error{errors.New("dial tcp: connection reset by peer")}}
+
+	token, err := sourceToken(t.Context(), tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "source-token" {
+		t.Errorf("got token %q, want %q", token.AccessToken, "source-token")
+	}
+	if tokens.calls != 2 {
+		t.Errorf("got %d calls, want 2", tokens.calls)
+	}
+}
+
+// tokenInfo answers tokeninfo requests with the email of the token sent in the form body
+type tokenInfo struct {
+	query string // Raw query of the last request
+}
+
+func (f *tokenInfo) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.query = req.URL.RawQuery
+	body := `{"error": "invalid_token"}`
+	status := http.StatusBadRequest
+	if req.Method == http.MethodPost && req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		if req.PostForm.Get("access_token") == "impersonated-token" {
+			body, status = `{"email": "sa@my-project.iam.gserviceaccount.com"}`, http.StatusOK
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestTokenIdentityKeepsTokenOutOfURL(t *testing.T) {
+	fake := &tokenInfo{}
+	email, err := TokenIdentity(t.Context(), &http.Client{Transport: fake}, "impersonated-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != "sa@my-project.iam.gserviceaccount.com" {
+		t.Errorf("got email %q, want %q", email, "sa@my-project.iam.gserviceaccount.com")
+	}
+	if fake.query != "" {
+		t.Errorf("got query %q, want the token only in the body", fake.query)
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google/downscope"
+)
+
+// storageBucketPrefix is the prefix of the buckets the rules of a Credential Access Boundary
+// apply to. Cloud Storage is the only service that enforces boundaries.
+const storageBucketPrefix = "//storage.googleapis.com/projects/_/buckets/"
+
+// maxBoundaryRules is the most rules Security Token Service accepts in a boundary
+const maxBoundaryRules = 10
+
+// AccessBoundary is a Credential Access Boundary, limiting what downscoped tokens may access
+// to the resources and roles of its rules
+type AccessBoundary struct {
+	Rules []downscope.AccessBoundaryRule `json:"accessBoundaryRules"`
+}
+
+// LoadAccessBoundary reads a Credential Access Boundary from a JSON file, in the format of
+// Security Token Service: {"accessBoundary": {"accessBoundaryRules": [...]}}
+func LoadAccessBoundary(path string) (*AccessBoundary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		AccessBoundary *AccessBoundary `json:"accessBoundary"`
+	}
+	// A misspelt field would otherwise silently drop a restriction
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if file.AccessBoundary == nil {
+		return nil, fmt.Errorf("%s: expected an accessBoundary object", path)
+	}
+
+	boundary := file.AccessBoundary
+	switch {
+	case len(boundary.Rules) == 0:
+		return nil, fmt.Errorf("%s: accessBoundaryRules is empty", path)
+	case len(boundary.Rules) > maxBoundaryRules:
+		return nil, fmt.Errorf("%s: %d accessBoundaryRules, at most %d are supported", path, len(boundary.Rules), maxBoundaryRules)
+	}
+	for i, rule := range boundary.Rules {
+		if err := checkBoundaryRule(rule); err != nil {
+			return nil, fmt.Errorf("%s: accessBoundaryRules[%d]: %w", path, i, err)
+		}
+	}
+	return boundary, nil
+}
+
+// checkBoundaryRule checks that the rule names a bucket and the roles available on it
+func checkBoundaryRule(rule downscope.AccessBoundaryRule) error {
+	bucket, ok := strings.CutPrefix(rule.AvailableResource, storageBucketPrefix)
+	if !ok || bucket == "" || strings.Contains(bucket, "/") {
+		return fmt.Errorf("availableResource %q isn't a bucket, expected %sBUCKET, only Cloud Storage enforces access boundaries", rule.AvailableResource, storageBucketPrefix)
+	}
+	if len(rule.AvailablePermissions) == 0 {
+		return errors.New("availablePermissions is empty")
+	}
+	for _, permission := range rule.AvailablePermissions {
+		if !strings.HasPrefix(permission, "inRole:") {
+			return fmt.Errorf("availablePermissions entry %q isn't a role, expected e.g. inRole:roles/storage.objectViewer", permission)
+		}
+	}
+	if rule.Condition != nil && rule.Condition.Expression == "" {
+		return errors.New("availabilityCondition has no expression")
+	}
+	return nil
+}
+
+// NewDownscopedTokenSource returns a token source exchanging the tokens of the root token
+// source for ones limited by the boundary. A downscoped token never grants more than the
+// root token does. Tokens are cached and refreshed shortly before they expire.
+func NewDownscopedTokenSource(ctx context.Context, httpClient *http.Client, root oauth2.TokenSource, boundary *AccessBoundary) (oauth2.TokenSource, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	tokens, err := downscope.NewTokenSource(ctx, downscope.DownscopingConfig{RootSource: root, Rules: boundary.Rules})
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSourceWithExpiry(nil, tokens, tokenRefreshWindow), nil
+}
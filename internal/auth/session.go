@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+)
+
+// sessionPattern restricts session ids to characters safe in file names
+var sessionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// sessionToken is the access token cached in a session
+type sessionToken struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// SessionDir returns the directory of the session's files in the temporary directory
+func SessionDir(session string) (string, error) {
+	if !sessionPattern.MatchString(session) {
+		return "", fmt.Errorf("invalid session id %q, expected letters, digits, '_', '.' and '-'", session)
+	}
+	return filepath.Join(os.TempDir(), "cloudrun-local-session-"+session), nil
+}
+
+// GetSessionCredentials is like GetImpersonatedCredentials, but keeps the credentials file
+// and the access token in the session's directory, named after the service account. Runs
+// of the same session reuse the token until shortly before it expires, and the file as
+// long as the application default credentials don't change. Without credsFile, only the
+// token is kept, like GetImpersonatedToken.
+func GetSessionCredentials(ctx context.Context, httpClient *http.Client, serviceAccountEmail, session string, credsFile bool) (*Credentials, error) {
+	currentADC, err := applicationDefaultCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := sessionDir(session)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", session, err)
+	}
+
+	tokenPath := filepath.Join(dir, serviceAccountEmail+".token.json")
+	token, ok := readSessionToken(tokenPath)
+	if !ok {
+		fetched, err := fetchImpersonatedAccessToken(ctx, httpClient, serviceAccountEmail)
+		if err != nil {
+			return nil, fmt.Errorf("fetch impersonated access token: %w", err)
+		}
+		token = sessionToken{AccessToken: fetched.AccessToken, Expiry: fetched.Expiry}
+
+		data, err := json.Marshal(token)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeSessionFile(tokenPath, data); err != nil {
+			return nil, fmt.Errorf("session %s: cache access token: %w", session, err)
+		}
+	}
+
+	creds := &Credentials{AccessToken: token.AccessToken, Expiry: token.Expiry, session: true}
+	if !credsFile {
+		return creds, nil
+	}
+
+	data, err := delegatedCreds(currentADC, serviceAccountEmail)
+	if err != nil {
+		return nil, fmt.Errorf("create credentials file: %w", err)
+	}
+	creds.CredsFile = filepath.Join(dir, serviceAccountEmail+".json")
+	if existing, err := os.ReadFile(creds.CredsFile); err != nil || !bytes.Equal(existing, data) {
+		if err := writeSessionFile(creds.CredsFile, data); err != nil {
+			return nil, fmt.Errorf("create credentials file: %w", err)
+		}
+	}
+	return creds, nil
+}
+
+// CleanSession removes the session's files. Fails with fs.ErrNotExist if there are none.
+func CleanSession(session string) error {
+	dir, err := SessionDir(session)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// sessionDir creates the session's directory, or checks that an existing one is a private
+// directory rather than one planted by another user of the shared temporary directory
+func sessionDir(session string) (string, error) {
+	dir, err := SessionDir(session)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Mkdir(dir, 0o700)
+	if err == nil || !errors.Is(err, fs.ErrExist) {
+		return dir, err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	// Windows doesn't report Unix permissions, its temporary directory is per user
+	if !info.IsDir() || (runtime.GOOS != "windows" && info.Mode().Perm() != 0o700) {
+		return "", fmt.Errorf("%s exists, but isn't a directory with mode 0700", dir)
+	}
+	return dir, nil
+}
+
+// readSessionToken reads the cached access token, reporting whether it's still valid for
+// longer than the refresh window
+func readSessionToken(path string) (sessionToken, bool) {
+	var token sessionToken
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &token) != nil || token.AccessToken == "" {
+		return sessionToken{}, false
+	}
+	return token, time.Until(token.Expiry) > tokenRefreshWindow
+}
+
+// writeSessionFile replaces the file atomically, so concurrent runs of the session never
+// read it half-written
+func writeSessionFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,83 @@
+package cloudrun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// baseURL is the Cloud Run Admin API v2 endpoint
+const baseURL = "https://run.googleapis.com"
+
+// maxResponseSize bounds the size of resources and errors read from the API
+const maxResponseSize = 4 << 20
+
+// ErrNotFound is returned when the service or job isn't deployed in the region
+var ErrNotFound = errors.New("not found")
+
+// Client reads deployed services and jobs from the Cloud Run Admin API
+type Client struct {
+	httpClient *http.Client
+	tokens     oauth2.TokenSource
+}
+
+// NewClient creates a client reading resources with the tokens of the token source
+func NewClient(httpClient *http.Client, tokens oauth2.TokenSource) *Client {
+	return &Client{httpClient: httpClient, tokens: tokens}
+}
+
+// Get returns the v2 resource of the deployed Service or Job as JSON, as config.ParseReader
+// parses it
+func (c *Client) Get(ctx context.Context, project, region, kind, name string) ([]byte, error) {
+	collection := "services"
+	if kind == "Job" {
+		collection = "jobs"
+	}
+	resource := fmt.Sprintf("projects/%s/locations/%s/%s/%s", project, region, collection, name)
+
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("get access token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/v2/"+(&url.URL{Path: resource}).EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token.SetAuthHeader(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", resource, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", resource, ErrNotFound)
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("permission denied on %s, reading it needs run.%s.get, e.g. with the Cloud Run Viewer role", resource, collection)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+			return nil, fmt.Errorf("get %s: received %d: %s", resource, resp.StatusCode, body.Error.Message)
+		}
+		return nil, fmt.Errorf("get %s: expected 200 response status, received %d", resource, resp.StatusCode)
+	}
+	return data, nil
+}
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2/google"
 	"gopkg.in/yaml.v3"
@@ -13,10 +19,68 @@ import (
 
 // Config represents a parsed Cloud Run service configuration
 type Config struct {
+	Kind            string // Service or Job
 	ServiceName     string
 	ServiceAccount  string
 	ProjectID       string
+	Region          string           // Region the service or job is deployed in, empty if unknown
+	Timeout         time.Duration    // Request timeout of a service or task timeout of a job, zero if not set
+	Image           string           // Image of the container
+	WorkingDir      string           // Working directory of the container, empty if not set
+	SecurityContext *SecurityContext // Security context of the container, nil if not set
 	EnvironmentVars []EnvVar
+	EnvPath         string       // Path of the container's env in the config, for diagnostics
+	SecretFiles     []SecretFile // Files of the secret volumes mounted into the container
+	Containers      []Container  // All containers, the fields above describe the selected one, if any
+	Warnings        []string     // Parts of the config that are ignored locally
+}
+
+// Container is a container of the service or job
+type Container struct {
+	Name            string
+	Image           string
+	WorkingDir      string
+	SecurityContext *SecurityContext
+	EnvironmentVars []EnvVar
+	EnvPath         string
+	SecretFiles     []SecretFile
+}
+
+// WithContainer returns a copy of the config with the container at index i selected
+func (c *Config) WithContainer(i int) *Config {
+	selected := *c
+	container := c.Containers[i]
+	selected.Image = container.Image
+	selected.WorkingDir = container.WorkingDir
+	selected.SecurityContext = container.SecurityContext
+	selected.EnvironmentVars = container.EnvironmentVars
+	selected.EnvPath = container.EnvPath
+	selected.SecretFiles = container.SecretFiles
+	return &selected
+}
+
+// ContainerIndex returns the index of the container with the name, failing with the names
+// of the config's containers if there is none
+func (c *Config) ContainerIndex(name string) (int, error) {
+	names := make([]string, 0, len(c.Containers))
+	for i, container := range c.Containers {
+		if container.Name == name {
+			return i, nil
+		}
+		names = append(names, container.Name)
+	}
+	if len(names) == 0 {
+		return -1, fmt.Errorf("no container named %s, the config has no containers", name)
+	}
+	return -1, fmt.Errorf("no container named %s, expected one of: %s", name, strings.Join(names, ", "))
+}
+
+// withFirstContainer selects the first container, if there is any
+func (c *Config) withFirstContainer() *Config {
+	if len(c.Containers) == 0 {
+		return c
+	}
+	return c.WithContainer(0)
 }
 
 // EnvVar represents an environment variable from the config
@@ -24,31 +88,366 @@ type EnvVar struct {
 	Name      string
 	Value     string
 	SecretRef *SecretRef
+	FieldRef  string // Field path of a downward API reference, one of the FieldPath constants
+	Path      string // Entry of the env list defining the variable, for diagnostics, empty if not from a file
+	// Incomplete describes what's missing from a secret reference that can't be resolved,
+	// such as a secretKeyRef without a key. The variable is left out of the environment.
+	Incomplete string
 }
 
+// SecurityContext is the user and group the container runs as
+type SecurityContext struct {
+	RunAsUser  *int64 `json:"runAsUser"`
+	RunAsGroup *int64 `json:"runAsGroup"`
+}
+
+// Field paths supported in valueFrom.fieldRef
+const (
+	FieldPathName           = "metadata.name"
+	FieldPathNamespace      = "metadata.namespace"
+	FieldPathServiceAccount = "spec.serviceAccountName"
+)
+
 // SecretRef represents a reference to a secret in Secret Manager
 type SecretRef struct {
+	Name    string
+	Key     string // Version, or a comma-separated list of versions to try in order
+	Project string // Project of the secret if referenced by its full path, empty for the config's project
+}
+
+// Secret returns the full path of the secret if its project is set, and its name otherwise
+func (r *SecretRef) Secret() string {
+	if r.Project == "" {
+		return r.Name
+	}
+	return fmt.Sprintf("projects/%s/secrets/%s", r.Project, r.Name)
+}
+
+// serviceAccountAnnotation sets the service account in configs exported by older tools,
+// used when spec.serviceAccountName is empty
+const serviceAccountAnnotation = "run.googleapis.com/service-account"
+
+// locationLabel is the label Cloud Run sets to the region of a Service, Job or Revision.
+// Some tools set it as an annotation instead.
+const locationLabel = "cloud.googleapis.com/location"
+
+// rawMetadata is the metadata of a Service, Job or Revision
+type rawMetadata struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// region returns the region of the location label or annotation, empty if there is neither
+func (m rawMetadata) region() string {
+	if region := m.Labels[locationLabel]; region != "" {
+		return region
+	}
+	return m.Annotations[locationLabel]
+}
+
+// rawTemplateMetadata is the metadata of a revision or execution template
+type rawTemplateMetadata struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// rawContainer is a container definition as it appears in a Service or Job template
+type rawContainer struct {
+	Name            string           `json:"name"`
+	Image           string           `json:"image"`
+	WorkingDir      string           `json:"workingDir"`
+	Env             []rawEnvVar      `json:"env"`
+	SecurityContext *SecurityContext `json:"securityContext"`
+	VolumeMounts    []rawVolumeMount `json:"volumeMounts"`
+}
+
+// rawEnvVar is a container environment variable as it appears in the config
+type rawEnvVar struct {
+	Name      string       `json:"name"`
+	Value     scalarString `json:"value"`
+	ValueFrom struct {
+		SecretKeyRef struct {
+			Name string       `json:"name"`
+			Key  scalarString `json:"key"`
+		} `json:"secretKeyRef"`
+		FieldRef struct {
+			FieldPath string `json:"fieldPath"`
+		} `json:"fieldRef"`
+	} `json:"valueFrom"`
+}
+
+// scalarString is a string that may be written as any YAML scalar, such as value: 8080,
+// value: true or key: 3, which is read as its text. Numbers are in the form YAML parses
+// them to, e.g. 1.0 becomes 1, so quoting the value keeps it exactly.
+type scalarString string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *scalarString) UnmarshalJSON(data []byte) error {
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*s = ""
+	case data[0] == '"':
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*s = scalarString(value)
+	case data[0] == '{' || data[0] == '[':
+		return fmt.Errorf("expected a string, number or boolean, got %s", data)
+	default:
+		// Numbers and booleans are valid JSON literals, which are their text
+		*s = scalarString(data)
+	}
+	return nil
+}
+
+// Selector picks the resource to parse from a file with multiple YAML documents.
+// Empty fields match any resource.
+type Selector struct {
+	Kind string // Service or Job
 	Name string
-	Key  string
+	// Revision is the name of a revision template, matched against the template name of
+	// Services and against Revision documents
+	Revision string
 }
 
-// Parse reads and parses a Cloud Run YAML configuration file (Service or Job)
-func Parse(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
+// Format is the syntax of a config
+type Format string
+
+// Formats of configs. FormatAuto parses configs starting with { as JSON, and others as YAML.
+const (
+	FormatAuto Format = ""
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// Parse reads and parses a Cloud Run YAML or JSON configuration file (Service or Job),
+// either in the Knative format, as a Cloud Run Admin API v2 resource or as a minimal
+// config of a service account and variables. The file is a path, a git+ location or -
+// for stdin.
+// Files with multiple documents must contain a single Service or Job matching the selector.
+func Parse(ctx context.Context, filename string, selector Selector, format Format) (*Config, error) {
+	data, err := readConfig(ctx, filename)
 	if err != nil {
-		return nil, fmt.Errorf("read config file: %w", err)
+		return nil, err
+	}
+	return ParseReader(bytes.NewReader(data), selector, format)
+}
+
+// ParseReader parses a config like Parse, from a reader
+func ParseReader(r io.Reader, selector Selector, format Format) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	// Editors on Windows may save a byte order mark, which neither format allows
+	data = bytes.TrimPrefix(data, utf8BOM)
+
+	if format == FormatAuto {
+		format = FormatYAML
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+			format = FormatJSON
+		}
+	}
+
+	var documents [][]byte
+	switch format {
+	case FormatYAML:
+		documents, err = splitDocuments(data)
+	case FormatJSON:
+		documents, err = splitJSONDocuments(data)
+	default:
+		return nil, fmt.Errorf("unsupported config format: %s (expected %s or %s)", format, FormatYAML, FormatJSON)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if selector.Revision != "" {
+		document, err := selectRevision(documents, selector)
+		if err != nil {
+			return nil, err
+		}
+		return parseDocument(document)
+	}
+
+	// A single document is parsed as is, to report unsupported kinds
+	if len(documents) == 1 && selector == (Selector{}) {
+		return parseDocument(documents[0])
+	}
+
+	var candidates [][]byte
+	for _, document := range documents {
+		kind, name := identify(document)
+		if kind == "" {
+			continue
+		}
+		if selector.Kind != "" && kind != selector.Kind {
+			continue
+		}
+		if selector.Name != "" && name != selector.Name {
+			continue
+		}
+		candidates = append(candidates, document)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("no Service or Job matching %s found in config", selector)
+	case 1:
+		return parseDocument(candidates[0])
+	default:
+		return nil, fmt.Errorf("found %d Services and Jobs matching %s in config, select one with --kind or --name", len(candidates), selector)
+	}
+}
+
+// String describes the selector in error messages
+func (s Selector) String() string {
+	var parts []string
+	if s.Kind != "" {
+		parts = append(parts, "kind "+s.Kind)
+	}
+	if s.Name != "" {
+		parts = append(parts, "name "+s.Name)
+	}
+	if len(parts) == 0 {
+		return "any kind and name"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// splitDocuments reads every YAML document of the file and converts it to JSON for easier
+// typed parsing. Empty documents are skipped.
+func splitDocuments(data []byte) ([][]byte, error) {
+	var documents [][]byte
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var yamlRaw map[string]any
+		if err := decoder.Decode(&yamlRaw); errors.Is(err, io.EOF) {
+			return documents, nil
+		} else if err != nil {
+			if tabErr := tabIndentation(data, err); tabErr != nil {
+				return nil, tabErr
+			}
+			return nil, fmt.Errorf("unmarshal yaml: %w", err)
+		}
+		if yamlRaw == nil {
+			continue
+		}
+
+		jsonData, err := json.Marshal(yamlRaw)
+		if err != nil {
+			return nil, fmt.Errorf("marshal to json: %w", err)
+		}
+		documents = append(documents, jsonData)
 	}
+}
 
-	// Unmarshal YAML into a generic map
-	var yamlRaw map[string]any
-	if err := yaml.Unmarshal(data, &yamlRaw); err != nil {
-		return nil, fmt.Errorf("unmarshal yaml: %w", err)
+// utf8BOM is the UTF-8 byte order mark
+var utf8BOM = []byte("\ufeff")
+
+// yamlErrorLine matches the line number in the errors of the YAML parser
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+):`)
+
+// tabIndentation explains a YAML error caused by a line indented with a tab, which YAML
+// doesn't allow, pointing at the line. The parser reports them as a tab violating the
+// indentation or a character that cannot start a token, at the line of the tab or of the
+// node it's in. Returns nil for other errors, or if no line from there on is indented with
+// a tab.
+func tabIndentation(data []byte, err error) error {
+	match := yamlErrorLine.FindStringSubmatch(err.Error())
+	if match == nil || !strings.Contains(err.Error(), "tab character") && !strings.Contains(err.Error(), "cannot start any token") {
+		return nil
+	}
+	first, _ := strconv.Atoi(match[1])
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if i+1 < first {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if column := strings.IndexByte(indent, '\t'); column >= 0 {
+			return fmt.Errorf("unmarshal yaml: line %d, column %d: indented with a tab, YAML only allows spaces: %q", i+1, column+1, strings.TrimRight(line, "\r"))
+		}
+	}
+	return nil
+}
+
+// splitJSONDocuments reads every JSON object of the file, which may hold several one after
+// another. Null values are skipped.
+func splitJSONDocuments(data []byte) ([][]byte, error) {
+	var documents [][]byte
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); errors.Is(err, io.EOF) {
+			return documents, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unmarshal json: %w", err)
+		}
+
+		var object map[string]any
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, fmt.Errorf("unmarshal json: document is not an object: %w", err)
+		}
+		if object == nil {
+			continue
+		}
+		documents = append(documents, raw)
+	}
+}
+
+// identify returns the kind and name of a document, or an empty kind if it's neither
+// a Service nor a Job
+func identify(jsonData []byte) (kind, name string) {
+	if isV2(jsonData) {
+		return identifyV2(jsonData)
+	}
+	if isSimple(jsonData) {
+		var header rawSimple
+		if err := json.Unmarshal(jsonData, &header); err != nil {
+			return "", ""
+		}
+		return "Service", header.Name
 	}
 
-	// Convert to JSON for easier typed parsing
-	jsonData, err := json.Marshal(yamlRaw)
+	var header struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(jsonData, &header); err != nil {
+		return "", ""
+	}
+	if header.Kind != "Service" && header.Kind != "Job" {
+		return "", ""
+	}
+	return header.Kind, header.Metadata.Name
+}
+
+// parseDocument parses a single Service or Job document
+func parseDocument(jsonData []byte) (*Config, error) {
+	cfg, err := parseKind(jsonData)
 	if err != nil {
-		return nil, fmt.Errorf("marshal to json: %w", err)
+		return nil, err
+	}
+	if err := checkSecretVersions(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseKind parses a document according to its format and kind
+func parseKind(jsonData []byte) (*Config, error) {
+	if isV2(jsonData) {
+		return parseV2(jsonData)
+	}
+	if isSimple(jsonData) {
+		return parseSimple(jsonData)
 	}
 
 	// Check the kind to determine if it's a Service or Job
@@ -64,6 +463,8 @@ func Parse(filename string) (*Config, error) {
 		return parseService(jsonData)
 	case "Job":
 		return parseJob(jsonData)
+	case "Revision":
+		return parseRevision(jsonData)
 	default:
 		return nil, fmt.Errorf("unsupported kind: %s (expected Service or Job)", kindCheck.Kind)
 	}
@@ -72,25 +473,15 @@ func Parse(filename string) (*Config, error) {
 // parseService parses a Cloud Run Service configuration
 func parseService(jsonData []byte) (*Config, error) {
 	var raw struct {
-		Metadata struct {
-			Name string `json:"name"`
-		} `json:"metadata"`
-		Spec struct {
+		Metadata rawMetadata `json:"metadata"`
+		Spec     struct {
 			Template struct {
-				Spec struct {
-					ServiceAccountName string `json:"serviceAccountName"`
-					Containers         []struct {
-						Env []struct {
-							Name      string `json:"name"`
-							Value     string `json:"value"`
-							ValueFrom struct {
-								SecretKeyRef struct {
-									Name string `json:"name"`
-									Key  string `json:"key"`
-								} `json:"secretKeyRef"`
-							} `json:"valueFrom"`
-						} `json:"env"`
-					} `json:"containers"`
+				Metadata rawTemplateMetadata `json:"metadata"`
+				Spec     struct {
+					ServiceAccountName string         `json:"serviceAccountName"`
+					TimeoutSeconds     int            `json:"timeoutSeconds"`
+					Containers         []rawContainer `json:"containers"`
+					Volumes            []rawVolume    `json:"volumes"`
 				} `json:"spec"`
 			} `json:"template"`
 		} `json:"spec"`
@@ -100,11 +491,12 @@ func parseService(jsonData []byte) (*Config, error) {
 		return nil, fmt.Errorf("unmarshal service json: %w", err)
 	}
 
-	if len(raw.Spec.Template.Spec.Containers) != 1 {
-		return nil, fmt.Errorf("expected exactly 1 container, got %d", len(raw.Spec.Template.Spec.Containers))
-	}
+	containers, warnings := parseContainers(raw.Spec.Template.Spec.Containers, raw.Spec.Template.Spec.Volumes, "spec.template.spec.containers[%d].env")
 
 	serviceAccount := raw.Spec.Template.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = raw.Spec.Template.Metadata.Annotations[serviceAccountAnnotation]
+	}
 	if serviceAccount == "" {
 		return nil, fmt.Errorf("serviceAccountName not found in config")
 	}
@@ -114,40 +506,33 @@ func parseService(jsonData []byte) (*Config, error) {
 		return nil, fmt.Errorf("extract project ID: %w", err)
 	}
 
-	envVars := parseEnvVars(raw.Spec.Template.Spec.Containers[0].Env)
-
-	return &Config{
-		ServiceName:     raw.Metadata.Name,
-		ServiceAccount:  serviceAccount,
-		ProjectID:       projectID,
-		EnvironmentVars: envVars,
-	}, nil
+	cfg := &Config{
+		Kind:           "Service",
+		ServiceName:    raw.Metadata.Name,
+		ServiceAccount: serviceAccount,
+		ProjectID:      projectID,
+		Region:         raw.Metadata.region(),
+		Timeout:        time.Duration(raw.Spec.Template.Spec.TimeoutSeconds) * time.Second,
+		Containers:     containers,
+		Warnings:       warnings,
+	}
+	return cfg.withFirstContainer(), nil
 }
 
 // parseJob parses a Cloud Run Job configuration
 func parseJob(jsonData []byte) (*Config, error) {
 	var raw struct {
-		Metadata struct {
-			Name string `json:"name"`
-		} `json:"metadata"`
-		Spec struct {
+		Metadata rawMetadata `json:"metadata"`
+		Spec     struct {
 			Template struct {
-				Spec struct {
+				Metadata rawTemplateMetadata `json:"metadata"`
+				Spec     struct {
 					Template struct {
 						Spec struct {
-							ServiceAccountName string `json:"serviceAccountName"`
-							Containers         []struct {
-								Env []struct {
-									Name      string `json:"name"`
-									Value     string `json:"value"`
-									ValueFrom struct {
-										SecretKeyRef struct {
-											Name string `json:"name"`
-											Key  string `json:"key"`
-										} `json:"secretKeyRef"`
-									} `json:"valueFrom"`
-								} `json:"env"`
-							} `json:"containers"`
+							ServiceAccountName string         `json:"serviceAccountName"`
+							TimeoutSeconds     int            `json:"timeoutSeconds"`
+							Containers         []rawContainer `json:"containers"`
+							Volumes            []rawVolume    `json:"volumes"`
 						} `json:"spec"`
 					} `json:"template"`
 				} `json:"spec"`
@@ -159,11 +544,16 @@ func parseJob(jsonData []byte) (*Config, error) {
 		return nil, fmt.Errorf("unmarshal job json: %w", err)
 	}
 
-	if len(raw.Spec.Template.Spec.Template.Spec.Containers) != 1 {
-		return nil, fmt.Errorf("expected exactly 1 container, got %d", len(raw.Spec.Template.Spec.Template.Spec.Containers))
-	}
+	containers, warnings := parseContainers(
+		raw.Spec.Template.Spec.Template.Spec.Containers,
+		raw.Spec.Template.Spec.Template.Spec.Volumes,
+		"spec.template.spec.template.spec.containers[%d].env",
+	)
 
 	serviceAccount := raw.Spec.Template.Spec.Template.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = raw.Spec.Template.Metadata.Annotations[serviceAccountAnnotation]
+	}
 	if serviceAccount == "" {
 		return nil, fmt.Errorf("serviceAccountName not found in config")
 	}
@@ -173,64 +563,168 @@ func parseJob(jsonData []byte) (*Config, error) {
 		return nil, fmt.Errorf("extract project ID: %w", err)
 	}
 
-	envVars := parseEnvVars(raw.Spec.Template.Spec.Template.Spec.Containers[0].Env)
+	cfg := &Config{
+		Kind:           "Job",
+		ServiceName:    raw.Metadata.Name,
+		ServiceAccount: serviceAccount,
+		ProjectID:      projectID,
+		Region:         raw.Metadata.region(),
+		Timeout:        time.Duration(raw.Spec.Template.Spec.Template.Spec.TimeoutSeconds) * time.Second,
+		Containers:     containers,
+		Warnings:       warnings,
+	}
+	return cfg.withFirstContainer(), nil
+}
 
-	return &Config{
-		ServiceName:     raw.Metadata.Name,
-		ServiceAccount:  serviceAccount,
-		ProjectID:       projectID,
-		EnvironmentVars: envVars,
-	}, nil
+// parseContainers parses the containers of a template, of which there may be none, with the
+// secret volumes they mount. envPathFormat is the path of the env of a container in the
+// config, formatted with the container's index.
+func parseContainers(rawContainers []rawContainer, rawVolumes []rawVolume, envPathFormat string) ([]Container, []string) {
+	var (
+		containers = make([]Container, 0, len(rawContainers))
+		volumes    = secretVolumes(rawVolumes)
+		warnings   []string
+	)
+	for i, container := range rawContainers {
+		envPath := fmt.Sprintf(envPathFormat, i)
+		envVars, envWarnings := parseEnvVars(container.Env, envPath)
+		warnings = append(warnings, envWarnings...)
+
+		name := containerName(container.Name, i)
+		files, fileWarnings := secretFiles(volumes, container.VolumeMounts, name)
+		warnings = append(warnings, fileWarnings...)
+
+		containers = append(containers, Container{
+			Name:            name,
+			Image:           container.Image,
+			WorkingDir:      container.WorkingDir,
+			SecurityContext: container.SecurityContext,
+			EnvironmentVars: envVars,
+			EnvPath:         envPath,
+			SecretFiles:     files,
+		})
+	}
+	return containers, warnings
 }
 
-// parseEnvVars parses environment variables from container env array
-func parseEnvVars(envArray []struct {
-	Name      string `json:"name"`
-	Value     string `json:"value"`
-	ValueFrom struct {
-		SecretKeyRef struct {
-			Name string `json:"name"`
-			Key  string `json:"key"`
-		} `json:"secretKeyRef"`
-	} `json:"valueFrom"`
-}) []EnvVar {
-	var envVars []EnvVar
-	for _, env := range envArray {
-		envVar := EnvVar{Name: env.Name}
+// containerName returns the name of a container, which is optional in single-container configs
+func containerName(name string, index int) string {
+	if name == "" {
+		return fmt.Sprintf("container-%d", index)
+	}
+	return name
+}
+
+// parseEnvVars parses environment variables from container env array.
+// Warnings are returned for references that can't be resolved locally.
+func parseEnvVars(envArray []rawEnvVar, envPath string) ([]EnvVar, []string) {
+	var (
+		envVars  []EnvVar
+		warnings []string
+	)
+	for i, env := range envArray {
+		envVar := EnvVar{Name: env.Name, Path: fmt.Sprintf("%s[%d]", envPath, i)}
 
 		if env.Value != "" {
-			envVar.Value = env.Value
+			envVar.Value = string(env.Value)
 		} else if env.ValueFrom.SecretKeyRef.Name != "" && env.ValueFrom.SecretKeyRef.Key != "" {
 			envVar.SecretRef = &SecretRef{
 				Name: env.ValueFrom.SecretKeyRef.Name,
-				Key:  env.ValueFrom.SecretKeyRef.Key,
+				Key:  string(env.ValueFrom.SecretKeyRef.Key),
+			}
+		} else if env.ValueFrom.SecretKeyRef.Name != "" {
+			envVar.Incomplete = "secretKeyRef has no key"
+		} else if env.ValueFrom.SecretKeyRef.Key != "" {
+			envVar.Incomplete = "secretKeyRef has no name"
+		} else if fieldPath := env.ValueFrom.FieldRef.FieldPath; fieldPath != "" {
+			switch fieldPath {
+			case FieldPathName, FieldPathNamespace, FieldPathServiceAccount:
+				envVar.FieldRef = fieldPath
+			default:
+				warnings = append(warnings, fmt.Sprintf("env %s: fieldRef %s is not supported locally, skipping", env.Name, fieldPath))
+				continue
 			}
 		}
 
 		envVars = append(envVars, envVar)
 	}
-	return envVars
+	return envVars, warnings
 }
 
-// extractProjectID extracts the project ID from a service account email
-// Expected format: name@project-id.iam.gserviceaccount.com
+// checkSecretVersions fails if a secret is referenced with a version other than latest or a
+// version number. Cloud Run reads the key of a secretKeyRef as the version of the secret,
+// while Kubernetes reads it as a key within the secret's data, so a config written for GKE,
+// with a key such as "password", would otherwise fetch a version that doesn't exist.
+func checkSecretVersions(cfg *Config) error {
+	for _, container := range cfg.Containers {
+		for _, envVar := range container.EnvironmentVars {
+			if envVar.SecretRef != nil && !isSecretVersions(envVar.SecretRef) {
+				return fmt.Errorf(
+					"container %s: env %s: secret %s has version %q, expected latest, a version number or a comma-separated list of them to try in order; Cloud Run uses the secretKeyRef key as the secret version, not as a key within the secret as Kubernetes does",
+					container.Name, envVar.Name, envVar.SecretRef.Name, envVar.SecretRef.Key,
+				)
+			}
+		}
+		for _, file := range container.SecretFiles {
+			if !isSecretVersions(file.SecretRef) {
+				return fmt.Errorf(
+					"container %s: secret file %s: secret %s has version %q, expected latest, a version number or a comma-separated list of them to try in order; Cloud Run uses the item key as the secret version, not as a key within the secret as Kubernetes does",
+					container.Name, file.Path, file.SecretRef.Name, file.SecretRef.Key,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions of the key in the order they are tried, a single one
+// unless the key lists fallbacks, e.g. 5,4,latest
+func (r *SecretRef) Versions() []string {
+	versions := strings.Split(r.Key, ",")
+	for i, version := range versions {
+		versions[i] = strings.TrimSpace(version)
+	}
+	return versions
+}
+
+// isSecretVersions reports whether every version of the key is latest or a version number
+func isSecretVersions(ref *SecretRef) bool {
+	return !slices.ContainsFunc(ref.Versions(), func(version string) bool {
+		return !isSecretVersion(version)
+	})
+}
+
+// isSecretVersion reports whether the version is latest or a version number
+func isSecretVersion(version string) bool {
+	if version == "latest" {
+		return true
+	}
+	n, err := strconv.Atoi(version)
+	return err == nil && n > 0
+}
+
+// extractProjectID extracts the project ID from a service account email.
+// Expected format: name@project-id.iam.gserviceaccount.com or project-id@appspot.gserviceaccount.com.
+// An empty project ID is returned for other formats, such as the default compute
+// service account, whose domain doesn't carry the project ID.
 func extractProjectID(serviceAccount string) (string, error) {
 	parts := strings.Split(serviceAccount, "@")
 	if len(parts) != 2 {
 		return "", fmt.Errorf("invalid service account format: %s", serviceAccount)
 	}
 
-	domainParts := strings.Split(parts[1], ".")
-	if len(domainParts) < 1 {
-		return "", fmt.Errorf("invalid service account domain: %s", parts[1])
-	}
-
-	projectID := domainParts[0]
-	if projectID == "" {
-		return "", fmt.Errorf("could not extract project ID from service account: %s", serviceAccount)
+	switch {
+	case parts[1] == "appspot.gserviceaccount.com":
+		return parts[0], nil
+	case strings.HasSuffix(parts[1], ".iam.gserviceaccount.com"):
+		projectID := strings.Split(parts[1], ".")[0]
+		if projectID == "" {
+			return "", fmt.Errorf("could not extract project ID from service account: %s", serviceAccount)
+		}
+		return projectID, nil
+	default:
+		return "", nil
 	}
-
-	return projectID, nil
 }
 
 // GetDefaultProjectID returns the default project ID from application default credentials
@@ -0,0 +1,321 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseScalarValues(t *testing.T) {
+	cfg, err := Parse(t.Context(), "testdata/scalar.yaml", Selector{}, FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "PORT", want: "8080"},
+		{name: "DEBUG", want: "true"},
+		{name: "QUOTED", want: "8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envVar := findEnvVar(t, cfg, tt.name)
+			if envVar.Value != tt.want {
+				t.Errorf("got value %q, want %q", envVar.Value, tt.want)
+			}
+		})
+	}
+
+	if envVar := findEnvVar(t, cfg, "DB_PASSWORD"); envVar.SecretRef == nil || envVar.SecretRef.Key != "3" {
+		t.Errorf("got secret reference %+v, want key %q", envVar.SecretRef, "3")
+	}
+}
+
+// findEnvVar returns the variable of the config with the name
+func findEnvVar(t *testing.T, cfg *Config, name string) EnvVar {
+	t.Helper()
+	for _, envVar := range cfg.EnvironmentVars {
+		if envVar.Name == name {
+			return envVar
+		}
+	}
+	t.Fatalf("variable %s not found in config", name)
+	return EnvVar{}
+}
+
+func TestParseByteOrderMark(t *testing.T) {
+	for _, file := range []string{"testdata/bom.yaml", "testdata/bom.json"} {
+		t.Run(file, func(t *testing.T) {
+			cfg, err := Parse(t.Context(), file, Selector{}, FormatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ServiceAccount != "app@my-project.iam.gserviceaccount.com" {
+				t.Errorf("got service account %q, want %q", cfg.ServiceAccount, "app@my-project.iam.gserviceaccount.com")
+			}
+			if envVar := findEnvVar(t, cfg, "A"); envVar.Value != "one" {
+				t.Errorf("got value %q, want %q", envVar.Value, "one")
+			}
+		})
+	}
+}
+
+func TestParseTabIndentation(t *testing.T) {
+	_, err := Parse(t.Context(), "testdata/tabs.yaml", Selector{}, FormatAuto)
+	want := `unmarshal yaml: line 3, column 1: indented with a tab, YAML only allows spaces: "\t- name: A"`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestParseV2(t *testing.T) {
+	tests := []struct {
+		file               string
+		wantKind           string
+		wantName           string
+		wantServiceAccount string
+		wantValues         map[string]string
+		wantSecrets        map[string]SecretRef
+	}{
+		{
+			file:               "testdata/v2-service.yaml",
+			wantKind:           "Service",
+			wantName:           "api",
+			wantServiceAccount: "api@my-project.iam.gserviceaccount.com",
+			wantValues:         map[string]string{"LOG_LEVEL": "info"},
+			wantSecrets: map[string]SecretRef{
+				"DB_PASSWORD": {Name: "db-password", Key: "latest", Project: "other-project"},
+				"API_TOKEN":   {Name: "api-token", Key: "3"},
+			},
+		},
+		{
+			file:               "testdata/v2-job.yaml",
+			wantKind:           "Job",
+			wantName:           "migrate",
+			wantServiceAccount: "migrate@my-project.iam.gserviceaccount.com",
+			wantValues:         map[string]string{"LOG_LEVEL": "debug"},
+			wantSecrets: map[string]SecretRef{
+				"DB_PASSWORD": {Name: "db-password", Key: "latest"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			cfg, err := Parse(t.Context(), tt.file, Selector{}, FormatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Kind != tt.wantKind || cfg.ServiceName != tt.wantName {
+				t.Errorf("got %s %q, want %s %q", cfg.Kind, cfg.ServiceName, tt.wantKind, tt.wantName)
+			}
+			if cfg.ProjectID != "my-project" || cfg.Region != "europe-west1" {
+				t.Errorf("got project %q in %q, want %q in %q", cfg.ProjectID, cfg.Region, "my-project", "europe-west1")
+			}
+			if cfg.ServiceAccount != tt.wantServiceAccount {
+				t.Errorf("got service account %q, want %q", cfg.ServiceAccount, tt.wantServiceAccount)
+			}
+			if got, want := len(cfg.EnvironmentVars), len(tt.wantValues)+len(tt.wantSecrets); got != want {
+				t.Errorf("got %d variables, want %d", got, want)
+			}
+			for name, want := range tt.wantValues {
+				if envVar := findEnvVar(t, cfg, name); envVar.Value != want || envVar.SecretRef != nil {
+					t.Errorf("got %s=%q from %+v, want %q", name, envVar.Value, envVar.SecretRef, want)
+				}
+			}
+			for name, want := range tt.wantSecrets {
+				if envVar := findEnvVar(t, cfg, name); envVar.SecretRef == nil || *envVar.SecretRef != want {
+					t.Errorf("got %s from %+v, want %+v", name, envVar.SecretRef, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseServiceAccountAnnotation(t *testing.T) {
+	for _, file := range []string{"testdata/annotation-service.yaml", "testdata/annotation-job.yaml"} {
+		t.Run(file, func(t *testing.T) {
+			cfg, err := Parse(t.Context(), file, Selector{}, FormatAuto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ServiceAccount != "legacy@my-project.iam.gserviceaccount.com" {
+				t.Errorf("got service account %q, want %q", cfg.ServiceAccount, "legacy@my-project.iam.gserviceaccount.com")
+			}
+			if cfg.ProjectID != "my-project" {
+				t.Errorf("got project %q, want %q", cfg.ProjectID, "my-project")
+			}
+		})
+	}
+}
+
+func TestPathIsLocal(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "password", want: true},
+		{path: "db/password", want: true},
+		{path: "db/../password", want: true},
+		{path: "../password"},
+		{path: "db/../../password"},
+		{path: `..\password`},
+		{path: "password\x00"},
+		{path: "."},
+	}
+	for _, tt := range tests {
+		if got := pathIsLocal(tt.path); got != tt.want {
+			t.Errorf("pathIsLocal(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWithOverridesTimeout(t *testing.T) {
+	cfg := &Config{Kind: "Job", Timeout: 10 * time.Minute, Containers: []Container{{Name: "job"}}}
+
+	tests := []struct {
+		timeout string
+		want    time.Duration
+		wantErr bool
+	}{
+		{timeout: "", want: 10 * time.Minute},
+		{timeout: "300s", want: 5 * time.Minute},
+		{timeout: "1.5s", want: 1500 * time.Millisecond},
+		{timeout: "300", wantErr: true},
+		{timeout: "0s", wantErr: true},
+	}
+	for _, tt := range tests {
+		result, _, err := cfg.WithOverrides(&Overrides{Timeout: tt.timeout})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("WithOverrides(timeout %q) succeeded, want an error", tt.timeout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WithOverrides(timeout %q) = %v", tt.timeout, err)
+			continue
+		}
+		if result.Timeout != tt.want {
+			t.Errorf("WithOverrides(timeout %q) has timeout %s, want %s", tt.timeout, result.Timeout, tt.want)
+		}
+	}
+}
+
+func TestEnvVarPath(t *testing.T) {
+	cfg, err := Parse(t.Context(), "testdata/paths.yaml", Selector{}, FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// POD_IP is skipped, LOG_LEVEL keeps its index in the file
+	want := "spec.template.spec.containers[0].env[1]"
+	if envVar := findEnvVar(t, cfg, "LOG_LEVEL"); envVar.Path != want {
+		t.Errorf("got path %q, want %q", envVar.Path, want)
+	}
+
+	var overrides Overrides
+	if err := json.Unmarshal([]byte(`{"containerOverrides": [{"env": [{"name": "LOG_LEVEL", "value": "debug"}]}]}`), &overrides); err != nil {
+		t.Fatal(err)
+	}
+	overridden, _, err := cfg.WithOverrides(&overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := overridden.EnvironmentVars[len(overridden.EnvironmentVars)-1]
+	if want := "containerOverrides[0].env[0]"; last.Path != want {
+		t.Errorf("got path %q of the override, want %q", last.Path, want)
+	}
+}
+
+func TestParseGitLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		want     *gitLocation
+		wantErr  bool
+	}{
+		{
+			location: "git+https://github.com/org/repo//deploy/service.yaml@v1.2.0",
+			want:     &gitLocation{Repository: "https://github.com/org/repo", Path: "deploy/service.yaml", Ref: "v1.2.0"},
+		},
+		{
+			location: "git+ssh://git@github.com/org/repo//service.yaml",
+			want:     &gitLocation{Repository: "ssh://git@github.com/org/repo", Path: "service.yaml", Ref: "HEAD"},
+		},
+		{location: "git+https://github.com/org/repo//service.yaml@--upload-pack=touch /tmp/pwned", wantErr: true},
+		{location: "git+--upload-pack=touch /tmp/pwned;://host//service.yaml", wantErr: true},
+		{location: "git+https://github.com/org/repo/service.yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseGitLocation(tt.location)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseGitLocation(%q) = %+v, want an error", tt.location, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseGitLocation(%q) = %v", tt.location, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("parseGitLocation(%q) = %+v, want %+v", tt.location, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSecretVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		container Container
+		wantErr   bool
+	}{
+		{
+			name:      "latest on an env var",
+			container: Container{EnvironmentVars: []EnvVar{{Name: "DB_PASSWORD", SecretRef: &SecretRef{Name: "db", Key: "latest"}}}},
+		},
+		{
+			name:      "version number on an env var",
+			container: Container{EnvironmentVars: []EnvVar{{Name: "DB_PASSWORD", SecretRef: &SecretRef{Name: "db", Key: "3"}}}},
+		},
+		{
+			name:      "fallback versions on an env var",
+			container: Container{EnvironmentVars: []EnvVar{{Name: "DB_PASSWORD", SecretRef: &SecretRef{Name: "db", Key: "5,4,latest"}}}},
+		},
+		{
+			name:      "Kubernetes key on an env var",
+			container: Container{EnvironmentVars: []EnvVar{{Name: "DB_PASSWORD", SecretRef: &SecretRef{Name: "db", Key: "password"}}}},
+			wantErr:   true,
+		},
+		{
+			name:      "latest on a volume item",
+			container: Container{SecretFiles: []SecretFile{{Path: "/secrets/db", SecretRef: &SecretRef{Name: "db", Key: "latest"}}}},
+		},
+		{
+			name:      "version number on a volume item",
+			container: Container{SecretFiles: []SecretFile{{Path: "/secrets/db", SecretRef: &SecretRef{Name: "db", Key: "3"}}}},
+		},
+		{
+			name:      "Kubernetes key on a volume item",
+			container: Container{SecretFiles: []SecretFile{{Path: "/secrets/db", SecretRef: &SecretRef{Name: "db", Key: "password"}}}},
+			wantErr:   true,
+		},
+		{
+			name:      "version zero",
+			container: Container{EnvironmentVars: []EnvVar{{Name: "DB_PASSWORD", SecretRef: &SecretRef{Name: "db", Key: "0"}}}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.container.Name = "app"
+			err := checkSecretVersions(&Config{Containers: []Container{tt.container}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSecretVersions() = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
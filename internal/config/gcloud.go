@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GcloudConfigDir returns the gcloud configuration directory
+func GcloudConfigDir() (string, error) {
+	// gcloud stores credentials in ~/.config/gcloud/ on all platforms
+	// Respect CLOUDSDK_CONFIG if set, otherwise use ~/.config/gcloud
+	configDir := os.Getenv("CLOUDSDK_CONFIG")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("get user home directory: %w", err)
+		}
+		configDir = filepath.Join(home, ".config", "gcloud")
+	}
+	return configDir, nil
+}
+
+// GcloudActiveProject returns the project set in the active gcloud configuration
+// and the name of that configuration
+func GcloudActiveProject() (string, string, error) {
+	// Environment overrides take precedence, same as for gcloud itself
+	if project := os.Getenv("CLOUDSDK_CORE_PROJECT"); project != "" {
+		return project, "CLOUDSDK_CORE_PROJECT", nil
+	}
+
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+
+	name, err := gcloudActiveConfigName(configDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := filepath.Join(configDir, "configurations", "config_"+name)
+	project, err := readINIValue(path, "core", "project")
+	if err != nil {
+		return "", "", fmt.Errorf("read gcloud configuration %s: %w", name, err)
+	}
+	if project == "" {
+		return "", "", fmt.Errorf("no project set in gcloud configuration %s", name)
+	}
+
+	return project, name, nil
+}
+
+// gcloudActiveConfigName returns the name of the active gcloud configuration
+func gcloudActiveConfigName(configDir string) (string, error) {
+	if name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME"); name != "" {
+		return name, nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(configDir, "active_config"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "default", nil
+		}
+		return "", fmt.Errorf("read active gcloud configuration: %w", err)
+	}
+
+	name := strings.TrimSpace(string(b))
+	if name == "" {
+		return "default", nil
+	}
+	return name, nil
+}
+
+// readINIValue reads a single key from a section of an INI file
+func readINIValue(path, section, key string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	currentSection := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			currentSection = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if currentSection != section {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v), nil
+		}
+	}
+
+	return "", scanner.Err()
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gitScheme prefixes config locations in a Git repository,
+// e.g. git+https://github.com/org/repo//path/service.yaml@ref
+const gitScheme = "git+"
+
+// gitLocation is a file at a ref of a Git repository
+type gitLocation struct {
+	Repository string
+	Path       string
+	Ref        string
+}
+
+// isGitLocation reports whether the config location refers to a Git repository
+func isGitLocation(location string) bool {
+	return strings.HasPrefix(location, gitScheme)
+}
+
+// parseGitLocation parses a location in the git+URL//path[@ref] form. The ref defaults to HEAD.
+func parseGitLocation(location string) (*gitLocation, error) {
+	scheme, rest, ok := strings.Cut(strings.TrimPrefix(location, gitScheme), "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid git location %s, expected git+SCHEME://HOST/REPO//PATH@REF", location)
+	}
+
+	repository, filePath, ok := strings.Cut(rest, "//")
+	if !ok || repository == "" || filePath == "" {
+		return nil, fmt.Errorf("invalid git location %s, separate the repository and the file path with //", location)
+	}
+
+	ref := "HEAD"
+	if i := strings.LastIndex(filePath, "@"); i >= 0 {
+		filePath, ref = filePath[:i], filePath[i+1:]
+		if ref == "" {
+			return nil, fmt.Errorf("invalid git location %s, empty ref", location)
+		}
+	}
+
+	// git would take either as an option, such as --upload-pack running a command
+	if strings.HasPrefix(scheme, "-") {
+		return nil, fmt.Errorf("invalid git location %s, the repository can't start with -", location)
+	}
+	if strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("invalid git location %s, the ref can't start with -", location)
+	}
+
+	return &gitLocation{
+		Repository: scheme + "://" + repository,
+		Path:       filePath,
+		Ref:        ref,
+	}, nil
+}
+
+// readConfig reads the config from a local file, a git+ location or stdin for -
+func readConfig(ctx context.Context, location string) ([]byte, error) {
+	if location == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read config from stdin: %w", err)
+		}
+		return data, nil
+	}
+
+	if isGitLocation(location) {
+		data, err := readGitFile(ctx, location)
+		if err != nil {
+			return nil, fmt.Errorf("read config from git: %w", err)
+		}
+		return data, nil
+	}
+
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	return data, nil
+}
+
+// readGitFile fetches the file at the ref with a shallow fetch into a temporary repository,
+// which is removed afterwards so nothing is cached
+func readGitFile(ctx context.Context, location string) ([]byte, error) {
+	loc, err := parseGitLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "cloudrun-local-git-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	if _, err := git(ctx, dir, "init", "--quiet"); err != nil {
+		return nil, err
+	}
+
+	if _, err := git(ctx, dir, "fetch", "--quiet", "--depth=1", "--no-tags", loc.Repository, loc.Ref); err != nil {
+		switch {
+		case isGitAuthError(err):
+			return nil, fmt.Errorf("authenticate to %s, check your git credentials and that the repository exists: %w", loc.Repository, err)
+		case isGitRefError(err):
+			return nil, fmt.Errorf("ref %s not found in %s: %w", loc.Ref, loc.Repository, err)
+		default:
+			return nil, fmt.Errorf("fetch %s from %s: %w", loc.Ref, loc.Repository, err)
+		}
+	}
+
+	data, err := git(ctx, dir, "show", "FETCH_HEAD:"+loc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("file %s not found at %s: %w", loc.Path, loc.Ref, err)
+	}
+
+	return data, nil
+}
+
+// git runs a git command in dir and returns its stdout, or its stderr as the error
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Fail instead of waiting for credentials that can't be typed in
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, errors.New("git is required for git+ config locations, but it's not installed")
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, errors.New(message)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// isGitAuthError reports whether git failed because the credentials were missing or rejected
+func isGitAuthError(err error) bool {
+	message := err.Error()
+	for _, s := range []string{
+		"Authentication failed",
+		"could not read Username",
+		"Permission denied",
+		"terminal prompts disabled",
+	} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGitRefError reports whether git failed because the ref doesn't exist in the repository
+func isGitRefError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "couldn't find remote ref") || strings.Contains(message, "not our ref")
+}
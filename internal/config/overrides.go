@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// Overrides are the overrides of a job execution, in the format of the Cloud Run Admin API,
+// e.g. set with gcloud run jobs execute --update-env-vars, --args or --tasks
+type Overrides struct {
+	ContainerOverrides []struct {
+		Name      string        `json:"name"` // Empty for the first container
+		Args      []string      `json:"args"`
+		ClearArgs bool          `json:"clearArgs"`
+		Env       []rawEnvVarV2 `json:"env"`
+	} `json:"containerOverrides"`
+	TaskCount *int   `json:"taskCount"`
+	Timeout   string `json:"timeout"`
+}
+
+// LoadOverrides reads job execution overrides from a YAML or JSON file
+func LoadOverrides(filename string) (*Overrides, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+
+	// JSON is YAML, so both are converted alike
+	documents, err := splitDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if len(documents) != 1 {
+		return nil, fmt.Errorf("parse %s: expected 1 document, got %d", filename, len(documents))
+	}
+
+	var overrides Overrides
+	if err := json.Unmarshal(documents[0], &overrides); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	return &overrides, nil
+}
+
+// WithOverrides returns a copy of the config with the env overrides of the containers
+// defined after their own variables, so they take precedence, and the first container
+// selected. The timeout of the overrides replaces the config's. Warnings are returned for
+// overrides that don't apply locally.
+func (c *Config) WithOverrides(overrides *Overrides) (*Config, []string, error) {
+	result := *c
+	result.Containers = slices.Clone(c.Containers)
+
+	var warnings []string
+	for j, override := range overrides.ContainerOverrides {
+		if len(result.Containers) == 0 {
+			return nil, nil, errors.New("config has no containers to override")
+		}
+		i := 0
+		if override.Name != "" {
+			var err error
+			if i, err = result.ContainerIndex(override.Name); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		container := &result.Containers[i]
+		container.EnvironmentVars = append(slices.Clone(container.EnvironmentVars), parseEnvVarsV2(override.Env, fmt.Sprintf("containerOverrides[%d].env", j))...)
+		if len(override.Args) > 0 || override.ClearArgs {
+			warnings = append(warnings, fmt.Sprintf("args of container %s are ignored, the command is given on the command line", container.Name))
+		}
+	}
+	if overrides.TaskCount != nil {
+		warnings = append(warnings, "taskCount is ignored, the job runs as a single local command")
+	}
+	if overrides.Timeout != "" {
+		// Replaces the task timeout of the job, like timeoutSeconds of the config
+		timeout, err := time.ParseDuration(overrides.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, nil, fmt.Errorf("timeout: invalid duration %q, expected e.g. 300s", overrides.Timeout)
+		}
+		result.Timeout = timeout
+	}
+
+	if err := checkSecretVersions(&result); err != nil {
+		return nil, nil, err
+	}
+	return result.withFirstContainer(), warnings, nil
+}
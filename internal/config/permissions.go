@@ -0,0 +1,62 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Permission is an IAM permission the service expects its service account to have, on the
+// resource it's tested against. An empty resource leaves the choice to the caller.
+type Permission struct {
+	Permission string `json:"permission"`
+	Resource   string `json:"resource"`
+}
+
+// UnmarshalJSON accepts a permission without resource as a plain string
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*p = Permission{Permission: name}
+		return nil
+	}
+
+	type plain Permission
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	if p.Permission == "" {
+		return errors.New("permission entry without permission")
+	}
+	return nil
+}
+
+// LoadPermissions reads the permissions the service expects from a YAML or JSON file with a
+// list of permissions, each a name or a permission with a resource
+func LoadPermissions(filename string) ([]Permission, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+
+	// JSON is YAML, so both are converted alike
+	documents, err := splitDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if len(documents) != 1 {
+		return nil, fmt.Errorf("parse %s: expected 1 document, got %d", filename, len(documents))
+	}
+
+	var file struct {
+		Permissions []Permission `json:"permissions"`
+	}
+	if err := json.Unmarshal(documents[0], &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	if len(file.Permissions) == 0 {
+		return nil, fmt.Errorf("parse %s: no permissions listed", filename)
+	}
+	return file.Permissions, nil
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// serviceLabel is the label of a Revision naming the Service it belongs to
+const serviceLabel = "serving.knative.dev/service"
+
+// revisionNames returns the name of the revision template of a Service document, empty if
+// the template isn't named, and the revisions its traffic split refers to
+func revisionNames(jsonData []byte) (template string, traffic []string) {
+	if isV2(jsonData) {
+		var raw struct {
+			Template struct {
+				Revision string `json:"revision"`
+			} `json:"template"`
+			Traffic []struct {
+				Revision string `json:"revision"`
+			} `json:"traffic"`
+		}
+		if err := json.Unmarshal(jsonData, &raw); err != nil {
+			return "", nil
+		}
+		for _, target := range raw.Traffic {
+			if target.Revision != "" {
+				traffic = append(traffic, target.Revision)
+			}
+		}
+		return raw.Template.Revision, traffic
+	}
+
+	var raw struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+			} `json:"template"`
+			Traffic []struct {
+				RevisionName string `json:"revisionName"`
+			} `json:"traffic"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return "", nil
+	}
+	for _, target := range raw.Spec.Traffic {
+		if target.RevisionName != "" {
+			traffic = append(traffic, target.RevisionName)
+		}
+	}
+	return raw.Spec.Template.Metadata.Name, traffic
+}
+
+// identifyRevision returns the name of a Revision document and of its Service,
+// or an empty name if the document isn't a Revision
+func identifyRevision(jsonData []byte) (name, service string) {
+	var header struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(jsonData, &header); err != nil || header.Kind != "Revision" {
+		return "", ""
+	}
+	return header.Metadata.Name, header.Metadata.Labels[serviceLabel]
+}
+
+// selectRevision picks the document with the revision template named by the selector: a
+// Service whose template has that name, or a Revision of that name
+func selectRevision(documents [][]byte, selector Selector) ([]byte, error) {
+	if selector.Kind == "Job" {
+		return nil, fmt.Errorf("revision templates only exist for Services, not Jobs")
+	}
+
+	var (
+		candidates [][]byte
+		available  []string
+		traffic    []string
+	)
+	for _, document := range documents {
+		if name, service := identifyRevision(document); name != "" {
+			if selector.Name != "" && service != selector.Name {
+				continue
+			}
+			available = append(available, name)
+			if name == selector.Revision {
+				candidates = append(candidates, document)
+			}
+			continue
+		}
+
+		kind, name := identify(document)
+		if kind != "Service" || (selector.Name != "" && name != selector.Name) {
+			continue
+		}
+		template, targets := revisionNames(document)
+		traffic = append(traffic, targets...)
+		if template == "" {
+			continue
+		}
+		available = append(available, template)
+		if template == selector.Revision {
+			candidates = append(candidates, document)
+		}
+	}
+
+	switch len(candidates) {
+	case 1:
+		return candidates[0], nil
+	case 0:
+		message := fmt.Sprintf("no revision template named %s in config", selector.Revision)
+		if len(available) > 0 {
+			message += ", available: " + strings.Join(available, ", ")
+		}
+		if slices.Contains(traffic, selector.Revision) {
+			message += "; the traffic split refers to it, but its template isn't part of the config"
+		}
+		return nil, fmt.Errorf("%s", message)
+	default:
+		return nil, fmt.Errorf("found %d revision templates named %s in config, select one with --name", len(candidates), selector.Revision)
+	}
+}
+
+// parseRevision parses a Knative Revision, whose spec is the revision template's spec
+func parseRevision(jsonData []byte) (*Config, error) {
+	var raw struct {
+		Metadata rawMetadata `json:"metadata"`
+		Spec     struct {
+			ServiceAccountName string         `json:"serviceAccountName"`
+			TimeoutSeconds     int            `json:"timeoutSeconds"`
+			Containers         []rawContainer `json:"containers"`
+			Volumes            []rawVolume    `json:"volumes"`
+		} `json:"spec"`
+	}
+
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal revision json: %w", err)
+	}
+
+	containers, warnings := parseContainers(raw.Spec.Containers, raw.Spec.Volumes, "spec.containers[%d].env")
+
+	serviceAccount := raw.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = raw.Metadata.Annotations[serviceAccountAnnotation]
+	}
+	if serviceAccount == "" {
+		return nil, fmt.Errorf("serviceAccountName not found in config")
+	}
+
+	projectID, err := extractProjectID(serviceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("extract project ID: %w", err)
+	}
+
+	// K_SERVICE is the name of the Service the revision belongs to
+	serviceName := raw.Metadata.Labels[serviceLabel]
+	if serviceName == "" {
+		serviceName = raw.Metadata.Name
+	}
+
+	cfg := &Config{
+		Kind:           "Service",
+		ServiceName:    serviceName,
+		ServiceAccount: serviceAccount,
+		ProjectID:      projectID,
+		Region:         raw.Metadata.region(),
+		Timeout:        time.Duration(raw.Spec.TimeoutSeconds) * time.Second,
+		Containers:     containers,
+		Warnings:       warnings,
+	}
+	return cfg.withFirstContainer(), nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// rawSimple is a minimal config of just a service account and variables, for quick
+// experiments without a Service or Job manifest
+type rawSimple struct {
+	Name               string      `json:"name"`
+	ServiceAccountName string      `json:"serviceAccountName"`
+	Env                []rawEnvVar `json:"env"`
+}
+
+// isSimple reports whether the config is a minimal config, which has no kind and no
+// spec or template, but a top-level env
+func isSimple(jsonData []byte) bool {
+	var check struct {
+		Kind     string          `json:"kind"`
+		Spec     json.RawMessage `json:"spec"`
+		Template json.RawMessage `json:"template"`
+		Env      json.RawMessage `json:"env"`
+	}
+	if err := json.Unmarshal(jsonData, &check); err != nil {
+		return false
+	}
+	return check.Kind == "" && check.Spec == nil && check.Template == nil && check.Env != nil
+}
+
+// parseSimple parses a minimal config into a service with a single container, whose
+// variables are written as in the env of a Service's container
+func parseSimple(jsonData []byte) (*Config, error) {
+	var raw rawSimple
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal simple config json: %w", err)
+	}
+
+	if raw.ServiceAccountName == "" {
+		return nil, fmt.Errorf("serviceAccountName not found in config")
+	}
+	projectID, err := extractProjectID(raw.ServiceAccountName)
+	if err != nil {
+		return nil, fmt.Errorf("extract project ID: %w", err)
+	}
+
+	envVars, warnings := parseEnvVars(raw.Env, "env")
+	cfg := &Config{
+		Kind:           "Service",
+		ServiceName:    raw.Name,
+		ServiceAccount: raw.ServiceAccountName,
+		ProjectID:      projectID,
+		Containers: []Container{{
+			Name:            containerName("", 0),
+			EnvironmentVars: envVars,
+			EnvPath:         "env",
+		}},
+		Warnings: warnings,
+	}
+	return cfg.withFirstContainer(), nil
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// rawTemplateV2 is a revision template of a v2 Service, or the task template of a v2 Job
+type rawTemplateV2 struct {
+	ServiceAccount string           `json:"serviceAccount"`
+	Timeout        string           `json:"timeout"` // Duration, e.g. 300s
+	Containers     []rawContainerV2 `json:"containers"`
+	Volumes        []rawVolumeV2    `json:"volumes"`
+}
+
+// rawContainerV2 is a container definition as it appears in a v2 template
+type rawContainerV2 struct {
+	Name         string           `json:"name"`
+	Image        string           `json:"image"`
+	WorkingDir   string           `json:"workingDir"`
+	Env          []rawEnvVarV2    `json:"env"`
+	VolumeMounts []rawVolumeMount `json:"volumeMounts"`
+}
+
+// rawEnvVarV2 is a container environment variable as it appears in a v2 config
+type rawEnvVarV2 struct {
+	Name        string       `json:"name"`
+	Value       scalarString `json:"value"`
+	ValueSource struct {
+		SecretKeyRef struct {
+			Secret  string       `json:"secret"`
+			Version scalarString `json:"version"`
+		} `json:"secretKeyRef"`
+	} `json:"valueSource"`
+}
+
+// isV2 reports whether the config is a Cloud Run Admin API v2 resource, which has no kind
+// and a top-level template instead of a spec
+func isV2(jsonData []byte) bool {
+	var check struct {
+		Kind     string          `json:"kind"`
+		Template json.RawMessage `json:"template"`
+	}
+	if err := json.Unmarshal(jsonData, &check); err != nil {
+		return false
+	}
+	return check.Kind == "" && check.Template != nil
+}
+
+// identifyV2 returns the kind and name of a v2 resource
+func identifyV2(jsonData []byte) (kind, name string) {
+	var header struct {
+		Name     string `json:"name"`
+		Template struct {
+			Template json.RawMessage `json:"template"`
+		} `json:"template"`
+	}
+	if err := json.Unmarshal(jsonData, &header); err != nil {
+		return "", ""
+	}
+
+	kind = "Service"
+	if header.Template.Template != nil {
+		kind = "Job"
+	}
+	return kind, path.Base(header.Name)
+}
+
+// parseV2 parses a Cloud Run Admin API v2 Service or Job
+func parseV2(jsonData []byte) (*Config, error) {
+	var raw struct {
+		Name     string `json:"name"`
+		Template struct {
+			rawTemplateV2
+			// Only set for Jobs, whose execution template wraps the task template
+			Template *rawTemplateV2 `json:"template"`
+		} `json:"template"`
+	}
+
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal v2 json: %w", err)
+	}
+
+	kind, template, templatePath := "Service", raw.Template.rawTemplateV2, "template"
+	if raw.Template.Template != nil {
+		kind, template, templatePath = "Job", *raw.Template.Template, "template.template"
+	}
+
+	if template.ServiceAccount == "" {
+		return nil, fmt.Errorf("serviceAccount not found in config")
+	}
+
+	projectID, err := extractProjectID(template.ServiceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("extract project ID: %w", err)
+	}
+
+	var timeout time.Duration
+	if template.Timeout != "" {
+		if timeout, err = time.ParseDuration(template.Timeout); err != nil {
+			return nil, fmt.Errorf("%s.timeout: %w", templatePath, err)
+		}
+	}
+
+	var (
+		containers = make([]Container, 0, len(template.Containers))
+		volumes    = secretVolumesV2(template.Volumes)
+		warnings   []string
+	)
+	for i, container := range template.Containers {
+		envPath := fmt.Sprintf("%s.containers[%d].env", templatePath, i)
+		name := containerName(container.Name, i)
+		files, fileWarnings := secretFiles(volumes, container.VolumeMounts, name)
+		warnings = append(warnings, fileWarnings...)
+
+		containers = append(containers, Container{
+			Name:            name,
+			Image:           container.Image,
+			WorkingDir:      container.WorkingDir,
+			EnvironmentVars: parseEnvVarsV2(container.Env, envPath),
+			EnvPath:         envPath,
+			SecretFiles:     files,
+		})
+	}
+
+	cfg := &Config{
+		Kind: kind,
+		// The name is the full resource name, e.g. projects/p/locations/l/services/name
+		ServiceName:    path.Base(raw.Name),
+		ServiceAccount: template.ServiceAccount,
+		ProjectID:      projectID,
+		Region:         regionFromName(raw.Name),
+		Timeout:        timeout,
+		Containers:     containers,
+		Warnings:       warnings,
+	}
+	return cfg.withFirstContainer(), nil
+}
+
+// parseEnvVarsV2 parses environment variables from a v2 container env array at envPath
+func parseEnvVarsV2(envArray []rawEnvVarV2, envPath string) []EnvVar {
+	envVars := make([]EnvVar, 0, len(envArray))
+	for i, env := range envArray {
+		envVar := EnvVar{Name: env.Name, Path: fmt.Sprintf("%s[%d]", envPath, i)}
+
+		if secretKeyRef := env.ValueSource.SecretKeyRef; secretKeyRef.Secret != "" {
+			envVar.SecretRef = parseSecretV2(secretKeyRef.Secret, string(secretKeyRef.Version))
+		} else if secretKeyRef.Version != "" {
+			envVar.Incomplete = "secretKeyRef has no secret"
+		} else {
+			envVar.Value = string(env.Value)
+		}
+
+		envVars = append(envVars, envVar)
+	}
+	return envVars
+}
+
+// parseSecretV2 creates a secret reference from a v2 secret, which is either a short
+// name or a full path such as projects/p/secrets/name
+func parseSecretV2(secret, version string) *SecretRef {
+	if version == "" {
+		version = "latest"
+	}
+
+	ref := &SecretRef{Name: secret, Key: version}
+	if parts := strings.Split(secret, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets" {
+		ref.Project = parts[1]
+		ref.Name = parts[3]
+	}
+	return ref
+}
+
+// regionFromName returns the location of a full resource name, e.g. projects/p/locations/l/services/name,
+// empty if the name has none
+func regionFromName(name string) string {
+	parts := strings.Split(name, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "locations" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SecretFile is a file of a secret volume mounted into a container
+type SecretFile struct {
+	Path      string // Absolute path of the file in the container, e.g. /secrets/db/password
+	SecretRef *SecretRef
+}
+
+// rawVolume is a volume of a template. Only secret volumes are read, other volumes
+// don't hold anything that can be resolved locally.
+type rawVolume struct {
+	Name   string `json:"name"`
+	Secret *struct {
+		SecretName string `json:"secretName"`
+		Items      []struct {
+			Key  scalarString `json:"key"`
+			Path string       `json:"path"`
+		} `json:"items"`
+	} `json:"secret"`
+}
+
+// rawVolumeV2 is a volume of a v2 template
+type rawVolumeV2 struct {
+	Name   string `json:"name"`
+	Secret *struct {
+		Secret string `json:"secret"`
+		Items  []struct {
+			Version scalarString `json:"version"`
+			Path    string       `json:"path"`
+		} `json:"items"`
+	} `json:"secret"`
+}
+
+// rawVolumeMount is a volume mounted into a container, the same in both formats
+type rawVolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+// secretVolumeItem is a version of a secret exposed as a file relative to the mount path
+type secretVolumeItem struct {
+	SecretRef *SecretRef
+	Path      string
+}
+
+// secretVolumes returns the files of each secret volume by volume name. A secret volume
+// without items exposes its latest version in a file named after the secret.
+func secretVolumes(volumes []rawVolume) map[string][]secretVolumeItem {
+	result := make(map[string][]secretVolumeItem)
+	for _, volume := range volumes {
+		if volume.Secret == nil || volume.Secret.SecretName == "" {
+			continue
+		}
+		secretName := volume.Secret.SecretName
+		if len(volume.Secret.Items) == 0 {
+			result[volume.Name] = []secretVolumeItem{{SecretRef: &SecretRef{Name: secretName, Key: "latest"}, Path: path.Base(secretName)}}
+			continue
+		}
+		for _, item := range volume.Secret.Items {
+			version := string(item.Key)
+			if version == "" {
+				version = "latest"
+			}
+			result[volume.Name] = append(result[volume.Name], secretVolumeItem{
+				SecretRef: &SecretRef{Name: secretName, Key: version},
+				Path:      item.Path,
+			})
+		}
+	}
+	return result
+}
+
+// secretVolumesV2 returns the files of each secret volume of a v2 template by volume name
+func secretVolumesV2(volumes []rawVolumeV2) map[string][]secretVolumeItem {
+	result := make(map[string][]secretVolumeItem)
+	for _, volume := range volumes {
+		if volume.Secret == nil || volume.Secret.Secret == "" {
+			continue
+		}
+		secret := volume.Secret.Secret
+		if len(volume.Secret.Items) == 0 {
+			ref := parseSecretV2(secret, "")
+			result[volume.Name] = []secretVolumeItem{{SecretRef: ref, Path: ref.Name}}
+			continue
+		}
+		for _, item := range volume.Secret.Items {
+			result[volume.Name] = append(result[volume.Name], secretVolumeItem{
+				SecretRef: parseSecretV2(secret, string(item.Version)),
+				Path:      item.Path,
+			})
+		}
+	}
+	return result
+}
+
+// secretFiles returns the files of the secret volumes mounted by a container.
+// Warnings are returned for files that would end up outside of their mount path.
+func secretFiles(volumes map[string][]secretVolumeItem, mounts []rawVolumeMount, container string) ([]SecretFile, []string) {
+	var (
+		files    []SecretFile
+		warnings []string
+	)
+	for _, mount := range mounts {
+		for _, item := range volumes[mount.Name] {
+			if !path.IsAbs(mount.MountPath) || path.IsAbs(item.Path) || !pathIsLocal(item.Path) {
+				warnings = append(warnings, fmt.Sprintf("container %s: secret volume %s has an invalid path %s under %s, skipping", container, mount.Name, item.Path, mount.MountPath))
+				continue
+			}
+			files = append(files, SecretFile{
+				Path:      path.Join(mount.MountPath, item.Path),
+				SecretRef: item.SecretRef,
+			})
+		}
+	}
+	return files, warnings
+}
+
+// pathIsLocal reports whether a relative slash-separated path names a file within its
+// directory. Backslashes and NUL are refused, as they'd separate or end the path elsewhere.
+func pathIsLocal(p string) bool {
+	if strings.ContainsAny(p, "\\\x00") {
+		return false
+	}
+	cleaned := path.Clean(p)
+	return cleaned != "." && cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
@@ -2,75 +2,1113 @@ package env
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ngalaiko/cloudrun-local/internal/auth"
 	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/lockfile"
 	"github.com/ngalaiko/cloudrun-local/internal/secrets"
+
+	"golang.org/x/oauth2"
 )
 
+// Source describes where the value of a resolved variable comes from
+type Source string
+
+// Sources of resolved variables
+const (
+	SourceMetadata Source = "metadata"
+	SourceConfig   Source = "config"
+	SourceSecret   Source = "secret"
+	SourceImage    Source = "image"
+	SourceFile     Source = "file"
+	// SourceSecretFile is a variable set to the path of a file holding a secret
+	SourceSecretFile Source = "secret-file"
+)
+
+// ResolvedVar is a resolved environment variable
+type ResolvedVar struct {
+	Name   string
+	Value  string
+	Source Source
+}
+
+// String returns the variable in KEY=value form
+func (v ResolvedVar) String() string {
+	return v.Name + "=" + v.Value
+}
+
+// Strings returns the variables in KEY=value form
+func Strings(vars []ResolvedVar) []string {
+	result := make([]string, 0, len(vars))
+	for _, v := range vars {
+		result = append(result, v.String())
+	}
+	return result
+}
+
+// SecretError is the error of accessing or expanding a secret
+type SecretError struct {
+	Op     string // access or expand
+	Secret string
+	Err    error
+}
+
+func (e *SecretError) Error() string {
+	return fmt.Sprintf("%s secret %s: %v", e.Op, e.Secret, e.Err)
+}
+
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+// Options configures how the resolver fetches secrets
+type Options struct {
+	// Lockfile pins "latest" secret references to concrete versions, if set
+	Lockfile *lockfile.Lockfile
+	// UpdateLock re-resolves "latest" references and refreshes the pins
+	UpdateLock bool
+	// MaxConcurrentSecrets limits how many secrets are fetched at once
+	MaxConcurrentSecrets int
+	// SecretMaps are secrets holding flat JSON objects expanded into one variable per key
+	SecretMaps []SecretMap
+	// HTTPClient is used for all API calls, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// SecretTransport is how Secret Manager is accessed, secrets.TransportREST if empty
+	SecretTransport string
+	// QuotaProject is billed for the quota of secret access over gRPC, HTTPClient bills the
+	// other requests
+	QuotaProject string
+	// Revision is exposed as K_REVISION, DefaultRevision if empty
+	Revision string
+	// LatestAs is the version fetched for every "latest" reference instead, if set
+	LatestAs string
+	// NoCredsFile skips creating the credentials file, leaving out GOOGLE_APPLICATION_CREDENTIALS
+	NoCredsFile bool
+	// EmitServiceVars sets K_SERVICE, K_CONFIGURATION and K_REVISION for jobs too, which
+	// have none of them in Cloud Run
+	EmitServiceVars bool
+	// Session keeps the credentials file and access token in the named session for later
+	// runs to reuse, if set
+	Session string
+	// Only restricts resolution to the named variables, if set. Secrets of other
+	// variables aren't fetched.
+	Only []string
+	// PrefixFilter restricts resolution to the variables whose name starts with it, if set.
+	// Automatic variables are kept, secrets of other variables aren't fetched.
+	PrefixFilter string
+	// FileVars are variables read from local files, overriding the config's
+	FileVars []ResolvedVar
+	// ContainerEnvOnly leaves out the automatic variables. If no secret is fetched either,
+	// the service account isn't impersonated.
+	ContainerEnvOnly bool
+	// MetadataVars are additional automatic variables, set next to the built-in ones
+	MetadataVars []ResolvedVar
+	// LazySecrets leaves the variables of the config referencing secrets out of Resolve, for
+	// them to be fetched on demand with ResolveOne. Secret maps are still resolved.
+	LazySecrets bool
+	// SecretRefs sets the variables of the config referencing secrets to their reference,
+	// sm://projects/p/secrets/name/versions/v, instead of fetching them. Values referencing
+	// the secrets of a provider are kept as they are.
+	SecretRefs bool
+	// Providers fetch the secrets that values of the config reference with a URL of their
+	// scheme, such as vault://path#field, by scheme. Values with SecretManagerScheme are
+	// always fetched from Secret Manager, other values are used as they are.
+	Providers map[string]SecretProvider
+	// SecretFileVars are secrets written to files of a temporary directory by Resolve, with a
+	// variable set to the path of each. The directory is removed by Cleanup.
+	SecretFileVars []SecretFileVar
+}
+
+// SecretProvider fetches secrets of a backend other than Secret Manager, which variables
+// reference in their value
+type SecretProvider interface {
+	Access(ctx context.Context, reference string) (string, error)
+}
+
+// SecretFileVar is a secret written to a file, with a variable set to its path, for clients
+// reading secrets such as TLS certificates from disk
+type SecretFileVar struct {
+	Name string            // Of the variable set to the path
+	File config.SecretFile // Path is relative to the temporary directory
+	// Reference is the URL of a provider's secret, such as gcs://bucket/object, written to
+	// the file instead of File.SecretRef if set
+	Reference string
+}
+
+// SecretMap references a secret whose value is a flat JSON object of variables,
+// similar to Kubernetes envFrom.secretRef
+type SecretMap struct {
+	SecretRef config.SecretRef
+	Prefix    string // Prepended to every key of the object
+}
+
+// DefaultRevision is the revision name used when none is configured
+const DefaultRevision = "local"
+
+// DefaultMaxConcurrentSecrets is the secret fetch parallelism used when none is configured
+const DefaultMaxConcurrentSecrets = 8
+
 // Resolver resolves environment variables from a Cloud Run config
 type Resolver struct {
-	config *config.Config
-	creds  *auth.Credentials
+	config  *config.Config
+	creds   *auth.Credentials
+	secrets *secrets.Client
+	opts    Options
+
+	lockMu    sync.Mutex        // guards opts.Lockfile, latest, versions and fallbacks between concurrent fetches
+	latest    map[string]string // Versions latest references resolved to, by secret
+	versions  map[string]string // Versions all references resolved to, by secret@key
+	fallbacks []Fallback        // References resolved to another than their first version
+
+	filesDir string // Temporary directory of the SecretFileVars, empty until written
 }
 
 // NewResolver creates a new environment resolver
-func NewResolver(ctx context.Context, cfg *config.Config) (*Resolver, error) {
-	creds, err := auth.GetImpersonatedCredentials(ctx, cfg.ServiceAccount)
+func NewResolver(ctx context.Context, cfg *config.Config, opts Options) (*Resolver, error) {
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	// Nothing needs a token, so the config resolves offline
+	if (opts.ContainerEnvOnly || opts.LazySecrets || opts.SecretRefs) && !FetchesSecrets(cfg, opts) {
+		return &Resolver{
+			config:  cfg,
+			creds:   &auth.Credentials{},
+			secrets: secrets.NewClient(httpClient, "", cfg.ProjectID),
+			opts:    opts,
+		}, nil
+	}
+
+	getCredentials := auth.GetImpersonatedCredentials
+	switch {
+	case opts.Session != "":
+		getCredentials = func(ctx context.Context, httpClient *http.Client, serviceAccountEmail string) (*auth.Credentials, error) {
+			return auth.GetSessionCredentials(ctx, httpClient, serviceAccountEmail, opts.Session, !opts.NoCredsFile)
+		}
+	case opts.NoCredsFile:
+		getCredentials = auth.GetImpersonatedToken
+	}
+	creds, err := getCredentials(ctx, httpClient, cfg.ServiceAccount)
 	if err != nil {
 		return nil, fmt.Errorf("get impersonated credentials: %w", err)
 	}
 
+	client := secrets.NewClient(httpClient, creds.AccessToken, cfg.ProjectID)
+	if opts.SecretTransport == secrets.TransportGRPC {
+		// The token already minted is reused until it expires, then a new one is impersonated
+		tokens := oauth2.ReuseTokenSource(
+			&oauth2.Token{AccessToken: creds.AccessToken, Expiry: creds.Expiry},
+			auth.NewTokenSource(context.WithoutCancel(ctx), httpClient, cfg.ServiceAccount, auth.SecretManagerScope),
+		)
+		client, err = secrets.NewGRPCClient(ctx, tokens, cfg.ProjectID, opts.QuotaProject)
+		if err != nil {
+			return nil, errors.Join(err, creds.Cleanup())
+		}
+	}
+
 	return &Resolver{
-		config: cfg,
-		creds:  creds,
+		config:  cfg,
+		creds:   creds,
+		secrets: client,
+		opts:    opts,
 	}, nil
 }
 
-// Resolve returns all environment variables as KEY=value strings
-func (r *Resolver) Resolve(ctx context.Context) ([]string, error) {
-	result := make([]string, 0, len(r.config.EnvironmentVars)+10)
+// TokenExpiry returns when the access token reading secrets expires
+func (r *Resolver) TokenExpiry() time.Time {
+	return r.creds.Expiry
+}
+
+// Identity returns the email of the identity the access token reading secrets belongs to,
+// empty if the service account wasn't impersonated as nothing needs a token
+func (r *Resolver) Identity(ctx context.Context) (string, error) {
+	if r.creds.AccessToken == "" {
+		return "", nil
+	}
+	httpClient := r.opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return auth.TokenIdentity(ctx, httpClient, r.creds.AccessToken)
+}
+
+// ErrNotDeclared is returned by ResolveOne for a variable that is neither declared in the
+// config, nor expanded from a secret map, nor an automatic variable
+var ErrNotDeclared = errors.New("variable is not declared")
 
-	// Add Cloud Run metadata environment variables
-	if r.config.ServiceName != "" {
-		result = append(result, "K_SERVICE="+r.config.ServiceName)
+// Resolve returns all environment variables in the order they are defined
+func (r *Resolver) Resolve(ctx context.Context) ([]ResolvedVar, error) {
+	result := make([]ResolvedVar, 0, len(r.config.EnvironmentVars)+10)
+	err := r.resolve(ctx, false, func(v ResolvedVar) error {
+		result = append(result, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	result = append(result, "K_REVISION=local")
-	result = append(result, "GOOGLE_CLOUD_PROJECT="+r.config.ProjectID)
-	result = append(result, "GOOGLE_APPLICATION_CREDENTIALS="+r.creds.CredsFile)
+	return result, nil
+}
 
-	// Resolve user-defined environment variables
-	secretsClient := secrets.NewClient(r.creds.AccessToken, r.config.ProjectID)
+// Stream resolves the environment variables like Resolve, passing each one to emit as soon
+// as it's resolved, in the same order, instead of waiting for every secret. If resolution
+// fails, the variables before the failed one have been emitted already. An error returned
+// by emit stops resolution and is returned as is.
+func (r *Resolver) Stream(ctx context.Context, emit func(ResolvedVar) error) error {
+	return r.resolve(ctx, true, emit)
+}
 
+// Declared returns the variables Stream emits, in the same order, without their values.
+// Variables expanded from secret maps are only known once the maps are fetched, so they
+// aren't included.
+func (r *Resolver) Declared() []ResolvedVar {
+	var result []ResolvedVar
+	for _, v := range r.metadataVars() {
+		if r.named(v.Name) {
+			result = append(result, ResolvedVar{Name: v.Name, Source: v.Source})
+		}
+	}
 	for _, envVar := range r.config.EnvironmentVars {
-		if envVar.Value != "" {
-			// Simple value
-			result = append(result, envVar.Name+"="+envVar.Value)
+		if v, ok, _ := r.resolveVar(envVar, func() (string, error) { return "", nil }); ok {
+			result = append(result, ResolvedVar{Name: v.Name, Source: v.Source})
+		}
+	}
+	for _, fileVar := range r.opts.SecretFileVars {
+		if r.wanted(fileVar.Name) && !r.fromFile(fileVar.Name) {
+			result = append(result, ResolvedVar{Name: fileVar.Name, Source: SourceSecretFile})
+		}
+	}
+	for _, v := range r.opts.FileVars {
+		if r.wanted(v.Name) {
+			result = append(result, ResolvedVar{Name: v.Name, Source: v.Source})
+		}
+	}
+	return result
+}
+
+// resolve passes the environment variables to emit in the order they are defined. Secret
+// references are fetched from Secret Manager up front, and unless streaming, waited for
+// before the first variable is emitted.
+func (r *Resolver) resolve(ctx context.Context, stream bool, emit func(ResolvedVar) error) error {
+	fetches := r.startFetches(ctx)
+	defer fetches.stop()
+	if !stream {
+		if err := fetches.wait(); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range r.metadataVars() {
+		if !r.named(v.Name) {
+			continue
+		}
+		if err := emit(v); err != nil {
+			return err
+		}
+	}
+
+	// Variables expanded from secret maps are overridden by ones defined individually
+	for _, secretMap := range r.opts.SecretMaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !r.wantedPrefix(secretMap.Prefix) {
 			continue
 		}
 
-		if envVar.SecretRef != nil {
-			// Secret reference - fetch from Secret Manager
-			secretValue, err := secretsClient.AccessSecretVersion(
-				ctx,
-				envVar.SecretRef.Name,
-				envVar.SecretRef.Key,
-			)
-			if err != nil {
-				return nil, fmt.Errorf("access secret %s: %w", envVar.SecretRef.Name, err)
+		vars, err := r.expandSecretMap(ctx, secretMap)
+		if err != nil {
+			return &SecretError{Op: "expand", Secret: secretMap.SecretRef.Secret(), Err: err}
+		}
+		for _, v := range vars {
+			if !r.wanted(v.Name) {
+				continue
+			}
+			if err := emit(v); err != nil {
+				return err
 			}
-			result = append(result, envVar.Name+"="+secretValue)
 		}
 	}
 
+	// Resolve user-defined environment variables
+	for i, envVar := range r.config.EnvironmentVars {
+		v, ok, err := r.resolveVar(envVar, func() (string, error) { return fetches.value(i) })
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := emit(v); err != nil {
+			return err
+		}
+	}
+
+	fileVars, err := r.writeSecretFiles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range fileVars {
+		if err := emit(v); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range r.opts.FileVars {
+		if !r.wanted(v.Name) {
+			continue
+		}
+		if err := emit(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveVar resolves a user-defined environment variable, calling secretValue for the value
+// of its secret if it's fetched. It reports false if the variable is left out.
+func (r *Resolver) resolveVar(envVar config.EnvVar, secretValue func() (string, error)) (ResolvedVar, bool, error) {
+	if !r.wanted(envVar.Name) {
+		return ResolvedVar{}, false, nil
+	}
+
+	if _, ok := r.provider(envVar.Value); ok {
+		switch {
+		case r.fromFile(envVar.Name):
+			return ResolvedVar{}, false, nil
+		case r.opts.SecretRefs:
+			return ResolvedVar{Name: envVar.Name, Value: envVar.Value, Source: SourceSecret}, true, nil
+		}
+		value, err := secretValue()
+		return ResolvedVar{Name: envVar.Name, Value: value, Source: SourceSecret}, err == nil, err
+	}
+
+	if envVar.Value != "" {
+		// Simple value
+		return ResolvedVar{Name: envVar.Name, Value: envVar.Value, Source: SourceConfig}, true, nil
+	}
+
+	if envVar.SecretRef != nil {
+		switch {
+		case r.fromFile(envVar.Name) || r.opts.LazySecrets:
+			return ResolvedVar{}, false, nil
+		case r.opts.SecretRefs:
+			return ResolvedVar{Name: envVar.Name, Value: r.secretReference(envVar.SecretRef), Source: SourceSecret}, true, nil
+		}
+		value, err := secretValue()
+		return ResolvedVar{Name: envVar.Name, Value: value, Source: SourceSecret}, err == nil, err
+	}
+
+	if envVar.FieldRef != "" {
+		return ResolvedVar{Name: envVar.Name, Value: r.fieldValue(envVar.FieldRef), Source: SourceConfig}, true, nil
+	}
+	return ResolvedVar{}, false, nil
+}
+
+// writeSecretFiles fetches the secrets of the SecretFileVars and writes them to files of a
+// temporary directory, readable only by the current user, returning the variables set to
+// their paths
+func (r *Resolver) writeSecretFiles(ctx context.Context) ([]ResolvedVar, error) {
+	var result []ResolvedVar
+	for _, fileVar := range r.opts.SecretFileVars {
+		if !r.wanted(fileVar.Name) || r.fromFile(fileVar.Name) {
+			continue
+		}
+
+		value, err := r.accessVar(ctx, config.EnvVar{Name: fileVar.Name, Value: fileVar.Reference, SecretRef: fileVar.File.SecretRef})
+		if err != nil {
+			return nil, err
+		}
+
+		if r.filesDir == "" {
+			dir, err := os.MkdirTemp("", "cloudrun-local-files-")
+			if err != nil {
+				return nil, fmt.Errorf("create directory for secret files: %w", err)
+			}
+			r.filesDir = dir
+		}
+		filename := filepath.Join(r.filesDir, filepath.FromSlash(fileVar.File.Path))
+		if err := os.WriteFile(filename, []byte(value), 0o600); err != nil {
+			return nil, fmt.Errorf("write secret file of %s: %w", fileVar.Name, err)
+		}
+		result = append(result, ResolvedVar{Name: fileVar.Name, Value: filename, Source: SourceSecretFile})
+	}
 	return result, nil
 }
 
+// SecretFilesDir returns the temporary directory the SecretFileVars were written to, empty if
+// none was
+func (r *Resolver) SecretFilesDir() string {
+	return r.filesDir
+}
+
+// ResolveOne resolves a single variable, fetching only the secrets it needs. The value is
+// the one Resolve would end up with: a file variable wins over a definition in the config,
+// which wins over a secret map, which wins over an automatic variable.
+func (r *Resolver) ResolveOne(ctx context.Context, name string) (ResolvedVar, error) {
+	for i := len(r.opts.FileVars) - 1; i >= 0; i-- {
+		if r.opts.FileVars[i].Name == name {
+			return r.opts.FileVars[i], nil
+		}
+	}
+
+	for i := len(r.config.EnvironmentVars) - 1; i >= 0; i-- {
+		envVar := r.config.EnvironmentVars[i]
+		if envVar.Name != name {
+			continue
+		}
+
+		_, fromProvider := r.provider(envVar.Value)
+		switch {
+		case fromProvider || (envVar.Value == "" && envVar.SecretRef != nil):
+			value, err := r.accessVar(ctx, envVar)
+			if err != nil {
+				return ResolvedVar{}, err
+			}
+			return ResolvedVar{Name: name, Value: value, Source: SourceSecret}, nil
+		case envVar.Value != "":
+			return ResolvedVar{Name: name, Value: envVar.Value, Source: SourceConfig}, nil
+		case envVar.FieldRef != "":
+			return ResolvedVar{Name: name, Value: r.fieldValue(envVar.FieldRef), Source: SourceConfig}, nil
+		}
+	}
+
+	// Which keys a secret map holds is only known once it's fetched, the last one wins
+	for i := len(r.opts.SecretMaps) - 1; i >= 0; i-- {
+		secretMap := r.opts.SecretMaps[i]
+		if !strings.HasPrefix(name, secretMap.Prefix) {
+			continue
+		}
+
+		vars, err := r.expandSecretMap(ctx, secretMap)
+		if err != nil {
+			return ResolvedVar{}, &SecretError{Op: "expand", Secret: secretMap.SecretRef.Secret(), Err: err}
+		}
+		for _, v := range vars {
+			if v.Name == name {
+				return v, nil
+			}
+		}
+	}
+
+	for _, v := range r.metadataVars() {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+
+	return ResolvedVar{}, fmt.Errorf("%s: %w", name, ErrNotDeclared)
+}
+
+// ResolvedFile is a resolved file of a secret volume
+type ResolvedFile struct {
+	Path      string // Absolute path of the file in the container
+	SecretRef *config.SecretRef
+	Value     string
+}
+
+// ResolveFiles fetches the secrets of the secret volume files the container mounts, in the
+// order they are mounted. Lockfile pins apply to them like to variables.
+func (r *Resolver) ResolveFiles(ctx context.Context) ([]ResolvedFile, error) {
+	files := make([]ResolvedFile, 0, len(r.config.SecretFiles))
+	for _, file := range r.config.SecretFiles {
+		value, err := r.accessSecret(ctx, file.SecretRef)
+		if err != nil {
+			return nil, &SecretError{Op: "access", Secret: file.SecretRef.Secret(), Err: err}
+		}
+		files = append(files, ResolvedFile{Path: file.Path, SecretRef: file.SecretRef, Value: value})
+	}
+	return files, nil
+}
+
+// FetchesSecrets reports whether resolving the environment of the config fetches any secret,
+// from a variable or a secret map, with the options' Only, PrefixFilter, FileVars, LazySecrets
+// and SecretRefs applied
+func FetchesSecrets(cfg *config.Config, opts Options) bool {
+	r := &Resolver{config: cfg, opts: opts}
+	for _, secretMap := range opts.SecretMaps {
+		if r.wantedPrefix(secretMap.Prefix) {
+			return true
+		}
+	}
+	for _, fileVar := range opts.SecretFileVars {
+		if r.wanted(fileVar.Name) && !r.fromFile(fileVar.Name) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(cfg.EnvironmentVars, func(envVar config.EnvVar) bool {
+		if !r.wanted(envVar.Name) || r.fromFile(envVar.Name) || opts.SecretRefs {
+			return false
+		}
+		// sm:// values are fetched up front even with LazySecrets, like those of other providers
+		if IsSecretReference(envVar.Value) {
+			return true
+		}
+		return envVar.Value == "" && envVar.SecretRef != nil && !opts.LazySecrets
+	})
+}
+
+// provider returns the provider of the secret the value references with a URL, if any
+func (r *Resolver) provider(value string) (SecretProvider, bool) {
+	scheme, _, ok := strings.Cut(value, "://")
+	if !ok {
+		return nil, false
+	}
+	if scheme == SecretManagerScheme {
+		return secretManagerProvider{resolver: r}, true
+	}
+	provider, ok := r.opts.Providers[scheme]
+	return provider, ok
+}
+
+// wanted reports whether the variable is resolved, which is all of them unless Only or
+// PrefixFilter is set
+func (r *Resolver) wanted(name string) bool {
+	return r.named(name) && strings.HasPrefix(name, r.opts.PrefixFilter)
+}
+
+// named reports whether the variable is named by Only, or Only isn't set. Automatic
+// variables are only subject to Only.
+func (r *Resolver) named(name string) bool {
+	return len(r.opts.Only) == 0 || slices.Contains(r.opts.Only, name)
+}
+
+// fromFile reports whether the variable is overridden by a file variable, which makes
+// fetching its secret unnecessary
+func (r *Resolver) fromFile(name string) bool {
+	return slices.ContainsFunc(r.opts.FileVars, func(v ResolvedVar) bool {
+		return v.Name == name
+	})
+}
+
+// wantedPrefix reports whether any resolved variable may start with the prefix
+func (r *Resolver) wantedPrefix(prefix string) bool {
+	if !strings.HasPrefix(prefix, r.opts.PrefixFilter) && !strings.HasPrefix(r.opts.PrefixFilter, prefix) {
+		return false
+	}
+	if len(r.opts.Only) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.opts.Only, func(name string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+// metadataVars returns the automatic variables Cloud Run sets for every container, followed
+// by the additional ones of the options
+func (r *Resolver) metadataVars() []ResolvedVar {
+	if r.opts.ContainerEnvOnly {
+		return nil
+	}
+
+	var result []ResolvedVar
+	if EmitsServiceVars(r.config, r.opts.EmitServiceVars) {
+		result = append(result, ServiceVars(r.config, r.opts.Revision)...)
+	}
+	result = append(result, JobVars(r.config)...)
+	result = append(result, ResolvedVar{Name: "GOOGLE_CLOUD_PROJECT", Value: r.config.ProjectID, Source: SourceMetadata})
+	if r.config.Region != "" {
+		result = append(result, ResolvedVar{Name: "CLOUD_RUN_REGION", Value: r.config.Region, Source: SourceMetadata})
+	}
+	if r.config.Timeout > 0 {
+		result = append(result, ResolvedVar{Name: "CLOUD_RUN_TIMEOUT_SECONDS", Value: TimeoutSeconds(r.config), Source: SourceMetadata})
+	}
+	if r.creds.CredsFile != "" {
+		result = append(result, ResolvedVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: r.creds.CredsFile, Source: SourceMetadata})
+	}
+	return append(result, r.opts.MetadataVars...)
+}
+
+// TimeoutSeconds returns the timeout of the config in whole seconds, as timeoutSeconds sets it
+func TimeoutSeconds(cfg *config.Config) string {
+	return strconv.Itoa(int(cfg.Timeout / time.Second))
+}
+
+// EmitsServiceVars reports whether the config gets K_SERVICE, K_CONFIGURATION and K_REVISION,
+// which Cloud Run only sets for services, unless forced
+func EmitsServiceVars(cfg *config.Config, force bool) bool {
+	return cfg.Kind != "Job" || force
+}
+
+// ServiceVars returns K_SERVICE, K_CONFIGURATION and K_REVISION of the config, with the
+// revision DefaultRevision if empty
+func ServiceVars(cfg *config.Config, revision string) []ResolvedVar {
+	var result []ResolvedVar
+	if cfg.ServiceName != "" {
+		// The configuration of a service is always named after it
+		result = append(result,
+			ResolvedVar{Name: "K_SERVICE", Value: cfg.ServiceName, Source: SourceMetadata},
+			ResolvedVar{Name: "K_CONFIGURATION", Value: cfg.ServiceName, Source: SourceMetadata},
+		)
+	}
+	if revision == "" {
+		revision = DefaultRevision
+	}
+	return append(result, ResolvedVar{Name: "K_REVISION", Value: revision, Source: SourceMetadata})
+}
+
+// JobVars returns the variables Cloud Run sets for the task of a job execution, none for a
+// service. The job runs as the single task of an execution named after DefaultRevision.
+func JobVars(cfg *config.Config) []ResolvedVar {
+	if cfg.Kind != "Job" {
+		return nil
+	}
+	return []ResolvedVar{
+		{Name: "CLOUD_RUN_JOB", Value: cfg.ServiceName, Source: SourceMetadata},
+		{Name: "CLOUD_RUN_EXECUTION", Value: cfg.ServiceName + "-" + DefaultRevision, Source: SourceMetadata},
+		{Name: "CLOUD_RUN_TASK_INDEX", Value: "0", Source: SourceMetadata},
+		{Name: "CLOUD_RUN_TASK_ATTEMPT", Value: "0", Source: SourceMetadata},
+		{Name: "CLOUD_RUN_TASK_COUNT", Value: "1", Source: SourceMetadata},
+	}
+}
+
+// secretFetches are the concurrent fetches of the secrets of the config's variables
+type secretFetches struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	done   []chan struct{} // Closed once the fetch of the variable at the index ends, nil if it isn't fetched
+	values []string
+	errs   []error
+}
+
+// startFetches starts fetching the secret referenced by each environment variable
+// concurrently, at most MaxConcurrentSecrets at once, from Secret Manager or the provider of
+// its value. Every reference is fetched at its own version, so variables referencing
+// different versions of one secret get their own values. The first failure cancels all
+// other fetches.
+func (r *Resolver) startFetches(ctx context.Context) *secretFetches {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	f := &secretFetches{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make([]chan struct{}, len(r.config.EnvironmentVars)),
+		values: make([]string, len(r.config.EnvironmentVars)),
+		errs:   make([]error, len(r.config.EnvironmentVars)),
+	}
+	for i, envVar := range r.config.EnvironmentVars {
+		if r.fetched(envVar) {
+			f.done[i] = make(chan struct{})
+		}
+	}
+
+	limit := r.opts.MaxConcurrentSecrets
+	if limit <= 0 {
+		limit = DefaultMaxConcurrentSecrets
+	}
+	semaphore := make(chan struct{}, limit)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for i, envVar := range r.config.EnvironmentVars {
+			if f.done[i] == nil {
+				continue
+			}
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-fetchCtx.Done():
+			}
+			// Don't start any more fetches once resolution is canceled
+			if err := fetchCtx.Err(); err != nil {
+				f.errs[i] = err
+				close(f.done[i])
+				continue
+			}
+
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				defer close(f.done[i])
+				defer func() { <-semaphore }()
+
+				value, err := r.accessVar(fetchCtx, envVar)
+				if err != nil {
+					f.errs[i] = err
+					cancel()
+					return
+				}
+				f.values[i] = value
+			}()
+		}
+	}()
+	return f
+}
+
+// value waits for the fetch of the secret of the variable at the index and returns its
+// value. If it failed, the error wait returns is.
+func (f *secretFetches) value(i int) (string, error) {
+	<-f.done[i]
+	if f.errs[i] != nil {
+		return "", f.wait()
+	}
+	return f.values[i], nil
+}
+
+// wait waits for all fetches to end and returns the error of the first failed variable in
+// config order
+func (f *secretFetches) wait() error {
+	f.wg.Wait()
+
+	// Fetches aborted because a sibling failed report cancellation, which is not the cause
+	var canceledErr error
+	for _, err := range f.errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if canceledErr == nil {
+			canceledErr = err
+		}
+	}
+	if canceledErr != nil {
+		return canceledErr
+	}
+	return f.ctx.Err()
+}
+
+// stop cancels the fetches still running and waits for them to end
+func (f *secretFetches) stop() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+// fetched reports whether startFetches fetches the secret the variable references
+func (r *Resolver) fetched(envVar config.EnvVar) bool {
+	if !r.wanted(envVar.Name) || r.fromFile(envVar.Name) || r.opts.SecretRefs {
+		return false
+	}
+	if _, ok := r.provider(envVar.Value); ok {
+		return true
+	}
+	return envVar.Value == "" && envVar.SecretRef != nil && !r.opts.LazySecrets
+}
+
+// accessVar fetches the secret the variable references, from the provider of its value or
+// from Secret Manager
+func (r *Resolver) accessVar(ctx context.Context, envVar config.EnvVar) (string, error) {
+	if provider, ok := r.provider(envVar.Value); ok {
+		value, err := provider.Access(ctx, envVar.Value)
+		if err != nil {
+			return "", &SecretError{Op: "access", Secret: envVar.Value, Err: err}
+		}
+		return value, nil
+	}
+
+	value, err := r.accessSecret(ctx, envVar.SecretRef)
+	if err != nil {
+		return "", &SecretError{Op: "access", Secret: envVar.SecretRef.Secret(), Err: err}
+	}
+	return value, nil
+}
+
+// Fallback is a reference listing several versions that resolved to another than its first
+type Fallback struct {
+	Secret  string  // As referenced
+	Key     string  // Versions of the reference, e.g. 5,4,latest
+	Version string  // Version used
+	Skipped []error // Why each version before it was skipped
+}
+
+// accessSecret fetches a secret at the first version of its key that exists and is enabled.
+// Versions that don't exist, are disabled or destroyed fall back to the next one, other
+// errors fail at once.
+func (r *Resolver) accessSecret(ctx context.Context, ref *config.SecretRef) (string, error) {
+	versions := ref.Versions()
+	if len(versions) == 1 {
+		secret, err := r.accessVersion(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		r.recordVersion(ref, secret.Version)
+		return secret.Value, nil
+	}
+
+	var errs []error
+	for _, version := range versions {
+		candidate := *ref
+		candidate.Key = version
+		secret, err := r.accessVersion(ctx, &candidate)
+		if err == nil {
+			if len(errs) > 0 {
+				r.lockMu.Lock()
+				r.fallbacks = append(r.fallbacks, Fallback{Secret: ref.Secret(), Key: strings.Join(versions, ","), Version: version, Skipped: errs})
+				r.lockMu.Unlock()
+			}
+			r.recordVersion(ref, secret.Version)
+			return secret.Value, nil
+		}
+		if !errors.Is(err, secrets.ErrNotFound) && !errors.Is(err, secrets.ErrDisabled) && !errors.Is(err, secrets.ErrDestroyed) {
+			return "", fmt.Errorf("version %s: %w", version, err)
+		}
+		errs = append(errs, fmt.Errorf("version %s: %w", version, err))
+	}
+	return "", fmt.Errorf("no version of %s is usable: %w", ref.Key, errors.Join(errs...))
+}
+
+// Fallbacks returns the references listing several versions that resolved to another than
+// their first, fetched so far
+func (r *Resolver) Fallbacks() []Fallback {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+	return slices.Clone(r.fallbacks)
+}
+
+// accessVersion fetches a secret at a single version, honoring the lockfile pins for
+// "latest" references
+func (r *Resolver) accessVersion(ctx context.Context, ref *config.SecretRef) (*secrets.SecretVersion, error) {
+	if ref.Key == "latest" && r.opts.LatestAs != "" {
+		secret, err := r.secrets.AccessSecretVersion(ctx, ref.Secret(), r.opts.LatestAs)
+		if errors.Is(err, secrets.ErrNotFound) {
+			return nil, fmt.Errorf("version %s used for latest does not exist: %w", r.opts.LatestAs, err)
+		}
+		if err != nil {
+			return nil, versionStateError(r.opts.LatestAs, err)
+		}
+		return secret, nil
+	}
+
+	lock := r.opts.Lockfile
+	if lock == nil || ref.Key != "latest" {
+		secret, err := r.secrets.AccessSecretVersion(ctx, ref.Secret(), ref.Key)
+		if err != nil {
+			return nil, r.latestStateError(ctx, ref, versionStateError(ref.Key, err))
+		}
+		if ref.Key == "latest" {
+			r.recordLatest(ref, secret.Version)
+		}
+		return secret, nil
+	}
+
+	r.lockMu.Lock()
+	pinned, ok := lock.Lookup(ref.Secret())
+	r.lockMu.Unlock()
+
+	if ok && !r.opts.UpdateLock {
+		secret, err := r.secrets.AccessSecretVersion(ctx, ref.Secret(), pinned.Version)
+		if errors.Is(err, secrets.ErrNotFound) {
+			return nil, fmt.Errorf("pinned version %s no longer exists, refresh the lockfile with --update-lock: %w", pinned.Version, err)
+		}
+		if err != nil {
+			return nil, versionStateError(pinned.Version, err)
+		}
+		return secret, nil
+	}
+
+	secret, err := r.secrets.AccessSecretVersion(ctx, ref.Secret(), ref.Key)
+	if err != nil {
+		return nil, r.latestStateError(ctx, ref, versionStateError(ref.Key, err))
+	}
+	r.lockMu.Lock()
+	lock.Pin(ref.Secret(), secret.Version, time.Now().UTC())
+	r.lockMu.Unlock()
+	r.recordLatest(ref, secret.Version)
+
+	return secret, nil
+}
+
+// recordVersion records the concrete version a reference resolved to
+func (r *Resolver) recordVersion(ref *config.SecretRef, version string) {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+	if r.versions == nil {
+		r.versions = make(map[string]string)
+	}
+	r.versions[ref.Secret()+"@"+ref.Key] = version
+}
+
+// ResolvedVersion returns the concrete version the reference resolved to, reporting whether
+// it was fetched
+func (r *Resolver) ResolvedVersion(ref *config.SecretRef) (string, bool) {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+	version, ok := r.versions[ref.Secret()+"@"+ref.Key]
+	return version, ok
+}
+
+// recordLatest records the version a latest reference resolved to
+func (r *Resolver) recordLatest(ref *config.SecretRef, version string) {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+	if r.latest == nil {
+		r.latest = make(map[string]string)
+	}
+	r.latest[ref.Secret()] = version
+}
+
+// LatestVersions returns the versions the latest references fetched so far resolved to, by
+// secret as referenced. References pinned by the lockfile or by LatestAs aren't included.
+func (r *Resolver) LatestVersions() map[string]string {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+	return maps.Clone(r.latest)
+}
+
+// versionStateError explains how to recover from accessing a disabled or destroyed version
+func versionStateError(version string, err error) error {
+	switch {
+	case version == "latest" && errors.Is(err, secrets.ErrDisabled):
+		return fmt.Errorf("the newest secret version is disabled; enable it or reference another version: %w", err)
+	case version == "latest" && errors.Is(err, secrets.ErrDestroyed):
+		return fmt.Errorf("the newest secret version is destroyed; add a new version or reference another one: %w", err)
+	case errors.Is(err, secrets.ErrDisabled):
+		return fmt.Errorf("secret version %s is disabled; enable it or reference latest: %w", version, err)
+	case errors.Is(err, secrets.ErrDestroyed):
+		return fmt.Errorf("secret version %s is destroyed; reference another version or latest: %w", version, err)
+	default:
+		return err
+	}
+}
+
+// latestStateError adds the newest enabled version to the error of a latest reference whose
+// newest version is disabled or destroyed, as a version to pin instead. The error is returned
+// as is if the versions can't be listed, which the Secret Accessor role doesn't allow.
+func (r *Resolver) latestStateError(ctx context.Context, ref *config.SecretRef, err error) error {
+	if ref.Key != "latest" || !(errors.Is(err, secrets.ErrDisabled) || errors.Is(err, secrets.ErrDestroyed)) {
+		return err
+	}
+
+	enabled, listErr := r.secrets.LatestEnabledVersion(ctx, ref.Secret())
+	switch {
+	case listErr == nil:
+		return fmt.Errorf("%w (the newest enabled version is %s)", err, enabled)
+	case errors.Is(listErr, secrets.ErrNoEnabledVersion):
+		return fmt.Errorf("%w (no version is enabled)", err)
+	default:
+		return err
+	}
+}
+
+// secretReference returns the sm:// reference of the secret version, with short names in the
+// project of the config
+func (r *Resolver) secretReference(ref *config.SecretRef) string {
+	secret := ref.Secret()
+	if !strings.HasPrefix(secret, "projects/") {
+		secret = fmt.Sprintf("projects/%s/secrets/%s", r.config.ProjectID, secret)
+	}
+	return fmt.Sprintf("%s://%s/versions/%s", SecretManagerScheme, secret, ref.Key)
+}
+
+// SecretManagerScheme is the scheme of values referencing a Secret Manager secret version,
+// such as the ones SecretRefs prints: sm://projects/p/secrets/name/versions/v
+const SecretManagerScheme = "sm"
+
+// secretManagerProvider fetches the secret versions of sm:// values with the resolver's own
+// client, so they're pinned, fall back and are recorded like the ones of secretKeyRef
+type secretManagerProvider struct {
+	resolver *Resolver
+}
+
+// Access implements SecretProvider
+func (p secretManagerProvider) Access(ctx context.Context, reference string) (string, error) {
+	ref, err := parseSecretReference(reference)
+	if err != nil {
+		return "", err
+	}
+	return p.resolver.accessSecret(ctx, ref)
+}
+
+// IsSecretReference reports whether the value references a Secret Manager secret version
+func IsSecretReference(value string) bool {
+	return strings.HasPrefix(value, SecretManagerScheme+"://")
+}
+
+// parseSecretReference returns the secret version an sm:// value references
+func parseSecretReference(reference string) (*config.SecretRef, error) {
+	rest, ok := strings.CutPrefix(reference, SecretManagerScheme+"://")
+	parts := strings.Split(rest, "/")
+	if !ok || len(parts) != 6 || parts[0] != "projects" || parts[2] != "secrets" || parts[4] != "versions" || slices.Contains(parts, "") {
+		return nil, fmt.Errorf("invalid reference %s, expected %s://projects/PROJECT/secrets/NAME/versions/VERSION", reference, SecretManagerScheme)
+	}
+	return &config.SecretRef{Project: parts[1], Name: parts[3], Key: parts[5]}, nil
+}
+
+// fieldValue returns the local value of a downward API field path
+func (r *Resolver) fieldValue(fieldPath string) string {
+	return FieldValue(r.config, fieldPath)
+}
+
+// FieldValue returns the local value of a downward API field path of the config
+func FieldValue(cfg *config.Config, fieldPath string) string {
+	switch fieldPath {
+	case config.FieldPathName:
+		return cfg.ServiceName
+	case config.FieldPathNamespace:
+		// Cloud Run uses the project as the namespace
+		return cfg.ProjectID
+	case config.FieldPathServiceAccount:
+		return cfg.ServiceAccount
+	default:
+		return ""
+	}
+}
+
+// expandSecretMap fetches a secret holding a flat JSON object and returns a variable per key,
+// sorted by name
+func (r *Resolver) expandSecretMap(ctx context.Context, secretMap SecretMap) ([]ResolvedVar, error) {
+	value, err := r.accessSecret(ctx, &secretMap.SecretRef)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]any
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, errors.New("value is not a JSON object")
+	}
+
+	vars := make([]ResolvedVar, 0, len(object))
+	for key, raw := range object {
+		var value string
+		switch raw := raw.(type) {
+		case string:
+			value = raw
+		case json.Number:
+			value = raw.String()
+		case bool:
+			value = strconv.FormatBool(raw)
+		case nil:
+		default:
+			return nil, fmt.Errorf("value of key %s is not a scalar, expected a flat JSON object", key)
+		}
+		vars = append(vars, ResolvedVar{Name: secretMap.Prefix + key, Value: value, Source: SourceSecret})
+	}
+
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name < vars[j].Name
+	})
+
+	return vars, nil
+}
+
 // Cleanup removes temporary files created during resolution
 func (r *Resolver) Cleanup() error {
+	var errs []error
 	if r.creds != nil {
-		return r.creds.Cleanup()
+		errs = append(errs, r.creds.Cleanup())
 	}
-	return nil
+	errs = append(errs, r.secrets.Close())
+	if r.filesDir != "" {
+		errs = append(errs, os.RemoveAll(r.filesDir))
+		r.filesDir = ""
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,401 @@
+package env
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngalaiko/cloudrun-local/internal/auth"
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+	"github.com/ngalaiko/cloudrun-local/internal/httpclient"
+	"github.com/ngalaiko/cloudrun-local/internal/secrets"
+)
+
+// fakeSecretManager serves secret versions like the Secret Manager REST API, by the path of
+// the version, e.g. projects/my-project/secrets/db/versions/latest. As a transport, it also
+// records requests a canceled client never sends, and answers them regardless.
+type fakeSecretManager struct {
+	values map[string]string
+	states map[string]string       // States of versions that can't be accessed, such as DISABLED
+	before func(req *http.Request) // Called before serving each request, if set
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeSecretManager) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/"), ":access")
+	f.mu.Lock()
+	f.requests = append(f.requests, path)
+	f.mu.Unlock()
+	if f.before != nil {
+		f.before(req)
+	}
+
+	w := httptest.NewRecorder()
+	if state, ok := f.states[path]; ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.WriteString(`{"error": {"code": 400, "message": "Secret Version [` + path + `] is in ` + state + ` state.", "status": "FAILED_PRECONDITION"}}`)
+		return w.Result(), nil
+	}
+	value, ok := f.values[path]
+	if !ok {
+		http.NotFound(w, req)
+		return w.Result(), nil
+	}
+	_, _ = w.WriteString(`{"name": "` + path + `", "payload": {"data": "` + base64.StdEncoding.EncodeToString([]byte(value)) + `"}}`)
+	return w.Result(), nil
+}
+
+// requested returns the paths of the versions requested so far
+func (f *fakeSecretManager) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// newTestResolver returns a resolver of the variables reading secrets from the fake as an
+// emulator. Automatic variables are left out unless opts enables them.
+func newTestResolver(t *testing.T, fake *fakeSecretManager, vars []config.EnvVar, opts Options) *Resolver {
+	t.Helper()
+
+	t.Setenv(secrets.EmulatorHostEnv, "secretmanager.test")
+
+	if !opts.EmitServiceVars {
+		opts.ContainerEnvOnly = true
+	}
+	return &Resolver{
+		config:  &config.Config{Kind: "Service", ServiceName: "my-service", ProjectID: "my-project", EnvironmentVars: vars},
+		creds:   &auth.Credentials{},
+		secrets: secrets.NewClient(&http.Client{Transport: fake}, "", "my-project"),
+		opts:    opts,
+	}
+}
+
+func TestStream(t *testing.T) {
+	release := make(chan struct{})
+	fake := &fakeSecretManager{
+		values: map[string]string{
+			"projects/my-project/secrets/fast/versions/latest": "fast-value",
+			"projects/my-project/secrets/slow/versions/latest": "slow-value",
+		},
+		before: func(req *http.Request) {
+			if !strings.Contains(req.URL.Path, "/slow/") {
+				return
+			}
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+				t.Error("the variables before SLOW weren't emitted while its secret was fetched")
+			}
+		},
+	}
+	resolver := newTestResolver(t, fake, []config.EnvVar{
+		{Name: "LITERAL", Value: "one"},
+		{Name: "FAST", SecretRef: &config.SecretRef{Name: "fast", Key: "latest"}},
+		{Name: "SLOW", SecretRef: &config.SecretRef{Name: "slow", Key: "latest"}},
+	}, Options{})
+
+	// The slow secret is only served once the variables before it were emitted
+	var got []string
+	err := resolver.Stream(t.Context(), func(v ResolvedVar) error {
+		got = append(got, v.String())
+		if v.Name == "FAST" {
+			close(release)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"LITERAL=one", "FAST=fast-value", "SLOW=slow-value"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResolveStopsFetchingOnceCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	fake := &fakeSecretManager{
+		values: map[string]string{
+			"projects/my-project/secrets/first/versions/latest":  "1",
+			"projects/my-project/secrets/second/versions/latest": "2",
+			"projects/my-project/secrets/third/versions/latest":  "3",
+		},
+		// Canceled while the first secret is served
+		before: func(*http.Request) { cancel() },
+	}
+	resolver := newTestResolver(t, fake, []config.EnvVar{
+		{Name: "FIRST", SecretRef: &config.SecretRef{Name: "first", Key: "latest"}},
+		{Name: "SECOND", SecretRef: &config.SecretRef{Name: "second", Key: "latest"}},
+		{Name: "THIRD", SecretRef: &config.SecretRef{Name: "third", Key: "latest"}},
+	}, Options{MaxConcurrentSecrets: 1})
+
+	if _, err := resolver.Resolve(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	want := []string{"projects/my-project/secrets/first/versions/latest"}
+	if got := fake.requested(); !slices.Equal(got, want) {
+		t.Errorf("requested %q, want %q", got, want)
+	}
+}
+
+func TestResolveReportsFirstFailedVariable(t *testing.T) {
+	fake := &fakeSecretManager{
+		// The earlier secret only fails once the later one did
+		before: func(req *http.Request) {
+			if strings.Contains(req.URL.Path, "/earlier/") {
+				<-req.Context().Done()
+			}
+		},
+	}
+	resolver := newTestResolver(t, fake, []config.EnvVar{
+		{Name: "EARLIER", SecretRef: &config.SecretRef{Name: "earlier", Key: "latest"}},
+		{Name: "LATER", SecretRef: &config.SecretRef{Name: "later", Key: "latest"}},
+	}, Options{})
+
+	_, err := resolver.Resolve(t.Context())
+	var secretErr *SecretError
+	if !errors.As(err, &secretErr) || secretErr.Secret != "earlier" {
+		t.Errorf("got error %v, want the one of secret earlier", err)
+	}
+	if !errors.Is(err, secrets.ErrNotFound) {
+		t.Errorf("got error %v, want %v", err, secrets.ErrNotFound)
+	}
+}
+
+func TestAccessSecretFallback(t *testing.T) {
+	fake := &fakeSecretManager{
+		values: map[string]string{
+			"projects/my-project/secrets/db/versions/2": "two",
+		},
+		states: map[string]string{
+			"projects/my-project/secrets/db/versions/3": "DISABLED",
+			"projects/my-project/secrets/db/versions/1": "DESTROYED",
+		},
+	}
+	resolver := newTestResolver(t, fake, nil, Options{})
+
+	tests := []struct {
+		name        string
+		ref         config.SecretRef
+		want        string
+		wantSkipped int
+		wantErrs    []error
+	}{
+		{name: "first version usable", ref: config.SecretRef{Name: "db", Key: "2,3"}, want: "two"},
+		{name: "past a disabled version", ref: config.SecretRef{Name: "db", Key: "3,2"}, want: "two", wantSkipped: 1},
+		{name: "past a missing and a disabled version", ref: config.SecretRef{Name: "db", Key: "4,3,2"}, want: "two", wantSkipped: 2},
+		{name: "no version usable", ref: config.SecretRef{Name: "db", Key: "3,1"}, wantErrs: []error{secrets.ErrDisabled, secrets.ErrDestroyed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver.fallbacks = nil
+
+			value, err := resolver.accessSecret(t.Context(), &tt.ref)
+			if tt.wantErrs != nil {
+				for _, want := range tt.wantErrs {
+					if !errors.Is(err, want) {
+						t.Errorf("got error %v, want %v", err, want)
+					}
+				}
+				if want := "no version of " + tt.ref.Key + " is usable"; err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %v, want it to contain %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != tt.want {
+				t.Errorf("got %q, want %q", value, tt.want)
+			}
+
+			fallbacks := resolver.Fallbacks()
+			switch {
+			case tt.wantSkipped == 0 && len(fallbacks) != 0:
+				t.Errorf("got fallbacks %+v, want none", fallbacks)
+			case tt.wantSkipped > 0 && (len(fallbacks) != 1 || len(fallbacks[0].Skipped) != tt.wantSkipped):
+				t.Errorf("got fallbacks %+v, want one skipping %d versions", fallbacks, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestResolveVersionsOfOneSecret(t *testing.T) {
+	fake := &fakeSecretManager{
+		values: map[string]string{
+			"projects/my-project/secrets/db/versions/latest": "three",
+			"projects/my-project/secrets/db/versions/2":      "two",
+		},
+	}
+	resolver := newTestResolver(t, fake, []config.EnvVar{
+		{Name: "CURRENT", SecretRef: &config.SecretRef{Name: "db", Key: "latest"}},
+		{Name: "PREVIOUS", SecretRef: &config.SecretRef{Name: "db", Key: "2"}},
+	}, Options{})
+
+	vars, err := resolver.Resolve(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, v := range vars {
+		got = append(got, v.String())
+	}
+	want := []string{"CURRENT=three", "PREVIOUS=two"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResolveSecretManagerReferences(t *testing.T) {
+	fake := &fakeSecretManager{
+		values: map[string]string{
+			"projects/other-project/secrets/db/versions/latest": "s3cret",
+		},
+	}
+	resolver := newTestResolver(t, fake, []config.EnvVar{
+		{Name: "DB_PASSWORD", Value: "sm://projects/other-project/secrets/db/versions/latest"},
+		{Name: "BROKEN", Value: "sm://db/versions/latest"},
+	}, Options{Only: []string{"DB_PASSWORD"}})
+
+	vars, err := resolver.Resolve(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 1 || vars[0].String() != "DB_PASSWORD=s3cret" || vars[0].Source != SourceSecret {
+		t.Errorf("got %v, want DB_PASSWORD=s3cret from a secret", vars)
+	}
+
+	if _, err := resolver.ResolveOne(t.Context(), "BROKEN"); err == nil || !strings.Contains(err.Error(), "invalid reference") {
+		t.Errorf("got error %v, want an invalid reference", err)
+	}
+}
+
+func TestServiceAndJobVars(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		opts     Options
+		want     []string
+		wantNone []string
+	}{
+		{
+			name:     "service",
+			kind:     "Service",
+			want:     []string{"K_SERVICE=migrate", "K_REVISION=local"},
+			wantNone: []string{"CLOUD_RUN_JOB", "CLOUD_RUN_TASK_INDEX"},
+		},
+		{
+			name: "job",
+			kind: "Job",
+			want: []string{
+				"CLOUD_RUN_JOB=migrate",
+				"CLOUD_RUN_EXECUTION=migrate-local",
+				"CLOUD_RUN_TASK_INDEX=0",
+				"CLOUD_RUN_TASK_ATTEMPT=0",
+				"CLOUD_RUN_TASK_COUNT=1",
+			},
+			wantNone: []string{"K_SERVICE", "K_CONFIGURATION", "K_REVISION"},
+		},
+		{
+			name: "job with service vars",
+			kind: "Job",
+			opts: Options{EmitServiceVars: true},
+			want: []string{"K_SERVICE=migrate", "K_REVISION=local", "CLOUD_RUN_JOB=migrate"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &Resolver{
+				config: &config.Config{Kind: tt.kind, ServiceName: "migrate", ProjectID: "my-project"},
+				creds:  &auth.Credentials{},
+				opts:   tt.opts,
+			}
+			vars, err := resolver.Resolve(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for _, v := range vars {
+				got[v.Name] = v.String()
+			}
+			for _, want := range tt.want {
+				name, _, _ := strings.Cut(want, "=")
+				if got[name] != want {
+					t.Errorf("got %q, want %q", got[name], want)
+				}
+			}
+			for _, name := range tt.wantNone {
+				if v, ok := got[name]; ok {
+					t.Errorf("got %q, want no %s", v, name)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkResolve50Secrets(b *testing.B) {
+	var dials atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":access")
+		_, _ = w.Write([]byte(`{"name": "` + path + `", "payload": {"data": "` + base64.StdEncoding.EncodeToString([]byte("value")) + `"}}`))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	b.Cleanup(server.Close)
+	b.Setenv(secrets.EmulatorHostEnv, strings.TrimPrefix(server.URL, "http://"))
+
+	vars := make([]config.EnvVar, 50)
+	for i := range vars {
+		vars[i] = config.EnvVar{Name: fmt.Sprintf("SECRET_%d", i), SecretRef: &config.SecretRef{Name: fmt.Sprintf("secret-%d", i), Key: "latest"}}
+	}
+
+	// The default transport keeps only 2 idle connections per host, so most of the concurrent
+	// fetches dial again
+	clients := []struct {
+		name   string
+		client *http.Client
+	}{
+		{name: "default transport", client: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}},
+		{name: "shared client", client: httpclient.New()},
+	}
+	for _, c := range clients {
+		b.Run(c.name, func(b *testing.B) {
+			dials.Store(0)
+			for b.Loop() {
+				resolver := &Resolver{
+					config:  &config.Config{Kind: "Service", ServiceName: "my-service", ProjectID: "my-project", EnvironmentVars: vars},
+					creds:   &auth.Credentials{},
+					secrets: secrets.NewClient(c.client, "", "my-project"),
+					opts:    Options{ContainerEnvOnly: true},
+				}
+				if _, err := resolver.Resolve(b.Context()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(dials.Load())/float64(b.N), "dials/op")
+		})
+	}
+}
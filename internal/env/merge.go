@@ -0,0 +1,51 @@
+package env
+
+import "strings"
+
+// SourceShell is the source of variables inherited from the current environment
+const SourceShell Source = "shell"
+
+// Override describes a variable whose value is shadowed by one with higher precedence
+type Override struct {
+	Overridden ResolvedVar
+	By         ResolvedVar
+}
+
+// FromEnviron converts KEY=value strings, as returned by os.Environ, to variables
+func FromEnviron(environ []string) []ResolvedVar {
+	vars := make([]ResolvedVar, 0, len(environ))
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		vars = append(vars, ResolvedVar{Name: name, Value: value, Source: SourceShell})
+	}
+	return vars
+}
+
+// Merge combines layers of variables, later layers taking precedence over earlier ones.
+// Variables keep the position of their first occurrence. Every shadowed value is
+// reported as an override, in the order they were encountered.
+func Merge(layers ...[]ResolvedVar) ([]ResolvedVar, []Override) {
+	var (
+		merged    []ResolvedVar
+		overrides []Override
+		index     = make(map[string]int)
+	)
+
+	for _, layer := range layers {
+		for _, v := range layer {
+			i, ok := index[v.Name]
+			if !ok {
+				index[v.Name] = len(merged)
+				merged = append(merged, v)
+				continue
+			}
+			overrides = append(overrides, Override{Overridden: merged[i], By: v})
+			merged[i] = v
+		}
+	}
+
+	return merged, overrides
+}
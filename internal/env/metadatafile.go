@@ -0,0 +1,37 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReadMetadataFile reads additional automatic variables from a YAML or JSON file holding a
+// flat object of names and scalar values. The variables are returned sorted by name.
+func ReadMetadataFile(filename string) ([]ResolvedVar, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", filename, err)
+	}
+
+	// JSON is YAML, so both are read alike
+	var values map[string]string
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("parse %s, expected an object of names and scalar values: %w", filename, err)
+	}
+
+	vars := make([]ResolvedVar, 0, len(values))
+	for name, value := range values {
+		if name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("%s: invalid variable name %q", filename, name)
+		}
+		vars = append(vars, ResolvedVar{Name: name, Value: value, Source: SourceMetadata})
+	}
+	slices.SortFunc(vars, func(a, b ResolvedVar) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return vars, nil
+}
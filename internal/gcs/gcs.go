@@ -0,0 +1,100 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Scheme is the scheme of values referencing a Cloud Storage object: gcs://bucket/object
+const Scheme = "gcs"
+
+// baseURL is the Cloud Storage JSON API endpoint
+const baseURL = "https://storage.googleapis.com"
+
+// maxObjectSize is the size of the largest object read, as its contents end up in memory
+// or an environment variable
+const maxObjectSize = 10 << 20
+
+// ErrNotFound is returned when the bucket or object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Client reads objects from Cloud Storage. Tokens are only requested once an object is read.
+type Client struct {
+	httpClient *http.Client
+	tokens     oauth2.TokenSource
+}
+
+// NewClient creates a client reading objects with the tokens of the token source
+func NewClient(httpClient *http.Client, tokens oauth2.TokenSource) *Client {
+	return &Client{httpClient: httpClient, tokens: tokens}
+}
+
+// IsReference reports whether the value references a Cloud Storage object
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Scheme+"://")
+}
+
+// ParseURL returns the bucket and object a gcs://bucket/object URL references
+func ParseURL(reference string) (bucket, object string, err error) {
+	rest, ok := strings.CutPrefix(reference, Scheme+"://")
+	if ok {
+		bucket, object, ok = strings.Cut(rest, "/")
+	}
+	if !ok || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid reference %s, expected %s://bucket/object", reference, Scheme)
+	}
+	return bucket, object, nil
+}
+
+// Access returns the contents of the object the gcs://bucket/object URL references. Errors
+// don't repeat the URL, which the caller reports.
+func (c *Client) Access(ctx context.Context, reference string) (string, error) {
+	bucket, object, err := ParseURL(reference)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := c.tokens.Token()
+	if err != nil {
+		return "", fmt.Errorf("get access token: %w", err)
+	}
+
+	// Object names may contain slashes, which are escaped as part of the name
+	endpoint := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", baseURL, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	token.SetAuthHeader(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("bucket %s: %w", bucket, ErrNotFound)
+	case resp.StatusCode == http.StatusForbidden:
+		return "", fmt.Errorf("permission denied, the service account needs storage.objects.get on bucket %s, e.g. with the Storage Object Viewer role", bucket)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("expected 200 response status, received %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxObjectSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxObjectSize {
+		return "", fmt.Errorf("object is larger than %d MiB", maxObjectSize>>20)
+	}
+	return string(data), nil
+}
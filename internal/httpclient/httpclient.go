@@ -0,0 +1,26 @@
+package httpclient
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// maxIdleConnsPerHost keeps enough connections open to serve concurrent secret fetches
+	// from the pool, the default of 2 makes most of them dial a new connection
+	maxIdleConnsPerHost = 64
+	// idleConnTimeout is how long an unused connection is kept open for reuse
+	idleConnTimeout = 90 * time.Second
+)
+
+// New creates the HTTP client shared by all Google API calls, so connections are reused
+// between token minting and secret fetches
+func New() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+
+	return &http.Client{Transport: transport}
+}
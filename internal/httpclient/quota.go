@@ -0,0 +1,44 @@
+package httpclient
+
+import (
+	"net/http"
+	"slices"
+)
+
+// quotaProjectHosts are the APIs whose quota is billed to the quota project
+var quotaProjectHosts = []string{
+	"iamcredentials.googleapis.com",
+	"secretmanager.googleapis.com",
+}
+
+// WithQuotaProject returns a client that sends the IAM Credentials and Secret Manager
+// requests of the client with the x-goog-user-project header, billing their quota to the
+// project. Other requests, such as token refreshes of the default credentials, are left as is.
+func WithQuotaProject(client *http.Client, project string) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrapped := *client
+	wrapped.Transport = &quotaProjectTransport{base: transport, project: project}
+	return &wrapped
+}
+
+// quotaProjectTransport sets the quota project header on requests to quotaProjectHosts
+type quotaProjectTransport struct {
+	base    http.RoundTripper
+	project string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *quotaProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(quotaProjectHosts, req.URL.Hostname()) {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Goog-User-Project", t.project)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,121 @@
+package iam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Endpoints of the APIs whose resources permissions are tested on
+const (
+	resourceManagerURL = "https://cloudresourcemanager.googleapis.com"
+	secretManagerURL   = "https://secretmanager.googleapis.com"
+	storageURL         = "https://storage.googleapis.com"
+)
+
+// Client tests which permissions the identity of an access token has, with the
+// testIamPermissions method of the API owning each resource
+type Client struct {
+	httpClient  *http.Client
+	accessToken string
+}
+
+// NewClient creates a client testing the permissions of the access token's identity
+func NewClient(httpClient *http.Client, accessToken string) *Client {
+	return &Client{httpClient: httpClient, accessToken: accessToken}
+}
+
+// ValidateResource checks that permissions can be tested on the resource, which is one of
+// projects/PROJECT, projects/PROJECT/secrets/SECRET or buckets/BUCKET
+func ValidateResource(resource string) error {
+	parts := strings.Split(resource, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "projects" && parts[1] != "",
+		len(parts) == 4 && parts[0] == "projects" && parts[1] != "" && parts[2] == "secrets" && parts[3] != "",
+		len(parts) == 2 && parts[0] == "buckets" && parts[1] != "":
+		return nil
+	default:
+		return fmt.Errorf("unsupported resource %s, expected projects/PROJECT, projects/PROJECT/secrets/SECRET or buckets/BUCKET", resource)
+	}
+}
+
+// Missing returns the permissions the identity doesn't have on the resource, in the order
+// given. The APIs reject permissions that don't apply to the resource's type.
+func (c *Client) Missing(ctx context.Context, resource string, permissions []string) ([]string, error) {
+	if err := ValidateResource(resource); err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if bucket, ok := strings.CutPrefix(resource, "buckets/"); ok {
+		// Cloud Storage has its own API, taking the permissions as query parameters
+		query := url.Values{"permissions": permissions}
+		endpoint := fmt.Sprintf("%s/storage/v1/b/%s/iam/testPermissions?%s", storageURL, url.PathEscape(bucket), query.Encode())
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = r
+	} else {
+		baseURL := resourceManagerURL
+		if strings.Contains(resource, "/secrets/") {
+			baseURL = secretManagerURL
+		}
+		body, err := json.Marshal(map[string][]string{"permissions": permissions})
+		if err != nil {
+			return nil, err
+		}
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v1/%s:testIamPermissions", baseURL, resource), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		req = r
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, responseError(resp, resource)
+	}
+
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return nil, fmt.Errorf("decode permissions of %s: %w", resource, err)
+	}
+
+	var missing []string
+	for _, permission := range permissions {
+		if !slices.Contains(granted.Permissions, permission) {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// responseError returns the error of an unexpected response, with the message the API reports
+func responseError(resp *http.Response, resource string) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		return fmt.Errorf("test permissions on %s: received %d: %s", resource, resp.StatusCode, body.Error.Message)
+	}
+	return fmt.Errorf("test permissions on %s: expected 200 response status, received %d", resource, resp.StatusCode)
+}
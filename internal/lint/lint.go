@@ -0,0 +1,172 @@
+package lint
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ngalaiko/cloudrun-local/internal/config"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severity is how serious a violation is
+type Severity string
+
+// Severities of violations, only errors fail validation
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// servicePlaceholder is replaced by the service name in secret name patterns
+const servicePlaceholder = "{service}"
+
+// Rules are the lint rules loaded from a rules file. Every rule is optional.
+type Rules struct {
+	// SecretNames requires secret names to match a pattern, e.g. ^{service}-[a-z-]+$
+	SecretNames *struct {
+		Pattern  string   `yaml:"pattern"`
+		Severity Severity `yaml:"severity"`
+	} `yaml:"secretNames"`
+	// RequiredEnv requires variables to be defined
+	RequiredEnv *struct {
+		Names    []string `yaml:"names"`
+		Severity Severity `yaml:"severity"`
+	} `yaml:"requiredEnv"`
+	// PlaintextValues disallows literal values for variables matching glob patterns, e.g. *_PASSWORD
+	PlaintextValues *struct {
+		Names    []string `yaml:"names"`
+		Severity Severity `yaml:"severity"`
+	} `yaml:"plaintextValues"`
+}
+
+// Violation is a rule violated by the config
+type Violation struct {
+	Path     string
+	Severity Severity
+	Message  string
+}
+
+// String returns the violation in "severity: path: message" form
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Severity, v.Path, v.Message)
+}
+
+// Load reads and checks the rules file
+func Load(filename string) (*Rules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read rules file: %w", err)
+	}
+
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("unmarshal rules: %w", err)
+	}
+
+	if rules.SecretNames != nil {
+		if err := checkSeverity(&rules.SecretNames.Severity); err != nil {
+			return nil, fmt.Errorf("secretNames: %w", err)
+		}
+		if _, err := compilePattern(rules.SecretNames.Pattern, "service"); err != nil {
+			return nil, fmt.Errorf("secretNames: %w", err)
+		}
+	}
+
+	if rules.RequiredEnv != nil {
+		if err := checkSeverity(&rules.RequiredEnv.Severity); err != nil {
+			return nil, fmt.Errorf("requiredEnv: %w", err)
+		}
+	}
+
+	if rules.PlaintextValues != nil {
+		if err := checkSeverity(&rules.PlaintextValues.Severity); err != nil {
+			return nil, fmt.Errorf("plaintextValues: %w", err)
+		}
+		for _, name := range rules.PlaintextValues.Names {
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, fmt.Errorf("plaintextValues: invalid pattern %s: %w", name, err)
+			}
+		}
+	}
+
+	return &rules, nil
+}
+
+// Check returns the violations of the rules in the config, in config order
+func (r *Rules) Check(cfg *config.Config) []Violation {
+	var violations []Violation
+
+	defined := make(map[string]bool, len(cfg.EnvironmentVars))
+	for _, envVar := range cfg.EnvironmentVars {
+		defined[envVar.Name] = true
+		envPath := envVar.Path
+		if envPath == "" {
+			envPath = cfg.EnvPath
+		}
+
+		if r.SecretNames != nil && envVar.SecretRef != nil {
+			// The pattern was checked when loading the rules
+			pattern, _ := compilePattern(r.SecretNames.Pattern, cfg.ServiceName)
+			if !pattern.MatchString(envVar.SecretRef.Name) {
+				violations = append(violations, Violation{
+					Path:     envPath,
+					Severity: r.SecretNames.Severity,
+					Message:  fmt.Sprintf("secret name %s doesn't match %s", envVar.SecretRef.Name, pattern),
+				})
+			}
+		}
+
+		if r.PlaintextValues != nil && envVar.SecretRef == nil && envVar.FieldRef == "" && envVar.Value != "" {
+			for _, name := range r.PlaintextValues.Names {
+				if matched, _ := path.Match(name, envVar.Name); matched {
+					violations = append(violations, Violation{
+						Path:     envPath,
+						Severity: r.PlaintextValues.Severity,
+						Message:  fmt.Sprintf("%s has a literal value, reference a secret instead", envVar.Name),
+					})
+					break
+				}
+			}
+		}
+	}
+
+	if r.RequiredEnv != nil {
+		for _, name := range r.RequiredEnv.Names {
+			if !defined[name] {
+				violations = append(violations, Violation{
+					Path:     cfg.EnvPath,
+					Severity: r.RequiredEnv.Severity,
+					Message:  fmt.Sprintf("required variable %s is not defined", name),
+				})
+			}
+		}
+	}
+
+	return violations
+}
+
+// checkSeverity defaults an empty severity to error and rejects unknown ones
+func checkSeverity(severity *Severity) error {
+	switch *severity {
+	case "":
+		*severity = SeverityError
+		return nil
+	case SeverityError, SeverityWarning:
+		return nil
+	default:
+		return fmt.Errorf("unknown severity %s (expected %s or %s)", *severity, SeverityError, SeverityWarning)
+	}
+}
+
+// compilePattern compiles a secret name pattern for the service
+func compilePattern(pattern, serviceName string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(strings.ReplaceAll(pattern, servicePlaceholder, regexp.QuoteMeta(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,94 @@
+package lockfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Lockfile pins the concrete versions that "latest" secret references resolved to
+type Lockfile struct {
+	Secrets []Entry `json:"secrets"`
+
+	changed bool
+}
+
+// Entry is a single pinned secret version
+type Entry struct {
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+}
+
+// Load reads a lockfile, returning an empty lockfile if it does not exist yet
+func Load(filename string) (*Lockfile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Lockfile{}, nil
+		}
+		return nil, fmt.Errorf("read lockfile: %w", err)
+	}
+
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("unmarshal lockfile %s: %w", filename, err)
+	}
+
+	return &lock, nil
+}
+
+// Lookup returns the pinned version of a secret
+func (l *Lockfile) Lookup(name string) (Entry, bool) {
+	for _, entry := range l.Secrets {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Pin records the version a secret resolved to
+func (l *Lockfile) Pin(name, version string, resolvedAt time.Time) {
+	for i, entry := range l.Secrets {
+		if entry.Name != name {
+			continue
+		}
+		if entry.Version != version {
+			l.Secrets[i] = Entry{Name: name, Version: version, ResolvedAt: resolvedAt}
+			l.changed = true
+		}
+		return
+	}
+
+	l.Secrets = append(l.Secrets, Entry{Name: name, Version: version, ResolvedAt: resolvedAt})
+	l.changed = true
+}
+
+// Changed reports whether any pins were added or updated since loading
+func (l *Lockfile) Changed() bool {
+	return l.changed
+}
+
+// Save writes the lockfile with entries sorted by secret name
+func (l *Lockfile) Save(filename string) error {
+	sort.Slice(l.Secrets, func(i, j int) bool {
+		return l.Secrets[i].Name < l.Secrets[j].Name
+	})
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal lockfile: %w", err)
+	}
+
+	//nolint:gosec // lockfile holds no secret values and is meant to be shared
+	if err := os.WriteFile(filename, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write lockfile: %w", err)
+	}
+
+	l.changed = false
+	return nil
+}
@@ -0,0 +1,271 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// refreshWindow is how long before expiry the background refresher renews the token
+	refreshWindow = 5 * time.Minute
+	// retryInterval is how long to wait before retrying failed background work
+	retryInterval = 5 * time.Second
+	// shutdownTimeout bounds how long in-flight requests may take on shutdown
+	shutdownTimeout = 5 * time.Second
+)
+
+// SecretProvider returns the values of secret-backed variables, fetching them on demand
+type SecretProvider interface {
+	// Secret returns the value of the variable, or an error matching ErrUnknownVariable if
+	// the variable isn't provided
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// ErrUnknownVariable is returned by a SecretProvider for a variable it doesn't provide
+var ErrUnknownVariable = errors.New("unknown variable")
+
+// Server emulates the subset of the GCE metadata server used by Google client libraries
+type Server struct {
+	serviceAccount string
+	projectID      string
+	tokens         oauth2.TokenSource
+	logger         *slog.Logger
+	secrets        SecretProvider
+	region         string
+
+	listener net.Listener
+}
+
+// NewServer creates a metadata server handing out tokens from the token source.
+// Failures of the background plumbing, which are retried, are logged as warnings.
+func NewServer(serviceAccount, projectID string, tokens oauth2.TokenSource, logger *slog.Logger) *Server {
+	return &Server{
+		serviceAccount: serviceAccount,
+		projectID:      projectID,
+		tokens:         tokens,
+		logger:         logger,
+	}
+}
+
+// ServeSecrets serves the variables of the provider at /cloudrun-local/v1/env/NAME, which
+// isn't part of the metadata API. Must be called before Run.
+func (s *Server) ServeSecrets(provider SecretProvider) {
+	s.secrets = provider
+}
+
+// ServeRegion serves the region at /computeMetadata/v1/instance/region, which Cloud Run
+// reports as projects/PROJECT_NUMBER/regions/REGION. The project number isn't known
+// locally, so the project ID takes its place. Must be called before Run.
+func (s *Server) ServeRegion(region string) {
+	s.region = region
+}
+
+// Listen binds the server to the given address
+func (s *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Run serves metadata requests and keeps the token fresh until the context is canceled.
+// The HTTP server is restarted on the same address if it fails.
+func (s *Server) Run(ctx context.Context) error {
+	if s.listener == nil {
+		return errors.New("metadata server is not listening")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.refreshTokens(ctx)
+	}()
+	defer wg.Wait()
+
+	addr := s.Addr()
+	for {
+		err := s.serve(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.logger.WarnContext(ctx, "metadata server failed, restarting", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retryInterval):
+		}
+
+		if err := s.Listen(addr); err != nil {
+			s.logger.WarnContext(ctx, "restart metadata server", "error", err)
+		}
+	}
+}
+
+// serve runs the HTTP server on the current listener until it fails or the context is canceled
+func (s *Server) serve(ctx context.Context) error {
+	httpServer := &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- httpServer.Serve(s.listener)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		<-errChan
+		return nil
+	}
+}
+
+// refreshTokens renews the token shortly before it expires so requests never wait on minting
+func (s *Server) refreshTokens(ctx context.Context) {
+	for {
+		wait := retryInterval
+
+		token, err := s.tokens.Token()
+		if err != nil {
+			s.logger.WarnContext(ctx, "refresh access token", "error", err)
+		} else if !token.Expiry.IsZero() {
+			wait = max(time.Until(token.Expiry)-refreshWindow+time.Second, retryInterval)
+		} else {
+			wait = refreshWindow
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// handler returns the HTTP handler serving the metadata endpoints
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) {
+		writeText(w, "computeMetadata/")
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/project/project-id", func(w http.ResponseWriter, _ *http.Request) {
+		writeText(w, s.projectID)
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/email", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isServiceAccount(r.PathValue("account")) {
+			http.NotFound(w, r)
+			return
+		}
+		writeText(w, s.serviceAccount)
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/scopes", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isServiceAccount(r.PathValue("account")) {
+			http.NotFound(w, r)
+			return
+		}
+		writeText(w, "https://www.googleapis.com/auth/cloud-platform")
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/instance/service-accounts/{account}/token", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isServiceAccount(r.PathValue("account")) {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveToken(w)
+	})
+	if s.region != "" {
+		mux.HandleFunc("GET /computeMetadata/v1/instance/region", func(w http.ResponseWriter, _ *http.Request) {
+			writeText(w, fmt.Sprintf("projects/%s/regions/%s", s.projectID, s.region))
+		})
+	}
+	if s.secrets != nil {
+		mux.HandleFunc("GET /cloudrun-local/v1/env/{name}", func(w http.ResponseWriter, r *http.Request) {
+			value, err := s.secrets.Secret(r.Context(), r.PathValue("name"))
+			switch {
+			case errors.Is(err, ErrUnknownVariable):
+				http.NotFound(w, r)
+			case err != nil:
+				s.logger.WarnContext(r.Context(), "fetch secret", "variable", r.PathValue("name"), "error", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			default:
+				writeText(w, value)
+			}
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The health check isn't part of the metadata API, so plain curl works
+		if r.URL.Path == "/healthz" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			writeText(w, "ok")
+			return
+		}
+
+		w.Header().Set("Metadata-Flavor", "Google")
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "Missing Metadata-Flavor: Google header", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// isServiceAccount reports whether the account path segment refers to the served service account
+func (s *Server) isServiceAccount(account string) bool {
+	return account == "default" || account == s.serviceAccount
+}
+
+// serveToken writes the current access token in the metadata server format
+func (s *Server) serveToken(w http.ResponseWriter) {
+	token, err := s.tokens.Token()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("get access token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Clients refresh early based on expires_in, so it must never be negative
+	expiresIn := int64(0)
+	if !token.Expiry.IsZero() {
+		expiresIn = max(int64(time.Until(token.Expiry).Seconds()), 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}{
+		AccessToken: token.AccessToken,
+		ExpiresIn:   expiresIn,
+		TokenType:   "Bearer",
+	})
+}
+
+// writeText writes a plain text metadata value
+func writeText(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", "application/text")
+	_, _ = w.Write([]byte(value))
+}
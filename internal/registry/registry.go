@@ -0,0 +1,343 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Media types of the accepted manifests
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Platform of the image variant Cloud Run runs
+const (
+	cloudRunPlatformOS   = "linux"
+	cloudRunPlatformArch = "amd64"
+)
+
+const (
+	// dockerHubRegistry is the registry of images without a host, like docker.io/library/alpine
+	dockerHubRegistry = "registry-1.docker.io"
+	// dockerHubOfficialNamespace is the namespace of single-component Docker Hub images
+	dockerHubOfficialNamespace = "library/"
+	// defaultTag is the tag of images without a tag or digest
+	defaultTag = "latest"
+	// googleRegistryUsername is the username that makes Google registries accept an access token
+	googleRegistryUsername = "oauth2accesstoken"
+	// maxResponseSize bounds the size of manifests, configs and errors read from registries
+	maxResponseSize = 4 << 20
+)
+
+// Reference is a parsed image reference
+type Reference struct {
+	Registry   string // Host of the registry, e.g. europe-docker.pkg.dev
+	Repository string // Path of the repository in the registry
+	Reference  string // Tag or digest
+}
+
+// ParseReference parses an image reference such as europe-docker.pkg.dev/p/repo/app:v1,
+// defaulting to Docker Hub and the latest tag like docker does
+func ParseReference(image string) (*Reference, error) {
+	if image == "" {
+		return nil, errors.New("empty image reference")
+	}
+
+	ref := &Reference{Registry: dockerHubRegistry}
+
+	name := image
+	if host, rest, ok := strings.Cut(image, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.Registry, name = host, rest
+	}
+	if ref.Registry == "docker.io" || ref.Registry == "index.docker.io" {
+		ref.Registry = dockerHubRegistry
+	}
+
+	switch {
+	case strings.Contains(name, "@"):
+		// A digest pins the image, a tag next to it is ignored
+		name, ref.Reference, _ = strings.Cut(name, "@")
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			name = name[:i]
+		}
+	case strings.LastIndex(name, ":") > strings.LastIndex(name, "/"):
+		i := strings.LastIndex(name, ":")
+		name, ref.Reference = name[:i], name[i+1:]
+	default:
+		ref.Reference = defaultTag
+	}
+
+	if name == "" || ref.Reference == "" {
+		return nil, fmt.Errorf("invalid image reference %s", image)
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = dockerHubOfficialNamespace + name
+	}
+	ref.Repository = name
+
+	return ref, nil
+}
+
+// at returns the image reference with the given tag or digest
+func (r *Reference) at(reference string) string {
+	if strings.Contains(reference, ":") {
+		return r.Registry + "/" + r.Repository + "@" + reference
+	}
+	return r.Registry + "/" + r.Repository + ":" + reference
+}
+
+// IsGoogleRegistry reports whether the registry is Artifact Registry or Container Registry,
+// which accept Google access tokens
+func IsGoogleRegistry(host string) bool {
+	return host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev")
+}
+
+// Client reads image configs from registries implementing the OCI distribution API
+type Client struct {
+	httpClient  *http.Client
+	accessToken string // Google access token, only sent to Google registries
+}
+
+// NewClient creates a registry client authenticating to Google registries with the access token.
+// Other registries are accessed anonymously.
+func NewClient(httpClient *http.Client, accessToken string) *Client {
+	return &Client{
+		httpClient:  httpClient,
+		accessToken: accessToken,
+	}
+}
+
+// manifest is an image manifest or an index of manifests per platform
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// ImageEnv returns the ENV defaults from the config of the image, in KEY=value form.
+// For multi-platform images, the linux/amd64 image Cloud Run runs is used.
+func (c *Client) ImageEnv(ctx context.Context, image string) ([]string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	var token string
+	m, err := c.manifest(ctx, ref, ref.Reference, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Manifests) > 0 {
+		digest := ""
+		for _, platformManifest := range m.Manifests {
+			if platformManifest.Platform.OS == cloudRunPlatformOS && platformManifest.Platform.Architecture == cloudRunPlatformArch {
+				digest = platformManifest.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, fmt.Errorf("image %s has no %s/%s variant", image, cloudRunPlatformOS, cloudRunPlatformArch)
+		}
+
+		m, err = c.manifest(ctx, ref, digest, &token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest of image %s has no config", image)
+	}
+
+	body, err := c.get(ctx, ref, "blobs/"+m.Config.Digest, "", &token)
+	if err != nil {
+		return nil, fmt.Errorf("get config of image %s: %w", image, err)
+	}
+
+	var config struct {
+		Config struct {
+			Env []string `json:"Env"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf("unmarshal config of image %s: %w", image, err)
+	}
+
+	return config.Config.Env, nil
+}
+
+// manifest fetches the manifest of the tag or digest
+func (c *Client) manifest(ctx context.Context, ref *Reference, reference string, token *string) (*manifest, error) {
+	accept := strings.Join([]string{mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest}, ", ")
+	body, err := c.get(ctx, ref, "manifests/"+reference, accept, token)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest of %s: %w", ref.at(reference), err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// get fetches a path of the repository, exchanging credentials for a registry token when
+// challenged. The token is kept for the following requests to the same repository.
+func (c *Client) get(ctx context.Context, ref *Reference, resource, accept string, token *string) ([]byte, error) {
+	endpoint := fmt.Sprintf("https://%s/v2/%s/%s", ref.Registry, ref.Repository, resource)
+
+	resp, err := c.do(ctx, endpoint, accept, *token)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && *token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+
+		*token, err = c.registryToken(ctx, ref, challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = c.do(ctx, endpoint, accept, *token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if IsGoogleRegistry(ref.Registry) {
+			return nil, fmt.Errorf("access denied (HTTP %d), grant the service account roles/artifactregistry.reader", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("access denied (HTTP %d), only public images of registries outside Google Cloud are supported", resp.StatusCode)
+	case http.StatusNotFound:
+		return nil, errors.New("not found")
+	default:
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+// do sends a GET request with the registry token, if any
+func (c *Client) do(ctx context.Context, endpoint, accept, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	return resp, nil
+}
+
+// registryToken gets a pull token from the token service named in a Bearer challenge.
+// Google registries exchange the access token, other registries hand out anonymous tokens.
+func (c *Client) registryToken(ctx context.Context, ref *Reference, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+
+	values := parseChallenge(params)
+	realm := values["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry authentication challenge without realm: %q", challenge)
+	}
+
+	query := url.Values{}
+	if service := values["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", ref.Repository))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if IsGoogleRegistry(ref.Registry) && c.accessToken != "" {
+		req.SetBasicAuth(googleRegistryUsername, c.accessToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get registry token: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		return "", fmt.Errorf("get registry token: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("decode registry token: %w", err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// parseChallenge parses the comma-separated key="value" parameters of a challenge
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		values[strings.TrimSpace(key)] = value
+		params = rest
+	}
+	return values
+}
@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSecretManager serves secret versions by their name over gRPC
+type fakeSecretManager struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+
+	versions map[string]*secretmanagerpb.AccessSecretVersionResponse
+	listed   []*secretmanagerpb.SecretVersion // Versions of every secret, one per page
+}
+
+func (f *fakeSecretManager) AccessSecretVersion(_ context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	resp, ok := f.versions[req.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Secret Version [%s] not found.", req.GetName())
+	}
+	return resp, nil
+}
+
+func (f *fakeSecretManager) ListSecretVersions(_ context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	page := 0
+	if req.GetPageToken() != "" {
+		page, _ = strconv.Atoi(req.GetPageToken())
+	}
+	if page >= len(f.listed) {
+		return &secretmanagerpb.ListSecretVersionsResponse{}, nil
+	}
+	resp := &secretmanagerpb.ListSecretVersionsResponse{Versions: f.listed[page : page+1]}
+	if page+1 < len(f.listed) {
+		resp.NextPageToken = strconv.Itoa(page + 1)
+	}
+	return resp, nil
+}
+
+// newGRPCTestClient starts the fake as an emulator and returns a client connected to it
+func newGRPCTestClient(t *testing.T, fake *fakeSecretManager) *Client {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, fake)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	t.Setenv(EmulatorHostEnv, listener.Addr().String())
+	client, err := NewGRPCClient(t.Context(), nil, "my-project", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestGRPCAccessSecretVersion(t *testing.T) {
+	value := []byte("s3cret")
+	checksum := int64(crc32.Checksum(value, crc32cTable))
+	wrongChecksum := checksum + 1
+
+	client := newGRPCTestClient(t, &fakeSecretManager{versions: map[string]*secretmanagerpb.AccessSecretVersionResponse{
+		"projects/my-project/secrets/db/versions/latest": {
+			Name:    "projects/my-project/secrets/db/versions/3",
+			Payload: &secretmanagerpb.SecretPayload{Data: value, DataCrc32C: &checksum},
+		},
+		"projects/my-project/secrets/corrupted/versions/1": {
+			Name:    "projects/my-project/secrets/corrupted/versions/1",
+			Payload: &secretmanagerpb.SecretPayload{Data: value, DataCrc32C: &wrongChecksum},
+		},
+	}})
+
+	version, err := client.AccessSecretVersion(t.Context(), "db", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Value != "s3cret" || version.Version != "3" {
+		t.Errorf("got value %q at version %q, want %q at version %q", version.Value, version.Version, "s3cret", "3")
+	}
+
+	if _, err := client.AccessSecretVersion(t.Context(), "corrupted", "1"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("got error %v, want %v", err, ErrCorrupted)
+	}
+	if _, err := client.AccessSecretVersion(t.Context(), "missing", "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestGRPCLatestEnabledVersion(t *testing.T) {
+	client := newGRPCTestClient(t, &fakeSecretManager{listed: []*secretmanagerpb.SecretVersion{
+		{Name: "projects/my-project/secrets/db/versions/2", State: secretmanagerpb.SecretVersion_ENABLED},
+		{Name: "projects/my-project/secrets/db/versions/4", State: secretmanagerpb.SecretVersion_ENABLED},
+		{Name: "projects/my-project/secrets/db/versions/3", State: secretmanagerpb.SecretVersion_ENABLED},
+	}})
+
+	version, err := client.LatestEnabledVersion(t.Context(), "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "4" {
+		t.Errorf("got version %q, want %q", version, "4")
+	}
+}
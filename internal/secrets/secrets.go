@@ -4,64 +4,208 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 )
 
-// Client handles Secret Manager API access
+// EmulatorHostEnv is the environment variable with the host:port of a Secret Manager emulator.
+// If set, requests go to the emulator over plain HTTP without an access token.
+const EmulatorHostEnv = "SECRET_MANAGER_EMULATOR_HOST"
+
+// defaultBaseURL is the Secret Manager API endpoint
+const defaultBaseURL = "https://secretmanager.googleapis.com"
+
+// ErrNotFound is returned when the requested secret version does not exist
+var ErrNotFound = errors.New("secret version not found")
+
+// ErrDisabled is returned when the requested secret version is disabled
+var ErrDisabled = errors.New("secret version is disabled")
+
+// ErrDestroyed is returned when the requested secret version is destroyed
+var ErrDestroyed = errors.New("secret version is destroyed")
+
+// ErrCorrupted is returned when a secret payload doesn't match its CRC32C checksum
+var ErrCorrupted = errors.New("secret payload is corrupted")
+
+// crc32cTable is the Castagnoli table Secret Manager computes payload checksums with
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Client handles Secret Manager API access. One client serves secrets of all projects
+// the access token is allowed to read.
 type Client struct {
-	accessToken string
+	httpClient  *http.Client
+	baseURL     string
+	accessToken string // Empty when talking to an emulator
 	projectID   string
+
+	grpc *grpcTransport // Set if secrets are accessed over gRPC instead
 }
 
-// NewClient creates a new Secret Manager client
-func NewClient(accessToken, projectID string) *Client {
+// SecretVersion is a secret version value retrieved from Secret Manager
+type SecretVersion struct {
+	Version string // Concrete version number, also when "latest" was requested
+	Value   string
+}
+
+// NewClient creates a new Secret Manager client, looking up short secret names in projectID
+func NewClient(httpClient *http.Client, accessToken, projectID string) *Client {
+	if emulatorHost := os.Getenv(EmulatorHostEnv); emulatorHost != "" {
+		return &Client{
+			httpClient: httpClient,
+			baseURL:    "http://" + emulatorHost,
+			projectID:  projectID,
+		}
+	}
+
 	return &Client{
+		httpClient:  httpClient,
+		baseURL:     defaultBaseURL,
 		accessToken: accessToken,
 		projectID:   projectID,
 	}
 }
 
-// AccessSecretVersion retrieves a secret value from Secret Manager
-func (c *Client) AccessSecretVersion(ctx context.Context, secretName, version string) (string, error) {
-	secretPath := fmt.Sprintf("projects/%s/secrets/%s/versions/%s", c.projectID, secretName, version)
+// AccessSecretVersion retrieves a secret value from Secret Manager. The secret is either
+// a short name in the client's project or a full path such as projects/p/secrets/name.
+func (c *Client) AccessSecretVersion(ctx context.Context, secret, version string) (*SecretVersion, error) {
+	if !strings.HasPrefix(secret, "projects/") {
+		secret = fmt.Sprintf("projects/%s/secrets/%s", c.projectID, secret)
+	}
+	secretPath := fmt.Sprintf("%s/versions/%s", secret, version)
+	if c.grpc != nil {
+		return c.grpc.access(ctx, secretPath, version)
+	}
 
-	url := fmt.Sprintf("https://secretmanager.googleapis.com/v1/%s:access", secretPath)
+	url := fmt.Sprintf("%s/v1/%s:access", c.baseURL, secretPath)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if c.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", secretPath, ErrNotFound)
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return "", fmt.Errorf("expected 200 response status, received %d", resp.StatusCode)
+		return nil, responseError(resp, secretPath)
 	}
 
 	var responseBody struct {
+		Name    string `json:"name"`
 		Payload struct {
 			Data string `json:"data"`
+			// DataCrc32c is an int64, which is a string in JSON, and only set if it was
+			// provided when the version was added
+			DataCrc32c json.Number `json:"dataCrc32c"`
 		} `json:"payload"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if responseBody.Payload.Data == "" {
-		return "", fmt.Errorf("no value for secret %s", secretPath)
+		return nil, fmt.Errorf("no value for secret %s", secretPath)
 	}
 
-	decodedData, err := base64.StdEncoding.DecodeString(responseBody.Payload.Data)
+	decodedData, err := decodePayload(responseBody.Payload.Data)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("decode secret %s: %w", secretPath, err)
+	}
+
+	if err := verifyChecksum(decodedData, responseBody.Payload.DataCrc32c); err != nil {
+		return nil, fmt.Errorf("%s: %w", secretPath, err)
+	}
+
+	// The response name always carries the concrete version number
+	resolvedVersion := version
+	if responseBody.Name != "" {
+		resolvedVersion = path.Base(responseBody.Name)
+	}
+
+	return &SecretVersion{
+		Version: resolvedVersion,
+		Value:   string(decodedData),
+	}, nil
+}
+
+// Close closes the connection of a client accessing secrets over gRPC
+func (c *Client) Close() error {
+	if c.grpc == nil {
+		return nil
+	}
+	return c.grpc.client.Close()
+}
+
+// responseError converts a failed response into an error. Versions in the DISABLED or
+// DESTROYED state are reported with ErrDisabled and ErrDestroyed, as retrying won't help.
+func responseError(resp *http.Response, secretPath string) error {
+	var errorBody struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errorBody); err != nil || errorBody.Error.Status != "FAILED_PRECONDITION" {
+		return fmt.Errorf("expected 200 response status, received %d", resp.StatusCode)
+	}
+
+	// The state is only available in the message, e.g. "Secret Version [...] is in DISABLED state."
+	switch {
+	case strings.Contains(errorBody.Error.Message, "DISABLED state"):
+		return fmt.Errorf("%s: %w", secretPath, ErrDisabled)
+	case strings.Contains(errorBody.Error.Message, "DESTROYED state"):
+		return fmt.Errorf("%s: %w", secretPath, ErrDestroyed)
+	default:
+		return fmt.Errorf("%s: %s", secretPath, errorBody.Error.Message)
+	}
+}
+
+// verifyChecksum checks the payload against its CRC32C checksum, if there is one
+func verifyChecksum(data []byte, checksum json.Number) error {
+	if checksum == "" {
+		return nil
+	}
+
+	expected, err := strconv.ParseUint(checksum.String(), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid payload checksum %s: %w", checksum, err)
+	}
+	if actual := crc32.Checksum(data, crc32cTable); uint64(actual) != expected {
+		return fmt.Errorf("%w: CRC32C is %d, expected %d", ErrCorrupted, actual, expected)
+	}
+	return nil
+}
+
+// decodePayload decodes a secret payload, accepting both the standard and the URL-safe
+// base64 alphabets, with or without padding
+func decodePayload(data string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err == nil {
+		return decoded, nil
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.URLEncoding, base64.RawURLEncoding, base64.RawStdEncoding} {
+		if decoded, urlErr := encoding.DecodeString(data); urlErr == nil {
+			return decoded, nil
+		}
 	}
 
-	return string(decodedData), nil
+	return nil, err
 }
@@ -0,0 +1,158 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newRESTTestClient starts the handler as an emulator and returns a client connected to it
+func newRESTTestClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv(EmulatorHostEnv, strings.TrimPrefix(server.URL, "http://"))
+	return NewClient(server.Client(), "", "my-project")
+}
+
+// accessResponse writes a response of accessing the version with the payload and its checksum
+func accessResponse(w http.ResponseWriter, name string, data []byte, checksum uint32) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"name": "` + name + `", "payload": {"data": "` + base64.StdEncoding.EncodeToString(data) +
+		`", "dataCrc32c": "` + strconv.FormatUint(uint64(checksum), 10) + `"}}`))
+}
+
+func TestDecodePayload(t *testing.T) {
+	// Bytes whose encodings use the characters that differ between the alphabets
+	value := []byte{0xfb, 0xff, 0xfe, 's', 'e', 'c', 'r', 'e', 't'}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "standard", data: "+//+c2VjcmV0", want: value},
+		{name: "standard without padding", data: base64.RawStdEncoding.EncodeToString([]byte("secret!")), want: []byte("secret!")},
+		{name: "URL-safe", data: "-__-c2VjcmV0", want: value},
+		{name: "URL-safe without padding", data: base64.RawURLEncoding.EncodeToString([]byte("secret!")), want: []byte("secret!")},
+		{name: "invalid", data: "not base64!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePayload(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessSecretVersionChecksum(t *testing.T) {
+	value := []byte("s3cret")
+	checksum := crc32.Checksum(value, crc32cTable)
+
+	client := newRESTTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/my-project/secrets/db/versions/1:access":
+			accessResponse(w, "projects/my-project/secrets/db/versions/1", value, checksum)
+		case "/v1/projects/my-project/secrets/corrupted/versions/1:access":
+			accessResponse(w, "projects/my-project/secrets/corrupted/versions/1", value, checksum+1)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	version, err := client.AccessSecretVersion(t.Context(), "db", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Value != "s3cret" {
+		t.Errorf("got value %q, want %q", version.Value, "s3cret")
+	}
+
+	_, err = client.AccessSecretVersion(t.Context(), "corrupted", "1")
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("got error %v, want %v", err, ErrCorrupted)
+	}
+	if want := "CRC32C is " + strconv.FormatUint(uint64(checksum), 10); !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q, want it to contain %q", err, want)
+	}
+}
+
+func TestAccessSecretVersionState(t *testing.T) {
+	client := newRESTTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":access")
+		state := strings.ToUpper(strings.Split(name, "/")[3])
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "Secret Version [` + name + `] is in ` + state + ` state.", "status": "FAILED_PRECONDITION"}}`))
+	}))
+
+	tests := []struct {
+		secret  string
+		wantErr error
+		want    string
+	}{
+		{secret: "disabled", wantErr: ErrDisabled, want: "projects/my-project/secrets/disabled/versions/1: secret version is disabled"},
+		{secret: "destroyed", wantErr: ErrDestroyed, want: "projects/my-project/secrets/destroyed/versions/1: secret version is destroyed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.secret, func(t *testing.T) {
+			_, err := client.AccessSecretVersion(t.Context(), tt.secret, "1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmulator(t *testing.T) {
+	// Control characters and invalid UTF-8 survive the base64 encoding of the payload
+	value := []byte("line one\nline two\x00\xff")
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("got authorization %q, want none sent to the emulator", auth)
+		}
+		accessResponse(w, "projects/my-project/secrets/db/versions/7", value, crc32.Checksum(value, crc32cTable))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv(EmulatorHostEnv, strings.TrimPrefix(server.URL, "http://"))
+
+	client := NewClient(http.DefaultClient, "access-token", "my-project")
+	version, err := client.AccessSecretVersion(t.Context(), "db", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"GET /v1/projects/my-project/secrets/db/versions/latest:access"}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", requests, want)
+	}
+	if version.Value != string(value) || version.Version != "7" {
+		t.Errorf("got value %q at version %q, want %q at version %q", version.Value, version.Version, value, "7")
+	}
+}
@@ -0,0 +1,139 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listAttempts is how often a page of versions is requested before giving up
+	listAttempts = 3
+	// listBackoff is the wait before the first retry, doubled for each further one
+	listBackoff = 500 * time.Millisecond
+	// listPageSize is the number of versions requested per page
+	listPageSize = 100
+)
+
+// ErrNoEnabledVersion is returned by LatestEnabledVersion when no version of the secret is enabled
+var ErrNoEnabledVersion = errors.New("no enabled secret version")
+
+// versionsPage is a page of the versions of a secret
+type versionsPage struct {
+	Versions      []versionsPageEntry `json:"versions"`
+	NextPageToken string              `json:"nextPageToken"`
+}
+
+// versionsPageEntry is a version of a secret and its state, such as ENABLED
+type versionsPageEntry struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+// LatestEnabledVersion returns the number of the newest enabled version of the secret, which
+// is either a short name in the client's project or a full path. Every page of versions is
+// read, as the order of the list isn't guaranteed. Listing requires the
+// secretmanager.versions.list permission, which the Secret Accessor role doesn't include.
+func (c *Client) LatestEnabledVersion(ctx context.Context, secret string) (string, error) {
+	if !strings.HasPrefix(secret, "projects/") {
+		secret = fmt.Sprintf("projects/%s/secrets/%s", c.projectID, secret)
+	}
+
+	latest := 0
+	pageToken := ""
+	for {
+		page, err := c.listVersions(ctx, secret, pageToken)
+		if err != nil {
+			return "", err
+		}
+
+		for _, version := range page.Versions {
+			if version.State != "ENABLED" {
+				continue
+			}
+			if n, err := strconv.Atoi(path.Base(version.Name)); err == nil && n > latest {
+				latest = n
+			}
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	if latest == 0 {
+		return "", fmt.Errorf("%s: %w", secret, ErrNoEnabledVersion)
+	}
+	return strconv.Itoa(latest), nil
+}
+
+// listVersions requests a page of the enabled versions of the secret, retrying transient
+// failures such as rate limiting, server errors and dropped connections
+func (c *Client) listVersions(ctx context.Context, secret, pageToken string) (*versionsPage, error) {
+	if c.grpc != nil {
+		return c.grpc.listVersions(ctx, secret, pageToken)
+	}
+
+	query := url.Values{}
+	query.Set("filter", "state:ENABLED")
+	query.Set("pageSize", strconv.Itoa(listPageSize))
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	listURL := fmt.Sprintf("%s/v1/%s/versions?%s", c.baseURL, secret, query.Encode())
+
+	backoff := listBackoff
+	for attempt := 1; ; attempt++ {
+		page, transient, err := c.getVersionsPage(ctx, listURL, secret)
+		if err == nil || !transient || attempt == listAttempts {
+			return page, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// getVersionsPage requests a page of versions, reporting whether a failure is worth retrying
+func (c *Client) getVersionsPage(ctx context.Context, listURL, secret string) (*versionsPage, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("list versions of %s: %w", secret, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, fmt.Errorf("%s: %w", secret, ErrNotFound)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("list versions of %s: received %d", secret, resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, false, fmt.Errorf("list versions of %s: expected 200 response status, received %d", secret, resp.StatusCode)
+	}
+
+	var page versionsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, false, fmt.Errorf("decode versions of %s: %w", secret, err)
+	}
+	return &page, false, nil
+}
@@ -0,0 +1,32 @@
+package secrets
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLatestEnabledVersionPages(t *testing.T) {
+	client := newRESTTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/my-project/secrets/db/versions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("pageToken") {
+		case "":
+			_, _ = w.Write([]byte(`{"versions": [{"name": "projects/my-project/secrets/db/versions/3", "state": "DISABLED"}], "nextPageToken": "page-2"}`))
+		case "page-2":
+			_, _ = w.Write([]byte(`{"versions": [{"name": "projects/my-project/secrets/db/versions/2", "state": "ENABLED"}]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	version, err := client.LatestEnabledVersion(t.Context(), "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "2" {
+		t.Errorf("got version %q, want %q", version, "2")
+	}
+}
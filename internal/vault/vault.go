@@ -0,0 +1,151 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables configuring the client, the same the vault CLI reads
+const (
+	AddrEnv      = "VAULT_ADDR"
+	TokenEnv     = "VAULT_TOKEN"
+	NamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// Scheme is the scheme of values referencing a field of a Vault secret: vault://path#field
+const Scheme = "vault"
+
+// tokenFile is where vault login stores the token, relative to the home directory
+const tokenFile = ".vault-token"
+
+// ErrNotFound is returned when the secret or its field does not exist
+var ErrNotFound = errors.New("vault secret not found")
+
+// Client reads secrets from Vault. The address and token are read from the environment when
+// the client is created, a missing one is reported by the first read.
+type Client struct {
+	httpClient *http.Client
+	addr       string
+	token      string
+	namespace  string
+}
+
+// NewClient creates a client for the Vault of VAULT_ADDR, authenticating with VAULT_TOKEN or
+// the token vault login stored in ~/.vault-token
+func NewClient(httpClient *http.Client) *Client {
+	token := os.Getenv(TokenEnv)
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(home, tokenFile)); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+
+	return &Client{
+		httpClient: httpClient,
+		addr:       strings.TrimSuffix(os.Getenv(AddrEnv), "/"),
+		token:      token,
+		namespace:  os.Getenv(NamespaceEnv),
+	}
+}
+
+// IsReference reports whether the value references a Vault secret
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Scheme+"://")
+}
+
+// Access returns the field of the secret a vault://path#field reference points to. The path
+// is the API path of the secret, e.g. secret/data/app for version 2 of the KV engine
+// mounted at secret/. Values of fields that aren't strings are returned as JSON.
+func (c *Client) Access(ctx context.Context, reference string) (string, error) {
+	secretPath, field, ok := strings.Cut(strings.TrimPrefix(reference, Scheme+"://"), "#")
+	if !IsReference(reference) || !ok || secretPath == "" || field == "" {
+		return "", fmt.Errorf("invalid reference %s, expected %s://path#field", reference, Scheme)
+	}
+	switch {
+	case c.addr == "":
+		return "", fmt.Errorf("%s is not set", AddrEnv)
+	case c.token == "":
+		return "", fmt.Errorf("%s is not set and there is no token of vault login", TokenEnv)
+	}
+
+	data, err := c.read(ctx, secretPath)
+	if err != nil {
+		return "", err
+	}
+
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("%s has no field %s: %w", secretPath, field, ErrNotFound)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil
+	}
+	return string(raw), nil
+}
+
+// read returns the fields of the secret at the path. Secrets of version 2 of the KV engine
+// nest their fields next to their metadata, which is left out.
+func (c *Client) read(ctx context.Context, secretPath string) (map[string]json.RawMessage, error) {
+	url := fmt.Sprintf("%s/v1/%s", c.addr, strings.TrimPrefix(secretPath, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", secretPath, ErrNotFound)
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("read %s: permission denied, check the token and its policies", secretPath)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, responseError(resp, secretPath)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", secretPath, err)
+	}
+
+	nested, hasData := body.Data["data"]
+	if _, hasMetadata := body.Data["metadata"]; hasData && hasMetadata {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &fields); err == nil {
+			return fields, nil
+		}
+	}
+	return body.Data, nil
+}
+
+// responseError returns the error of an unexpected response, with the errors Vault reports
+func responseError(resp *http.Response, secretPath string) error {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		return fmt.Errorf("read %s: received %d: %s", secretPath, resp.StatusCode, strings.Join(body.Errors, "; "))
+	}
+	return fmt.Errorf("read %s: expected 200 response status, received %d", secretPath, resp.StatusCode)
+}